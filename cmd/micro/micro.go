@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"runtime"
 	"sort"
+	"syscall"
 
 	"github.com/go-errors/errors"
 	isatty "github.com/mattn/go-isatty"
@@ -184,6 +186,7 @@ func main() {
 			// backup all open buffers
 			for _, b := range buffer.OpenBuffers {
 				b.Backup(false)
+				b.SerializeNow()
 			}
 			// Print the stack trace too
 			fmt.Print(errors.Wrap(err, 2).ErrorStack())
@@ -221,6 +224,12 @@ func main() {
 
 	events = make(chan tcell.Event)
 
+	config.SetSerializeTime(int(config.GlobalSettings["serializeinterval"].(float64)))
+
+	// Keep the cursor and undo history when micro is killed
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM, syscall.SIGHUP)
+
 	// Here is the event loop which runs in a separate thread
 	go func() {
 		for {
@@ -252,10 +261,32 @@ func main() {
 		case f := <-shell.Jobs:
 			// If a new job has finished while running in the background we should execute the callback
 			f.Function(f.Output, f.Args...)
+		case f := <-buffer.LoadedLines:
+			// Lines of a file that is loading in the background
+			f()
 		case <-config.Autosave:
 			for _, b := range buffer.OpenBuffers {
 				b.Save()
 			}
+		case <-config.Autoserialize:
+			for _, b := range buffer.OpenBuffers {
+				b.SerializeNow()
+			}
+		case <-sigterm:
+			// Close the buffers like quitting does, which also removes their
+			// backups, but keep the cursor of the modified ones
+			for _, b := range append([]*buffer.Buffer(nil), buffer.OpenBuffers...) {
+				if b.Modified() {
+					b.SerializeNow()
+				}
+				b.Close()
+				for b.Refs() > 0 {
+					b.Close()
+				}
+			}
+			screen.Screen.Fini()
+			action.InfoBar.Close()
+			os.Exit(0)
 		case <-shell.CloseTerms:
 		case event = <-events:
 		case <-screen.DrawChan:
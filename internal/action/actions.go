@@ -1010,7 +1010,11 @@ func (h *BufPane) paste(clip string) {
 		h.Cursor.ResetSelection()
 	}
 
-	h.Buf.Insert(h.Cursor.Loc, clip)
+	if h.Buf.Settings["pasteindent"].(bool) {
+		h.Buf.InsertNormalizedIndent(h.Cursor.Loc, clip)
+	} else {
+		h.Buf.Insert(h.Cursor.Loc, clip)
+	}
 	// h.Cursor.Loc = h.Cursor.Loc.Move(Count(clip), h.Buf)
 	h.freshClip = false
 	if clipboard.Unsupported {
@@ -553,6 +553,8 @@ func SetGlobalOptionNative(option string, nativeValue interface{}) error {
 		// 	}
 	} else if option == "paste" {
 		screen.Screen.SetPaste(nativeValue.(bool))
+	} else if option == "serializeinterval" {
+		config.SetSerializeTime(int(nativeValue.(float64)))
 	} else {
 		for _, pl := range config.Plugins {
 			if option == pl.Name {
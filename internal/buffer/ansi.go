@@ -0,0 +1,105 @@
+package buffer
+
+import (
+	"io"
+)
+
+// The states of an ansiStripper
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI
+	ansiOSC
+	ansiOSCEscape
+	ansiCharset
+)
+
+// An ansiStripper removes ANSI escape sequences (such as colors) from text
+// It keeps its state between calls to strip, so a sequence may be split
+// across several pieces of text
+type ansiStripper struct {
+	state int
+}
+
+// strip appends src without escape sequences to dst
+func (s *ansiStripper) strip(dst, src []byte) []byte {
+	for _, c := range src {
+		switch s.state {
+		case ansiText:
+			if c == 0x1b {
+				s.state = ansiEscape
+			} else {
+				dst = append(dst, c)
+			}
+		case ansiEscape:
+			switch c {
+			case '[':
+				s.state = ansiCSI
+			case ']':
+				s.state = ansiOSC
+			case '(', ')', '*', '+':
+				s.state = ansiCharset
+			default:
+				s.state = ansiText
+			}
+		case ansiCSI:
+			// Parameters and intermediate bytes up to a final byte
+			if c >= 0x40 && c <= 0x7e {
+				s.state = ansiText
+			} else if c < 0x20 || c > 0x7e {
+				// Not a valid sequence, so the text goes on
+				s.state = ansiText
+				dst = append(dst, c)
+			}
+		case ansiOSC:
+			// Operating system commands end with BEL or ESC \
+			if c == 0x07 {
+				s.state = ansiText
+			} else if c == 0x1b {
+				s.state = ansiOSCEscape
+			}
+		case ansiOSCEscape, ansiCharset:
+			s.state = ansiText
+		}
+	}
+	return dst
+}
+
+// stripsANSI returns whether the stripansi option removes escape sequences
+// from the text of a buffer with the given settings and type
+// Only log and readonly buffers are stripped, because saving a file whose
+// escape sequences were removed would silently drop them from the file
+func stripsANSI(settings map[string]interface{}, t BufType) bool {
+	return settings["stripansi"].(bool) && (t.Readonly || settings["readonly"].(bool))
+}
+
+// ansiReader reads from r with the escape sequences removed
+type ansiReader struct {
+	r io.Reader
+	s ansiStripper
+}
+
+func (a *ansiReader) Read(p []byte) (int, error) {
+	for {
+		n, err := a.r.Read(p)
+		// The stripped text is never longer, so it can be written to p
+		n = len(a.s.strip(p[:0], p[:n]))
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Append adds text to the end of the buffer, even if it is readonly (which is
+// what log buffers are)
+// If the stripansi option is on, ANSI escape sequences are removed from the
+// text of log and readonly buffers, including sequences that are split across
+// several calls
+func (b *Buffer) Append(text string) {
+	if stripsANSI(b.Settings, b.Type) {
+		text = string(b.ansi.strip(nil, []byte(text)))
+	}
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.EventHandler.Insert(b.End(), text)
+}
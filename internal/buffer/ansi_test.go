@@ -0,0 +1,57 @@
+package buffer
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zyedidia/micro/internal/config"
+)
+
+const coloredText = "\x1b[1;31merror\x1b[0m: \x1b]0;title\x07file \x1b(Bnot found\x1b[K\n"
+
+func TestStripANSI(t *testing.T) {
+	var s ansiStripper
+	assert.Equal(t, "error: file not found\n", string(s.strip(nil, []byte(coloredText))))
+
+	// Sequences split across reads
+	r := &ansiReader{r: iotest.OneByteReader(strings.NewReader(coloredText))}
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "error: file not found\n", string(data))
+
+	// An escape that doesn't start a valid sequence only removes itself
+	s = ansiStripper{}
+	assert.Equal(t, "a\nb", string(s.strip(nil, []byte("a\x1b[\nb"))))
+}
+
+func TestStripANSIOption(t *testing.T) {
+	config.GlobalSettings["stripansi"] = true
+	b := NewBufferFromString(coloredText, "", BTLog)
+	config.GlobalSettings["stripansi"] = false
+	assert.Equal(t, "error: file not found\n", string(b.Bytes()))
+
+	b.Append("\x1b[32mok\x1b")
+	b.Append("[0m done")
+	assert.Equal(t, "error: file not found\nok done", string(b.Bytes()))
+
+	b.SetOptionNative("stripansi", false)
+	b.Append("\x1b[0m")
+	assert.Equal(t, "error: file not found\nok done\x1b[0m", string(b.Bytes()))
+
+	// Files that can be saved keep their escape sequences
+	config.GlobalSettings["stripansi"] = true
+	defer func() {
+		config.GlobalSettings["stripansi"] = false
+	}()
+	f := NewBufferFromString(coloredText, "", BTDefault)
+	assert.Equal(t, coloredText, string(f.Bytes()))
+	f.Append("\x1b[0m")
+	assert.Equal(t, coloredText+"\x1b[0m", string(f.Bytes()))
+
+	f.SetOptionNative("readonly", true)
+	f.Append("\x1b[32mok")
+	assert.Equal(t, coloredText+"\x1b[0mok", string(f.Bytes()))
+}
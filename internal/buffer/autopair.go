@@ -0,0 +1,81 @@
+package buffer
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// autoPairs are the pairs of runes that are closed automatically
+var autoPairs = [][2]rune{{'"', '"'}, {'\'', '\''}, {'`', '`'}, {'(', ')'}, {'{', '}'}, {'[', ']'}}
+
+// inStringOrComment returns whether loc is inside a string or a comment
+// according to the syntax highlighting
+// At the end of a line only comments count, since a string that ends there
+// has been closed
+func (b *Buffer) inStringOrComment(loc Loc) bool {
+	if b.Highlighter == nil || !b.Settings["syntax"].(bool) || loc.X == 0 {
+		return false
+	}
+
+	isString := func(group string) bool {
+		return strings.HasPrefix(group, "constant.string")
+	}
+	isComment := func(group string) bool {
+		return strings.HasPrefix(group, "comment")
+	}
+
+	prev := b.SyntaxContextAt(Loc{loc.X - 1, loc.Y})
+	if loc.X >= utf8.RuneCount(b.LineBytes(loc.Y)) {
+		return isComment(prev)
+	}
+	next := b.SyntaxContextAt(loc)
+	return (isString(prev) || isComment(prev)) && (isString(next) || isComment(next))
+}
+
+// InsertWithAutopair inserts the rune r at loc the way it is typed when the
+// autopair option is on: an opening bracket or quote is inserted together
+// with its closing counterpart, and a closing one is skipped over if it is
+// already the next rune
+// Pairs are not closed inside strings and comments, or when the next rune is
+// part of a word
+// It returns the text that was inserted and the location the cursor should
+// move to
+func (b *Buffer) InsertWithAutopair(loc Loc, r rune) (inserted string, newCursor Loc) {
+	if b.Type.Readonly {
+		return "", loc
+	}
+	line := []rune(string(b.LineBytes(loc.Y)))
+	text := string(r)
+
+	if b.Settings["autopair"].(bool) {
+		var prev, next rune
+		if loc.X > 0 && loc.X <= len(line) {
+			prev = line[loc.X-1]
+		}
+		if loc.X < len(line) {
+			next = line[loc.X]
+		}
+
+		for _, p := range autoPairs {
+			if r == p[1] && next == r {
+				return "", Loc{loc.X + 1, loc.Y}
+			}
+			if r != p[0] {
+				continue
+			}
+			// A quote after a word is an apostrophe or closes a string
+			if p[0] == p[1] && (util.IsWordChar(prev) || prev == r) {
+				break
+			}
+			if !util.IsWordChar(next) && !b.inStringOrComment(loc) {
+				text += string(p[1])
+			}
+			break
+		}
+	}
+
+	b.Insert(loc, text)
+	return text, Loc{loc.X + 1, loc.Y}
+}
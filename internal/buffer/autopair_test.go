@@ -0,0 +1,72 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zyedidia/micro/internal/config"
+)
+
+func TestInsertWithAutopair(t *testing.T) {
+	b := NewBufferFromString("foo\n", "", BTDefault)
+
+	text, loc := b.InsertWithAutopair(Loc{3, 0}, '(')
+	assert.Equal(t, "()", text)
+	assert.Equal(t, Loc{4, 0}, loc)
+	assert.Equal(t, "foo()", string(b.LineBytes(0)))
+
+	// Typing the closer skips over it
+	text, loc = b.InsertWithAutopair(Loc{4, 0}, ')')
+	assert.Equal(t, "", text)
+	assert.Equal(t, Loc{5, 0}, loc)
+	assert.Equal(t, "foo()", string(b.LineBytes(0)))
+
+	// No pair before a word
+	text, _ = b.InsertWithAutopair(Loc{0, 0}, '[')
+	assert.Equal(t, "[", text)
+	assert.Equal(t, "[foo()", string(b.LineBytes(0)))
+
+	// A quote after a word is an apostrophe
+	b = NewBufferFromString("don", "", BTDefault)
+	text, _ = b.InsertWithAutopair(Loc{3, 0}, '\'')
+	assert.Equal(t, "'", text)
+
+	b.SetOptionNative("autopair", false)
+	text, _ = b.InsertWithAutopair(Loc{0, 0}, '{')
+	assert.Equal(t, "{", text)
+}
+
+func TestAutopairInString(t *testing.T) {
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftpair.yaml", `filetype: ftpair
+
+detect:
+    filename: "\\.ftp$"
+
+rules:
+    - constant.string:
+        start: "\""
+        end: "\""
+        rules: []
+    - comment:
+        start: "#"
+        end: "$"
+        rules: []
+`)
+
+	b := NewBufferFromString("x = \"ab\" # c\n", "pair.ftp", BTDefault)
+	assert.Equal(t, "ftpair", b.Settings["filetype"])
+
+	// Inside the string
+	text, _ := b.InsertWithAutopair(Loc{6, 0}, '(')
+	assert.Equal(t, "(", text)
+	assert.Equal(t, "x = \"a(b\" # c", string(b.LineBytes(0)))
+
+	// After the string
+	text, _ = b.InsertWithAutopair(Loc{9, 0}, '(')
+	assert.Equal(t, "()", text)
+
+	// In the comment at the end of the line
+	end := Loc{len([]rune(string(b.LineBytes(0)))), 0}
+	text, _ = b.InsertWithAutopair(end, '[')
+	assert.Equal(t, "[", text)
+}
@@ -1,8 +1,10 @@
 package buffer
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"time"
 
@@ -27,9 +29,29 @@ The backup was created on %s, and the file is
 
 Options: [r]ecover, [i]gnore: `
 
+// ErrNoBackup is returned when a buffer's backup is opened but it has none
+var ErrNoBackup = errors.New("No backup exists for this file")
+
+// backupPath returns the path of the buffer's backup file
+func (b *Buffer) backupPath() string {
+	name, _ := util.EscapePathLimited(b.AbsPath, maxHistoryNameLen)
+	return config.ConfigDir + "/backups/" + name
+}
+
 // Backup saves the current buffer to ConfigDir/backups
 func (b *Buffer) Backup(checkTime bool) error {
-	if !b.Settings["backup"].(bool) || b.Path == "" || b.Type != BTDefault {
+	if write := b.prepareBackup(checkTime); write != nil {
+		return write()
+	}
+	return nil
+}
+
+// prepareBackup returns a function that writes the current text of the buffer
+// to its backup file, or nil if no backup should be made
+// Everything that the backup depends on is read before it returns, so the
+// function can be run in the background while the buffer is edited
+func (b *Buffer) prepareBackup(checkTime bool) func() error {
+	if !b.Settings["backup"].(bool) || b.Path == "" || b.Type != BTDefault || b.clone {
 		return nil
 	}
 
@@ -43,53 +65,58 @@ func (b *Buffer) Backup(checkTime bool) error {
 	b.lastbackup = time.Now()
 
 	backupdir := config.ConfigDir + "/backups/"
-	if _, err := os.Stat(backupdir); os.IsNotExist(err) {
-		os.Mkdir(backupdir, os.ModePerm)
+	name := b.backupPath()
+	var data []byte
+	for i, l := range b.lines {
+		if i > 0 {
+			data = append(data, '\n')
+		}
+		data = append(data, l.data...)
 	}
 
-	name := backupdir + util.EscapePath(b.AbsPath)
-
-	err := overwriteFile(name, encoding.Nop, func(file io.Writer) (e error) {
-		if len(b.lines) == 0 {
-			return
+	return func() error {
+		if _, err := os.Stat(backupdir); os.IsNotExist(err) {
+			os.Mkdir(backupdir, os.ModePerm)
 		}
 
-		// end of line
-		eol := []byte{'\n'}
-
-		// write lines
-		if _, e = file.Write(b.lines[0].data); e != nil {
-			return
-		}
+		return overwriteFile(name, encoding.Nop, func(file io.Writer) error {
+			_, err := file.Write(data)
+			return err
+		}, false)
+	}
+}
 
-		for _, l := range b.lines[1:] {
-			if _, e = file.Write(eol); e != nil {
-				return
-			}
-			if _, e = file.Write(l.data); e != nil {
-				return
-			}
-		}
+// backupAsync saves a backup of the buffer in the background
+// The backup is tracked so that closing the buffer can wait for it, otherwise
+// it could recreate the backup file after the buffer removed it
+func (b *Buffer) backupAsync() {
+	if b.closed {
 		return
-	}, false)
-
-	return err
+	}
+	write := b.prepareBackup(true)
+	if write == nil {
+		return
+	}
+	b.backups.Add(1)
+	go func() {
+		defer b.backups.Done()
+		write()
+	}()
 }
 
 // RemoveBackup removes any backup file associated with this buffer
 func (b *Buffer) RemoveBackup() {
-	if !b.Settings["backup"].(bool) || b.Path == "" || b.Type != BTDefault {
+	if !b.Settings["backup"].(bool) || b.Path == "" || b.Type != BTDefault || b.clone {
 		return
 	}
-	f := config.ConfigDir + "/backups/" + util.EscapePath(b.AbsPath)
-	os.Remove(f)
+	os.Remove(b.backupPath())
 }
 
 // ApplyBackup applies the corresponding backup file to this buffer (if one exists)
 // Returns true if a backup was applied
 func (b *Buffer) ApplyBackup(fsize int64) bool {
 	if b.Settings["backup"].(bool) && len(b.Path) > 0 && b.Type == BTDefault {
-		backupfile := config.ConfigDir + "/backups/" + util.EscapePath(b.AbsPath)
+		backupfile := b.backupPath()
 		if info, err := os.Stat(backupfile); err == nil {
 			backup, err := os.Open(backupfile)
 			if err == nil {
@@ -113,3 +140,26 @@ func (b *Buffer) ApplyBackup(fsize int64) bool {
 
 	return false
 }
+
+// OpenBackup opens the backup of the buffer (which has the text the buffer had
+// when it was last backed up) in a readonly scratch buffer, for example to
+// compare it with the buffer
+// It returns ErrNoBackup if there is no backup of the buffer
+func (b *Buffer) OpenBackup() (*Buffer, error) {
+	if b.Path == "" {
+		return nil, ErrNoBackup
+	}
+	data, err := ioutil.ReadFile(b.backupPath())
+	if os.IsNotExist(err) {
+		return nil, ErrNoBackup
+	} else if err != nil {
+		return nil, err
+	}
+
+	btype := BTScratch
+	btype.Readonly = true
+	backup := NewBufferFromString(string(data), "", btype)
+	backup.SetName("Backup of " + b.GetName())
+	backup.SetOptionNative("filetype", b.Settings["filetype"])
+	return backup, nil
+}
@@ -1,15 +1,20 @@
 package buffer
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
 	"errors"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -30,6 +35,11 @@ const backupTime = 8000
 var (
 	OpenBuffers []*Buffer
 	LogBuf      *Buffer
+
+	// openFiles maps the resolved paths of files opened with
+	// NewBufferFromFile to their buffers, so that opening a file twice
+	// returns the same buffer (unless allowduplicatebuffers is on)
+	openFiles = make(map[string]*Buffer)
 )
 
 // The BufType defines what kind of buffer this is
@@ -49,12 +59,41 @@ var (
 	BTInfo    = BufType{5, false, true, false}
 
 	ErrFileTooLarge = errors.New("File is too large to hash")
+	// ErrNoPath is returned when saving a buffer that has no path yet, in
+	// which case the user should be asked for one
+	ErrNoPath = errors.New("Buffer has no path, use SaveAs")
+	// ErrFileMissing is returned when the file of a buffer no longer exists
+	// on disk
+	ErrFileMissing = errors.New("File no longer exists on disk")
+	// ErrFileTruncated is returned when new content should be appended from
+	// a file that has become smaller, in which case it must be reloaded
+	ErrFileTruncated = errors.New("File was truncated on disk")
+	// ErrPathIsDirectory is returned when saving to a path that is a
+	// directory, for example because the file was replaced by one
+	ErrPathIsDirectory = errors.New("Path is a directory and cannot be saved to")
+	// ErrNotLoaded is returned when saving a buffer whose file is still
+	// being loaded in the background
+	ErrNotLoaded = errors.New("File has not been loaded completely yet")
+	// ErrSeparatorNewlines is returned when saving a buffer whose records
+	// contain newlines, which would be written as separators because of the
+	// lineseparator option
+	ErrSeparatorNewlines = errors.New("Records of this file contain newlines, which cannot be saved with the lineseparator option")
 )
 
 type SharedBuffer struct {
 	*LineArray
 	// Stores the last modification time of the file the buffer is pointing to
 	ModTime time.Time
+	// The size of the file when it was last read or written
+	diskSize int64
+	// Why the text can't be saved without losing data (the file couldn't be
+	// read completely for example), or nil if it can
+	saveErr error
+	// When the last successful save finished, how long writing the file
+	// took and its size, for LastSaveInfo
+	lastSaveAt       time.Time
+	lastSaveDuration time.Duration
+	lastSaveBytes    int
 	// Type of the buffer (e.g. help, raw, scratch etc..)
 	Type BufType
 
@@ -62,17 +101,66 @@ type SharedBuffer struct {
 	// Whether or not suggestions can be autocompleted must be shared because
 	// it changes based on how the buffer has changed
 	HasSuggestions bool
+
+	// The range of lines that were edited since the highlight states were
+	// last updated
+	hlDirty        bool
+	hlStart, hlEnd int
+	// The number of lines at the top of the buffer whose highlight states
+	// have been computed. Lines below are highlighted lazily when they are
+	// first needed
+	hlValid int
+	// Number of calls to SuspendHighlight that have not been resumed yet
+	hlSuspended int
+
+	// Functions registered with OnChange
+	observers []*changeObserver
+
+	// The widest line, for MaxLineWidth
+	maxWidth maxWidth
+
+	// The loading of the rest of the file in the background, or nil when the
+	// buffer is fully loaded
+	loader *loader
 }
 
 func (b *SharedBuffer) insert(pos Loc, value []byte) {
 	b.isModified = true
 	b.HasSuggestions = false
 	b.LineArray.insert(pos, value)
+	n := bytes.Count(value, []byte{'\n'})
+	b.markEdited(pos.Y, pos.Y+n, n)
+	b.updateMaxWidth(pos.Y, pos.Y+n, n)
 }
 func (b *SharedBuffer) remove(start, end Loc) []byte {
 	b.isModified = true
 	b.HasSuggestions = false
-	return b.LineArray.remove(start, end)
+	b.markEdited(start.Y, start.Y, start.Y-end.Y)
+	removed := b.LineArray.remove(start, end)
+	b.updateMaxWidth(start.Y, start.Y, start.Y-end.Y)
+	return removed
+}
+
+// markEdited adds the lines from start to end to the range of lines that need
+// to be rehighlighted
+// delta is the number of lines that were added (or removed if negative) by the edit
+func (b *SharedBuffer) markEdited(start, end, delta int) {
+	if start < b.hlValid {
+		// The computed states move along with the lines after the edit
+		b.hlValid = util.Max(b.hlValid+delta, start)
+	}
+
+	if !b.hlDirty {
+		b.hlDirty = true
+		b.hlStart, b.hlEnd = start, end
+		return
+	}
+
+	if b.hlEnd > start {
+		b.hlEnd = util.Max(b.hlEnd+delta, start)
+	}
+	b.hlStart = util.Min(b.hlStart, start)
+	b.hlEnd = util.Max(b.hlEnd, end)
 }
 
 // Buffer stores the main information about a currently open file including
@@ -99,9 +187,14 @@ type Buffer struct {
 
 	SyntaxDef   *highlight.Def
 	Highlighter *highlight.Highlighter
+	// filetypes that match this buffer, best first
+	ftCandidates []string
+	// Whether the filetype was set by the user, in which case it isn't
+	// detected again when the path changes
+	ftUserSet bool
 
 	// Hash of the original buffer -- empty if fastdirty is on
-	origHash [md5.Size]byte
+	origHash []byte
 
 	// Settings customized by the user
 	Settings map[string]interface{}
@@ -112,15 +205,41 @@ type Buffer struct {
 
 	Messages []*Message
 
+	// OnBeforeSave is called when the buffer is about to be saved, after the
+	// changes that are made when saving (such as rmtrailingws) so that it
+	// sees the final text. If it returns an error, the file is not written
+	OnBeforeSave func() error
+	// OnAfterSave is called when the buffer has been saved, or saving has
+	// failed with err
+	OnAfterSave func(err error)
+
 	// counts the number of edits
 	// resets every backupTime edits
 	lastbackup time.Time
+	// Backups that are being written in the background
+	backups sync.WaitGroup
+	// Whether Close has been called
+	closed bool
+	// Number of times NewBufferFromFile returned this buffer that haven't
+	// been closed yet, and the key of the buffer in openFiles
+	refs    int
+	fileKey string
+	// Whether this buffer is a clone of a buffer for the same file, in which
+	// case it doesn't write backups or history for the file
+	clone bool
+	// Removes escape sequences from appended text for the stripansi option
+	ansi ansiStripper
+	// The encoding that the file was detected to be in
+	encodingInfo DetectedEncoding
+	// Collapsed ranges of lines
+	folds []FoldRange
 }
 
 // NewBufferFromFile opens a new buffer using the given path
 // It will also automatically handle `~`, and line/column with filename:l:c
-// It will return an empty buffer if the path does not exist
-// and an error if the file is a directory
+// It will return an empty buffer if the path does not exist (or
+// os.ErrNotExist if the mustexist option is on) and an error if the file is a
+// directory
 func NewBufferFromFile(path string, btype BufType) (*Buffer, error) {
 	var err error
 	filename, cursorPos := util.GetPathAndCursorPosition(path)
@@ -128,6 +247,9 @@ func NewBufferFromFile(path string, btype BufType) (*Buffer, error) {
 	if err != nil {
 		return nil, err
 	}
+	if wsl, _ := config.GlobalSettings["wslpaths"].(bool); wsl && runtime.GOOS != "windows" {
+		filename, _ = util.WindowsToWSLPath(filename)
+	}
 
 	file, err := os.Open(filename)
 	fileInfo, _ := os.Stat(filename)
@@ -136,6 +258,10 @@ func NewBufferFromFile(path string, btype BufType) (*Buffer, error) {
 		return nil, errors.New("Error: " + filename + " is a directory and cannot be opened")
 	}
 
+	if mustExist, _ := config.GlobalSettings["mustexist"].(bool); mustExist && os.IsNotExist(err) {
+		return nil, os.ErrNotExist
+	}
+
 	defer file.Close()
 
 	cursorLoc, cursorerr := ParseCursorLocation(cursorPos)
@@ -143,17 +269,135 @@ func NewBufferFromFile(path string, btype BufType) (*Buffer, error) {
 		cursorLoc = Loc{-1, -1}
 	}
 
+	key := resolvePath(filename)
+	allowDuplicates, _ := config.GlobalSettings["allowduplicatebuffers"].(bool)
+	if buf, ok := openFiles[key]; ok && buf.Type == btype && !allowDuplicates {
+		buf.refs++
+		if cursorLoc.X != -1 && cursorLoc.Y != -1 {
+			c := buf.GetActiveCursor()
+			c.GotoLoc(cursorLoc)
+			c.Relocate()
+		}
+		return buf, nil
+	}
+
 	var buf *Buffer
 	if err != nil {
 		// File does not exist -- create an empty buffer with that name
 		buf = NewBufferFromString("", filename, btype)
+		// A buffer that shares its text with a buffer that is already open
+		// already has the template (or the changes that were made to it)
+		if template := newFileTemplate(filename); template != "" && !buf.sharesText() && buf.End() == buf.Start() {
+			buf.insertTemplate(template)
+		}
 	} else {
 		buf = NewBuffer(file, util.FSize(file), filename, cursorLoc, btype)
 	}
 
+	buf.refs = 1
+	if _, ok := openFiles[key]; !ok {
+		buf.fileKey = key
+		openFiles[key] = buf
+	}
+
 	return buf, nil
 }
 
+// newFileTemplate returns the text that a new file with the given name starts
+// with, which is the contents of the file named after its extension (like
+// `sh` for script.sh) in the templatedir directory, if there is one
+func newFileTemplate(filename string) string {
+	dir, _ := config.GlobalSettings["templatedir"].(string)
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	if dir == "" || ext == "" {
+		return ""
+	}
+	dir, err := util.ReplaceHome(dir)
+	if err != nil {
+		return ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ext))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// insertTemplate inserts the template of a new file as an undoable edit
+// The buffer isn't modified until it differs from the template, so a new file
+// that was left as it is can be closed without saving it
+func (b *Buffer) insertTemplate(template string) {
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.EventHandler.Insert(b.Start(), template)
+
+	b.isModified = false
+	if !b.Settings["fastdirty"].(bool) {
+		calcHash(b, &b.origHash)
+	}
+}
+
+// resolvePath returns the absolute path of the given file with any symlinks
+// resolved, which identifies the file in openFiles
+func resolvePath(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+		return resolved
+	}
+	return absPath
+}
+
+// updateFileKey moves the buffer to the key of its current path in openFiles
+// after the path has changed
+func (b *Buffer) updateFileKey() {
+	if b.fileKey == "" {
+		return
+	}
+	if openFiles[b.fileKey] == b {
+		delete(openFiles, b.fileKey)
+	}
+	b.fileKey = ""
+	key := resolvePath(b.AbsPath)
+	if _, ok := openFiles[key]; !ok {
+		b.fileKey = key
+		openFiles[key] = b
+	}
+}
+
+// Refs returns the number of times the buffer was returned by
+// NewBufferFromFile without being closed
+func (b *Buffer) Refs() int {
+	return b.refs
+}
+
+// NewBufferFromFileAtMatch opens a new buffer using the given path with the
+// cursor at the first match of pattern (which is a regular expression if
+// regex is true)
+// If there is no match the cursor is placed at the start of the buffer
+func NewBufferFromFileAtMatch(path, pattern string, regex bool) (*Buffer, error) {
+	b, err := NewBufferFromFile(path, BTDefault)
+	if err != nil {
+		return nil, err
+	}
+
+	match, found, err := b.FindNext(pattern, b.Start(), b.End(), b.Start(), true, regex)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.StartCursor = Loc{0, 0}
+	if found {
+		b.StartCursor = match[0]
+	}
+	c := b.GetActiveCursor()
+	c.ResetSelection()
+	c.GotoLoc(b.StartCursor)
+	return b, nil
+}
+
 // NewBufferFromString creates a new buffer containing the given string
 func NewBufferFromString(text, path string, btype BufType) *Buffer {
 	return NewBuffer(strings.NewReader(text), int64(len(text)), path, Loc{-1, -1}, btype)
@@ -165,6 +409,13 @@ func NewBufferFromString(text, path string, btype BufType) *Buffer {
 // Places the cursor at startcursor. If startcursor is -1, -1 places the
 // cursor at an autodetected location (based on savecursor or :LINE:COL)
 func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufType) *Buffer {
+	return newBuffer(r, size, path, startcursor, btype, -1)
+}
+
+// newBuffer creates a new buffer like NewBuffer from the first firstLines
+// lines of r, or all of them if firstLines is negative, and loads the rest of
+// r in the background
+func newBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufType, firstLines int) *Buffer {
 	absPath, _ := filepath.Abs(path)
 
 	b := new(Buffer)
@@ -183,7 +434,19 @@ func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufT
 		b.Settings["encoding"] = "utf-8"
 	}
 
-	reader := transform.NewReader(r, enc.NewDecoder())
+	// The start of the file is peeked at to detect its encoding
+	raw := bufio.NewReaderSize(r, encodingSampleSize)
+	sample, _ := raw.Peek(encodingSampleSize)
+	b.encodingInfo = DetectEncoding(sample)
+
+	var reader io.Reader = transform.NewReader(raw, enc.NewDecoder())
+	if stripsANSI(b.Settings, btype) {
+		reader = &ansiReader{r: reader}
+	}
+	var saveErr error
+	if sep := lineSeparator(b.Settings); sep != "" {
+		reader, saveErr = separatorReader(reader, sep)
+	}
 
 	found := false
 	if len(path) > 0 {
@@ -206,7 +469,13 @@ func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufT
 		hasBackup := b.ApplyBackup(size)
 
 		if !hasBackup {
-			b.LineArray = NewLineArray(uint64(size), FFAuto, reader)
+			b.saveErr = saveErr
+			br := bufio.NewReader(reader)
+			b.LineArray = &LineArray{lines: make([]Line, 0, 1000), initsize: uint64(size)}
+			if !b.LineArray.readLines(br, FFAuto, firstLines) {
+				b.loader = &loader{r: br, readonly: b.Type.Readonly, stop: make(chan struct{})}
+				b.Type.Readonly = true
+			}
 		}
 		b.EventHandler = NewEventHandler(b.SharedBuffer, b.cursors)
 	}
@@ -226,7 +495,34 @@ func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufT
 	}
 
 	b.UpdateRules()
+	if ft := b.GuessLanguage(); ft != b.Settings["filetype"] {
+		b.Settings["filetype"] = ft
+		b.UpdateRules()
+		if b.SyntaxDef == nil {
+			// There is no syntax file for the guess
+			b.Settings["filetype"] = "unknown"
+		}
+	}
+	if b.Settings["detectindent"].(bool) {
+		// Settings for the file's glob or filetype still take precedence
+		if tabs, size, ok := b.DetectIndent(); ok {
+			b.Settings["tabstospaces"] = !tabs
+			if !tabs {
+				b.Settings["tabsize"] = float64(size)
+			}
+		}
+	}
 	config.InitLocalSettings(b.Settings, b.Path)
+	b.applyModeline()
+
+	// Local settings (for example from .editorconfig) may ask for a different
+	// file format than the one that was detected
+	switch b.Settings["fileformat"].(string) {
+	case "unix":
+		b.Endings = FFUnix
+	case "dos":
+		b.Endings = FFDos
+	}
 
 	if _, err := os.Stat(config.ConfigDir + "/buffers/"); os.IsNotExist(err) {
 		os.Mkdir(config.ConfigDir+"/buffers/", os.ModePerm)
@@ -235,7 +531,7 @@ func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufT
 	if startcursor.X != -1 && startcursor.Y != -1 {
 		b.StartCursor = startcursor
 	} else {
-		if b.Settings["savecursor"].(bool) || b.Settings["saveundo"].(bool) {
+		if b.savesHistory() {
 			err := b.Unserialize()
 			if err != nil {
 				screen.TermMessage(err)
@@ -243,6 +539,8 @@ func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufT
 		}
 	}
 
+	b.EventHandler.groupWindow = undoGroupWindow(b.Settings)
+
 	b.AddCursor(NewCursor(b, b.StartCursor))
 	b.GetActiveCursor().Relocate()
 
@@ -250,7 +548,7 @@ func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufT
 		if size > LargeFileThreshold {
 			// If the file is larger than LargeFileThreshold fastdirty needs to be on
 			b.Settings["fastdirty"] = true
-		} else {
+		} else if b.loader == nil {
 			calcHash(b, &b.origHash)
 		}
 	}
@@ -265,26 +563,106 @@ func NewBuffer(r io.Reader, size int64, path string, startcursor Loc, btype BufT
 	return b
 }
 
-// Close removes this buffer from the list of open buffers
-func (b *Buffer) Close() {
+// Close removes this buffer from the list of open buffers and cleans up its
+// resources (see Fini)
+// A buffer that NewBufferFromFile returned several times is only closed once
+// Close has been called as many times
+// It is safe to call Close more than once
+func (b *Buffer) Close() error {
+	if b.closed {
+		return nil
+	}
+	if b.refs > 1 {
+		b.refs--
+		return nil
+	}
+	b.refs = 0
+	b.closed = true
+
+	if b.fileKey != "" && openFiles[b.fileKey] == b {
+		delete(openFiles, b.fileKey)
+	}
+
 	for i, buf := range OpenBuffers {
 		if b == buf {
-			b.Fini()
 			copy(OpenBuffers[i:], OpenBuffers[i+1:])
 			OpenBuffers[len(OpenBuffers)-1] = nil
 			OpenBuffers = OpenBuffers[:len(OpenBuffers)-1]
-			return
+			break
 		}
 	}
+	// Buffers for the same file share the loading
+	if !b.sharesText() {
+		b.stopLoading()
+	}
+	return b.Fini()
+}
+
+// sharesText returns whether another open buffer shares the text of this
+// buffer
+func (b *Buffer) sharesText() bool {
+	for _, buf := range OpenBuffers {
+		if buf != b && buf.SharedBuffer == b.SharedBuffer {
+			return true
+		}
+	}
+	return false
 }
 
 // Fini should be called when a buffer is closed and performs
-// some cleanup
-func (b *Buffer) Fini() {
+// some cleanup: it waits for any backups that are being written in the
+// background, removes the backup file, and serializes the cursor and undo
+// history if the buffer is unmodified
+func (b *Buffer) Fini() error {
+	b.backups.Wait()
+	b.RemoveBackup()
 	if !b.Modified() {
-		b.Serialize()
+		return b.Serialize()
 	}
-	b.RemoveBackup()
+	return nil
+}
+
+// Clone returns an independent copy of the buffer, with a copy of its text,
+// cursor and settings and an empty undo history
+// The clone keeps the path of the buffer but is not one of the OpenBuffers, so
+// it never shares its text with other buffers. It cannot be saved over the
+// file of the original (use SaveCopy or SaveAs with another path instead) and
+// doesn't write backups or cursor and undo history for that file
+func (b *Buffer) Clone() *Buffer {
+	c := new(Buffer)
+
+	c.Settings = make(map[string]interface{})
+	for k, v := range b.Settings {
+		c.Settings[k] = v
+	}
+
+	c.SharedBuffer = new(SharedBuffer)
+	c.LineArray = b.LineArray.clone()
+	c.Type = b.Type
+	c.ModTime = b.ModTime
+	c.diskSize = b.diskSize
+	c.isModified = b.Modified()
+	c.hlValid = b.hlValid
+	c.EventHandler = NewEventHandler(c.SharedBuffer, c.cursors)
+	c.EventHandler.groupWindow = b.EventHandler.groupWindow
+
+	c.Path = b.Path
+	c.AbsPath = b.AbsPath
+	c.name = b.name
+	c.clone = true
+	c.origHash = b.origHash
+
+	c.SyntaxDef = b.SyntaxDef
+	if b.Highlighter != nil {
+		c.Highlighter = highlight.NewHighlighter(b.SyntaxDef)
+	}
+	c.ftCandidates = append([]string(nil), b.ftCandidates...)
+
+	c.StartCursor = b.GetActiveCursor().Loc
+	c.AddCursor(NewCursor(c, c.StartCursor))
+	c.GetActiveCursor().Relocate()
+
+	return c
 }
 
 // GetName returns the name that should be displayed in the statusline
@@ -299,7 +677,26 @@ func (b *Buffer) GetName() string {
 	return b.name
 }
 
-//SetName changes the name for this buffer
+// DisplayName returns the path of the buffer relative to relativeTo (such as
+// the working directory or the root of a project) if the file is inside of it,
+// and the absolute path otherwise, with the home directory abbreviated to ~
+// Buffers without a path return the same as GetName
+func (b *Buffer) DisplayName(relativeTo string) string {
+	if b.Path == "" {
+		return b.GetName()
+	}
+	if relativeTo != "" {
+		if base, err := filepath.Abs(relativeTo); err == nil {
+			rel, err := filepath.Rel(base, b.AbsPath)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return rel
+			}
+		}
+	}
+	return util.AbbreviateHome(b.AbsPath)
+}
+
+// SetName changes the name for this buffer
 func (b *Buffer) SetName(s string) {
 	b.name = s
 }
@@ -310,8 +707,430 @@ func (b *Buffer) Insert(start Loc, text string) {
 		b.EventHandler.active = b.curCursor
 		b.EventHandler.Insert(start, text)
 
-		go b.Backup(true)
+		b.backupAsync()
+	}
+}
+
+// InsertText inserts text like typing it would: if tabstospaces is on, the
+// tabs in the text are replaced with spaces up to the next tabstop
+func (b *Buffer) InsertText(loc Loc, text string) {
+	if b.Settings["tabstospaces"].(bool) && strings.Contains(text, "\t") {
+		tabsize := util.IntOpt(b.Settings["tabsize"])
+		col := util.StringWidth(b.LineBytes(loc.Y), loc.X, tabsize)
+		text = string(util.ExpandTabsAt([]byte(text), tabsize, col))
+	}
+	b.Insert(loc, text)
+}
+
+// Lines returns a copy of the lines of the buffer, which can be freely
+// modified by the caller
+func (b *Buffer) Lines() []string {
+	lines := make([]string, len(b.lines))
+	for i, l := range b.lines {
+		lines[i] = string(l.data)
+	}
+	return lines
+}
+
+// ReadLineRange returns a copy of the lines from start up to (but not
+// including) end, clamped to the lines of the buffer
+// While the file is still being loaded in the background, only the lines
+// that have been loaded are returned, and the error is ErrNotLoaded if the
+// range goes past them
+func (b *Buffer) ReadLineRange(start, end int) ([][]byte, error) {
+	var err error
+	if b.loader != nil && end > len(b.lines) {
+		err = ErrNotLoaded
+	}
+	start = util.Clamp(start, 0, len(b.lines))
+	end = util.Clamp(end, start, len(b.lines))
+
+	lines := make([][]byte, 0, end-start)
+	for _, l := range b.lines[start:end] {
+		lines = append(lines, append([]byte(nil), l.data...))
+	}
+	return lines, err
+}
+
+// SafeLine returns line n in a form that is safe to display in a terminal
+// Control characters (except tabs), C1 control characters and invalid bytes
+// are never returned as they are. If showcontrolchars is on, control
+// characters are shown in caret notation, such as ^[ for escape, and C1
+// control characters and invalid bytes as their hex value, such as <0x9b>.
+// Otherwise they are all replaced by U+FFFD
+func (b *Buffer) SafeLine(n int) string {
+	line := b.LineBytes(n)
+	show := b.Settings["showcontrolchars"].(bool)
+
+	var sb strings.Builder
+	escape := func(visible string) {
+		if show {
+			sb.WriteString(visible)
+		} else {
+			sb.WriteRune(utf8.RuneError)
+		}
+	}
+	for len(line) > 0 {
+		r, size := utf8.DecodeRune(line)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			escape("<0x" + strconv.FormatInt(int64(line[0]), 16) + ">")
+		case r == '\t':
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			escape(string([]byte{'^', byte(r) ^ 0x40}))
+		case r >= 0x80 && r < 0xa0:
+			escape("<0x" + strconv.FormatInt(int64(r), 16) + ">")
+		default:
+			sb.Write(line[:size])
+		}
+		line = line[size:]
+	}
+	return sb.String()
+}
+
+// FilterLines returns the numbers of the lines for which fn returns true
+// fn is given the text of each line, which it must not modify or keep
+func (b *Buffer) FilterLines(fn func(n int, data []byte) bool) []int {
+	var lines []int
+	for i, l := range b.lines {
+		if fn(i, l.data) {
+			lines = append(lines, i)
+		}
+	}
+	return lines
+}
+
+// RangeUntilLine returns the start of the first line that is exactly marker,
+// which ends the range of text from the start of the buffer that tools such
+// as template processors work on, or false if there is no such line
+func (b *Buffer) RangeUntilLine(marker string) (Loc, bool) {
+	for i, l := range b.lines {
+		if string(l.data) == marker {
+			return Loc{0, i}, true
+		}
+	}
+	return b.End(), false
+}
+
+// SetLines replaces the text of the buffer with the given lines as a single
+// undoable event
+// Only the lines between the first and last lines that differ are replaced,
+// so cursors outside of them keep their position
+func (b *Buffer) SetLines(lines []string) {
+	if b.Type.Readonly {
+		return
+	}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	oldN, newN := len(b.lines), len(lines)
+	prefix := 0
+	for prefix < oldN && prefix < newN && string(b.lines[prefix].data) == lines[prefix] {
+		prefix++
+	}
+	if prefix == oldN && prefix == newN {
+		return
+	}
+	suffix := 0
+	for suffix < oldN-prefix && suffix < newN-prefix &&
+		string(b.lines[oldN-1-suffix].data) == lines[newN-1-suffix] {
+		suffix++
+	}
+
+	changed := lines[prefix : newN-suffix]
+	start, end := Loc{0, prefix}, Loc{0, oldN - suffix}
+	text := ""
+	if suffix > 0 {
+		if len(changed) > 0 {
+			text = strings.Join(changed, "\n") + "\n"
+		}
+	} else {
+		// The replaced lines include the last line, which has no newline
+		end = b.End()
+		if prefix > 0 {
+			start = Loc{utf8.RuneCount(b.lines[prefix-1].data), prefix - 1}
+			if len(changed) > 0 {
+				text = "\n" + strings.Join(changed, "\n")
+			}
+		} else {
+			text = strings.Join(changed, "\n")
+		}
+	}
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.EventHandler.replace(start, end, text)
+	b.RelocateCursors()
+
+	b.backupAsync()
+}
+
+// errReader remembers the first error other than io.EOF that reading from r
+// returns
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// LoadFromReader replaces the text of the buffer with the text that is read
+// from r (of about size bytes) as a single undoable event, like SetLines, and
+// keeps the buffer's path and settings
+// The text must be UTF-8, with unix or dos line endings. If reading fails the
+// buffer is not changed
+func (b *Buffer) LoadFromReader(r io.Reader, size int64) error {
+	if b.Type.Readonly {
+		return errors.New("Cannot edit readonly buffer")
+	}
+
+	er := &errReader{r: r}
+	la := NewLineArray(uint64(size), FFAuto, er)
+	if er.err != nil {
+		return er.err
+	}
+
+	lines := make([]string, len(la.lines))
+	for i, l := range la.lines {
+		lines[i] = string(l.data)
+	}
+	b.SetLines(lines)
+	return nil
+}
+
+// ReplaceInLine replaces the runes from start up to (but not including) end
+// on line n with text, as a single undoable event
+// Cursors after the range on the same line move with the text
+func (b *Buffer) ReplaceInLine(n, start, end int, text string) error {
+	if b.Type.Readonly {
+		return errors.New("Cannot edit readonly buffer")
+	}
+	if n < 0 || n >= b.LinesNum() {
+		return errors.New("Line " + strconv.Itoa(n) + " is outside of the buffer")
+	}
+	if start < 0 || start > end || end > utf8.RuneCount(b.LineBytes(n)) {
+		return errors.New("Range " + strconv.Itoa(start) + "-" + strconv.Itoa(end) + " is outside of line " + strconv.Itoa(n))
+	}
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.EventHandler.replace(Loc{start, n}, Loc{end, n}, text)
+	b.RelocateCursors()
+	b.backupAsync()
+	return nil
+}
+
+// InsertLine inserts text as a new line before line n as a single undoable
+// event, or after the last line if n is the number of lines
+// Cursors on line n and below move down with the lines
+func (b *Buffer) InsertLine(n int, text string) {
+	if b.Type.Readonly {
+		return
+	}
+	n = util.Clamp(n, 0, b.LinesNum())
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	if n < b.LinesNum() {
+		b.EventHandler.Insert(Loc{0, n}, text+"\n")
+	} else {
+		// Cursors at the end of the last line would move with the inserted
+		// text, but no cursor is below the new line
+		saved := make([]Cursor, len(b.cursors))
+		for i, c := range b.cursors {
+			saved[i] = *c
+		}
+		b.EventHandler.Insert(b.End(), "\n"+text)
+		for i, c := range b.cursors {
+			*c = saved[i]
+		}
+	}
+	b.backupAsync()
+}
+
+// SurroundRange inserts prefix at start and suffix at end as a single undoable
+// event
+// Cursors and selections move with the text so that a selection of the range
+// still selects the same text, without the prefix and suffix
+func (b *Buffer) SurroundRange(start, end Loc, prefix, suffix string) {
+	if b.Type.Readonly {
+		return
+	}
+	if end.LessThan(start) {
+		start, end = end, start
+	}
+
+	move := func(loc Loc) Loc {
+		if loc.GreaterThan(end) {
+			loc = shiftLoc(loc, end, suffix)
+		}
+		if loc.GreaterEqual(start) {
+			loc = shiftLoc(loc, start, prefix)
+		}
+		return loc
+	}
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.MultipleReplace([]Delta{
+		{[]byte(suffix), end, end, nil},
+		{[]byte(prefix), start, start, nil},
+	})
+	b.moveCursors(move)
+	b.backupAsync()
+}
+
+// shiftLoc returns where loc moves to when text is inserted at pos, which must
+// not be after loc
+func shiftLoc(loc, pos Loc, text string) Loc {
+	lines := strings.Count(text, "\n")
+	if loc.Y != pos.Y {
+		loc.Y += lines
+	} else if lines == 0 {
+		loc.X += utf8.RuneCountInString(text)
+	} else {
+		loc.Y += lines
+		loc.X += utf8.RuneCountInString(text[strings.LastIndex(text, "\n")+1:]) - pos.X
+	}
+	return loc
+}
+
+// moveCursors moves the locations and selections of all cursors with move
+func (b *Buffer) moveCursors(move func(Loc) Loc) {
+	for _, c := range b.cursors {
+		c.Loc = move(c.Loc)
+		c.CurSelection[0] = move(c.CurSelection[0])
+		c.CurSelection[1] = move(c.CurSelection[1])
+		c.OrigSelection[0] = move(c.OrigSelection[0])
+		c.OrigSelection[1] = move(c.OrigSelection[1])
+	}
+	b.RelocateCursors()
+}
+
+// InsertAtCursors inserts text at every cursor as a single undoable event, and
+// moves every cursor to the end of the text that was inserted at it
+// Cursors at the same location get the text only once
+func (b *Buffer) InsertAtCursors(text string) {
+	if b.Type.Readonly || text == "" {
+		return
+	}
+
+	locs := make([]Loc, 0, len(b.cursors))
+	for _, c := range b.cursors {
+		locs = append(locs, c.Loc)
+	}
+	// Insert from the bottom up, so that the locations of the inserts that
+	// are still to be made don't move
+	sort.Slice(locs, func(i, j int) bool {
+		return locs[j].LessThan(locs[i])
+	})
+	var starts []Loc
+	var deltas []Delta
+	for i, loc := range locs {
+		if i == 0 || loc != locs[i-1] {
+			starts = append(starts, loc)
+			deltas = append(deltas, Delta{[]byte(text), loc, loc, nil})
+		}
+	}
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.MultipleReplace(deltas)
+	b.moveCursors(func(loc Loc) Loc {
+		for _, start := range starts {
+			if loc.GreaterEqual(start) {
+				loc = shiftLoc(loc, start, text)
+			}
+		}
+		return loc
+	})
+	b.backupAsync()
+}
+
+// unshiftLoc returns where loc moves to when the text from start to end is
+// removed
+func unshiftLoc(loc, start, end Loc) Loc {
+	switch {
+	case loc.LessEqual(start):
+		return loc
+	case loc.LessEqual(end):
+		return start
+	case loc.Y == end.Y:
+		return Loc{start.X + loc.X - end.X, start.Y}
+	default:
+		return Loc{loc.X, loc.Y - (end.Y - start.Y)}
+	}
+}
+
+// DeleteAtCursors removes the selection of every cursor as a single undoable
+// event, and leaves every cursor without a selection where the text was
+// removed
+// If backspace is true, the character before every cursor without a selection
+// is removed too. Ranges that overlap are removed once
+func (b *Buffer) DeleteAtCursors(backspace bool) {
+	if b.Type.Readonly {
+		return
+	}
+
+	var ranges [][2]Loc
+	for _, c := range b.cursors {
+		if c.HasSelection() {
+			start, end := c.CurSelection[0], c.CurSelection[1]
+			if end.LessThan(start) {
+				start, end = end, start
+			}
+			ranges = append(ranges, [2]Loc{start, end})
+		} else if backspace && c.Loc.GreaterThan(b.Start()) {
+			ranges = append(ranges, [2]Loc{c.Loc.Move(-1, b), c.Loc})
+		}
+	}
+	if len(ranges) == 0 {
+		return
+	}
+
+	// Merge the ranges that overlap, and remove them from the bottom up so
+	// that the ranges that are still to be removed don't move
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0].LessThan(ranges[j][0])
+	})
+	merged := [][2]Loc{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0].LessEqual(last[1]) {
+			if r[1].GreaterThan(last[1]) {
+				last[1] = r[1]
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	deltas := make([]Delta, len(merged))
+	for i, r := range merged {
+		deltas[len(merged)-1-i] = Delta{[]byte{}, r[0], r[1], nil}
+	}
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.MultipleReplace(deltas)
+	b.moveCursors(func(loc Loc) Loc {
+		for i := len(merged) - 1; i >= 0; i-- {
+			loc = unshiftLoc(loc, merged[i][0], merged[i][1])
+		}
+		return loc
+	})
+	for _, c := range b.cursors {
+		c.ResetSelection()
+		c.StoreVisualX()
 	}
+	b.backupAsync()
 }
 
 func (b *Buffer) Remove(start, end Loc) {
@@ -320,8 +1139,48 @@ func (b *Buffer) Remove(start, end Loc) {
 		b.EventHandler.active = b.curCursor
 		b.EventHandler.Remove(start, end)
 
-		go b.Backup(true)
+		b.backupAsync()
+	}
+}
+
+// lineSeparator returns the separator of the records in the buffer's file as
+// given by the lineseparator option, or "" if they are separated by newlines
+func lineSeparator(settings map[string]interface{}) string {
+	sep := settings["lineseparator"].(string)
+	if sep == "\n" || sep == "\r\n" {
+		return ""
+	}
+	return sep
+}
+
+// separatorReader returns a reader of the text from r with the separator sep
+// replaced by newlines, so that every record is loaded as a line
+// The error is the one of reading r, or ErrSeparatorNewlines if a record
+// contains a newline. In both cases the text can't be saved as it was read
+func separatorReader(r io.Reader, sep string) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	data, sepErr := splitRecords(data, sep)
+	if err == nil {
+		err = sepErr
+	}
+	return bytes.NewReader(data), err
+}
+
+// splitRecords replaces the separator sep in data with newlines
+// It returns ErrSeparatorNewlines if a record already contains a newline,
+// because the record would be split into several lines
+func splitRecords(data []byte, sep string) ([]byte, error) {
+	var err error
+	if bytes.IndexByte(bytes.Replace(data, []byte(sep), nil, -1), '\n') >= 0 {
+		err = ErrSeparatorNewlines
 	}
+	return bytes.Replace(data, []byte(sep), []byte{'\n'}, -1), err
+}
+
+// undoGroupWindow returns the time window in which events are undone together
+// as given by the 'undogroupwindow' option
+func undoGroupWindow(settings map[string]interface{}) time.Duration {
+	return time.Duration(util.IntOpt(settings["undogroupwindow"])) * time.Millisecond
 }
 
 // FileType returns the buffer's filetype
@@ -339,34 +1198,250 @@ func (b *Buffer) ExternallyModified() bool {
 	return false
 }
 
-// UpdateModTime updates the modtime of this file
+// SetType changes the type of the buffer, which also changes whether it can
+// be edited, saved and highlighted
+// It returns an error and leaves the type unchanged if the change is unsafe:
+// a modified buffer can't become scratch, because its changes could no longer
+// be saved, and info buffers (such as the command bar) can't change their kind
+func (b *Buffer) SetType(t BufType) error {
+	if (b.Type.Kind == BTInfo.Kind) != (t.Kind == BTInfo.Kind) {
+		return errors.New("Cannot change the kind of an info buffer")
+	}
+	if t.Scratch && !b.Type.Scratch && b.Modified() {
+		return errors.New("Cannot make a modified buffer scratch, save or discard its changes first")
+	}
+
+	syntax := b.Type.Syntax
+	b.Type = t
+	b.Settings["readonly"] = t.Readonly
+	if t.Syntax && !syntax {
+		b.UpdateRules()
+	} else if !t.Syntax && syntax {
+		b.SyntaxDef, b.Highlighter = nil, nil
+		b.ClearMatches()
+	}
+	return nil
+}
+
+// UpdateModTime updates the modtime (and the size) of this file
 func (b *Buffer) UpdateModTime() (err error) {
-	b.ModTime, err = util.GetModTime(b.Path)
+	b.ModTime, err = util.GetModTime(b.AbsPath)
+	b.diskSize = 0
+	if info, e := os.Stat(b.AbsPath); e == nil {
+		b.diskSize = info.Size()
+	}
 	return
 }
 
-// ReOpen reloads the current buffer from disk
-func (b *Buffer) ReOpen() error {
+// DiskSizeDelta returns the size of the file on disk minus the size of the
+// buffer's text in the buffer's encoding and line endings
+// A positive delta means that the file on disk is larger than the buffer
+func (b *Buffer) DiskSizeDelta() (int64, error) {
+	if b.Path == "" {
+		return 0, ErrNoPath
+	}
+	info, err := os.Stat(b.AbsPath)
+	if os.IsNotExist(err) {
+		return 0, ErrFileMissing
+	} else if err != nil {
+		return 0, err
+	}
+
+	data := b.Bytes()
+	enc, err := htmlindex.Get(b.Settings["encoding"].(string))
+	if err != nil {
+		return 0, err
+	}
+	if enc != unicode.UTF8 {
+		if data, _, err = transform.Bytes(enc.NewEncoder(), data); err != nil {
+			return 0, err
+		}
+	}
+	return info.Size() - int64(len(data)), nil
+}
+
+// AppendNewDiskContent appends the content that was added to the end of the
+// file on disk since it was last read or written, and returns the number of
+// lines that were added
+// This only reads the new part of the file, which is much faster than ReOpen
+// for following a log file. If the file has become smaller it returns
+// ErrFileTruncated and the buffer should be reloaded with ReOpen instead
+func (b *Buffer) AppendNewDiskContent() (int, error) {
+	if b.Path == "" {
+		return 0, ErrNoPath
+	}
+	file, err := os.Open(b.AbsPath)
+	if os.IsNotExist(err) {
+		return 0, ErrFileMissing
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < b.diskSize {
+		return 0, ErrFileTruncated
+	} else if info.Size() == b.diskSize {
+		return 0, nil
+	}
+
+	enc, err := htmlindex.Get(b.Settings["encoding"].(string))
+	if err != nil {
+		return 0, err
+	}
+	raw, err := ioutil.ReadAll(io.NewSectionReader(file, b.diskSize, info.Size()-b.diskSize))
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if enc == unicode.UTF8 {
+		// A character may have been written only partly, so its bytes are
+		// left on disk until the rest of it is appended
+		if n := partialRuneLen(raw); n > 0 {
+			raw = raw[:len(raw)-n]
+			size -= int64(n)
+		}
+	}
+	if len(raw) == 0 {
+		b.ModTime = info.ModTime()
+		return 0, nil
+	}
+	data, _, err := transform.Bytes(enc.NewDecoder(), raw)
+	if err != nil {
+		return 0, err
+	}
+	if b.Endings == FFDos && lineSeparator(b.Settings) == "" && bytes.HasSuffix(data, []byte{'\r'}) {
+		// The '\n' of a "\r\n" may not have been written yet, so the '\r' is
+		// left on disk until the rest of the line ending is appended
+		cr, err := enc.NewEncoder().Bytes([]byte{'\r'})
+		if err != nil {
+			return 0, err
+		}
+		data = data[:len(data)-1]
+		size -= int64(len(cr))
+		if len(data) == 0 {
+			b.ModTime = info.ModTime()
+			return 0, nil
+		}
+	}
+	if stripsANSI(b.Settings, b.Type) {
+		data = b.ansi.strip(data[:0], data)
+	}
+	if sep := lineSeparator(b.Settings); sep != "" {
+		if data, err = splitRecords(data, sep); err != nil {
+			b.saveErr = err
+		}
+	} else if b.Endings == FFDos {
+		data = bytes.Replace(data, []byte{'\r', '\n'}, []byte{'\n'}, -1)
+	}
+
+	modified := b.Modified()
+	lines := b.LinesNum()
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.EventHandler.Insert(b.End(), string(data))
+	if !modified {
+		// The buffer still matches the file
+		b.isModified = false
+		if !b.Settings["fastdirty"].(bool) {
+			calcHash(b, &b.origHash)
+		}
+	}
+
+	b.ModTime = info.ModTime()
+	b.diskSize = size
+	return b.LinesNum() - lines, nil
+}
+
+// partialRuneLen returns the number of bytes at the end of p that are the
+// start of a UTF-8 encoded character whose other bytes are missing
+func partialRuneLen(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return 0
+			}
+			return len(p) - i
+		}
+	}
+	return 0
+}
+
+// readFile reads the buffer's file from disk and decodes it like the buffer's
+// text, except that dos line endings are kept
+// The text is also returned with ErrSeparatorNewlines, which only means that
+// it can't be saved again
+func (b *Buffer) readFile() (string, error) {
 	file, err := os.Open(b.Path)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer file.Close()
 
 	enc, err := htmlindex.Get(b.Settings["encoding"].(string))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	reader := transform.NewReader(file, enc.NewDecoder())
+	var reader io.Reader = transform.NewReader(file, enc.NewDecoder())
+	if stripsANSI(b.Settings, b.Type) {
+		reader = &ansiReader{r: reader}
+	}
 	data, err := ioutil.ReadAll(reader)
-	txt := string(data)
-
 	if err != nil {
+		return "", err
+	}
+	if sep := lineSeparator(b.Settings); sep != "" {
+		data, err = splitRecords(data, sep)
+	}
+	return string(data), err
+}
+
+// ReOpen reloads the current buffer from disk
+func (b *Buffer) ReOpen() error {
+	txt, err := b.readFile()
+	if err != nil && err != ErrSeparatorNewlines {
 		return err
 	}
+	return b.reload(txt, err)
+}
+
+// ReloadIfChanged reloads the buffer from disk like ReOpen, but only if the
+// content of the file differs from the buffer's text, and returns whether it
+// did
+// This avoids disturbing the cursors and highlighting when a file watcher
+// reports a change that only touched the file's metadata
+func (b *Buffer) ReloadIfChanged() (bool, error) {
+	txt, err := b.readFile()
+	if err != nil && err != ErrSeparatorNewlines {
+		return false, err
+	}
+
+	h := dirtyHasher.New()
+	h.Write([]byte(strings.Replace(txt, "\r\n", "\n", -1)))
+	if bytes.Equal(h.Sum(nil), b.ContentHash()) {
+		return false, b.UpdateModTime()
+	}
+	return true, b.reload(txt, err)
+}
+
+// reload replaces the buffer's text with txt, which was read from disk
+func (b *Buffer) reload(txt string, saveErr error) error {
+	// The whole file has been read again
+	b.stopLoading()
+	b.saveErr = saveErr
+	b.ansi = ansiStripper{}
 	b.EventHandler.ApplyDiff(txt)
 
-	err = b.UpdateModTime()
+	if b.Settings["clearhistoryonreload"].(bool) {
+		b.UndoStack = new(TEStack)
+		b.RedoStack = new(TEStack)
+	}
+
+	err := b.UpdateModTime()
 	b.isModified = false
 	b.RelocateCursors()
 	return err
@@ -399,7 +1474,8 @@ func (b *Buffer) RuneAt(loc Loc) rune {
 // Modified returns if this buffer has been modified since
 // being opened
 func (b *Buffer) Modified() bool {
-	if b.Type.Scratch {
+	if b.Type.Scratch || b.loader != nil {
+		// A buffer that is still loading can't have been edited
 		return false
 	}
 
@@ -407,15 +1483,43 @@ func (b *Buffer) Modified() bool {
 		return b.isModified
 	}
 
-	var buff [md5.Size]byte
+	var buff []byte
 
 	calcHash(b, &buff)
-	return buff != b.origHash
+	return !bytes.Equal(buff, b.origHash)
+}
+
+// A DirtyHasher creates the hashes that are used to check whether a buffer
+// has been modified when fastdirty is off
+type DirtyHasher interface {
+	New() hash.Hash
+}
+
+// DirtyHasherFunc is a function that creates a hash, such as md5.New, used as
+// a DirtyHasher
+type DirtyHasherFunc func() hash.Hash
+
+// New calls f
+func (f DirtyHasherFunc) New() hash.Hash {
+	return f()
+}
+
+var dirtyHasher DirtyHasher = DirtyHasherFunc(md5.New)
+
+// SetDirtyHasher sets the hash that is used to check whether buffers have been
+// modified, or md5 (the default) if h is nil
+// It should be set before any buffer is opened, since buffers that were
+// opened with another hash will count as modified
+func SetDirtyHasher(h DirtyHasher) {
+	if h == nil {
+		h = DirtyHasherFunc(md5.New)
+	}
+	dirtyHasher = h
 }
 
-// calcHash calculates md5 hash of all lines in the buffer
-func calcHash(b *Buffer, out *[md5.Size]byte) error {
-	h := md5.New()
+// calcHash calculates the hash of all lines in the buffer
+func calcHash(b *Buffer, out *[]byte) error {
+	h := dirtyHasher.New()
 
 	size := 0
 	if len(b.lines) > 0 {
@@ -443,12 +1547,54 @@ func calcHash(b *Buffer, out *[md5.Size]byte) error {
 		return ErrFileTooLarge
 	}
 
-	h.Sum((*out)[:0])
+	*out = h.Sum(nil)
 	return nil
 }
 
+// ContentHash returns the hash of the buffer's text with unix line endings,
+// made with the same hash that is used to check whether the buffer has been
+// modified
+func (b *Buffer) ContentHash() []byte {
+	h := dirtyHasher.New()
+	for i, l := range b.lines {
+		if i > 0 {
+			h.Write([]byte{'\n'})
+		}
+		h.Write(l.data)
+	}
+	return h.Sum(nil)
+}
+
+// syntaxError tells the user about an error with a syntax file, unless the
+// same error has already been reported during this session
+func syntaxError(msg string) {
+	if config.AddSyntaxLoadError(errors.New(msg)) {
+		screen.TermMessage(msg)
+	}
+}
+
+// A ftCandidate is a syntax file that could be used for a buffer
+type ftCandidate struct {
+	header *highlight.Header
+	name   string
+	// contents of the user's syntax files, which have no separate header file
+	data  []byte
+	score int
+}
+
+// FileTypeCandidates returns the filetypes whose detection rules match this
+// buffer, from the best match to the worst
+func (b *Buffer) FileTypeCandidates() []string {
+	return b.ftCandidates
+}
+
 // UpdateRules updates the syntax rules and filetype for this buffer
 // This is called when the colorscheme changes
+// If the filetype is unknown, every syntax file whose detection rules match is
+// considered and the most specific one is used. A match on the first line of
+// the file beats a match on the filename, and the user's own syntax files win
+// ties with the built-in ones. The filetypeoverrides option and setting the
+// filetype option both override detection
 func (b *Buffer) UpdateRules() {
 	if !b.Type.Syntax {
 		return
@@ -457,80 +1603,104 @@ func (b *Buffer) UpdateRules() {
 	if ft == "off" {
 		return
 	}
-	syntaxFile := ""
-	var header *highlight.Header
-	for _, f := range config.ListRuntimeFiles(config.RTSyntaxHeader) {
+	detect := ft == "unknown" || ft == ""
+	if detect {
+		// The user's overrides take precedence over the detection rules. If
+		// the filetype they give has no syntax file, the buffer is left as
+		// plain text
+		if override, ok := config.FileTypeOverride(b.Path); ok {
+			ft = override
+			detect = false
+		}
+	}
+
+	var candidates []ftCandidate
+	var chosen *ftCandidate
+
+	// The user's custom syntax files come first so that they win over the
+	// built-in ones when both match equally well
+	for _, f := range config.ListRealRuntimeFiles(config.RTSyntax) {
 		data, err := f.Data()
 		if err != nil {
-			screen.TermMessage("Error loading syntax header file " + f.Name() + ": " + err.Error())
+			syntaxError("Error loading syntax file " + f.Name() + ": " + err.Error())
 			continue
 		}
 
-		header, err = highlight.MakeHeader(data)
+		header, err := highlight.MakeHeaderYaml(data)
+		if err != nil {
+			syntaxError("Error parsing syntax file " + f.Name() + ": " + err.Error())
+			continue
+		}
+		candidates = append(candidates, ftCandidate{header, f.Name(), data, 0})
+	}
+	for _, f := range config.ListRuntimeFiles(config.RTSyntaxHeader) {
+		data, err := f.Data()
 		if err != nil {
-			screen.TermMessage("Error reading syntax header file", f.Name(), err)
+			syntaxError("Error loading syntax header file " + f.Name() + ": " + err.Error())
 			continue
 		}
 
-		if ft == "unknown" || ft == "" {
-			if highlight.MatchFiletype(header.FtDetect, b.Path, b.lines[0].data) {
-				syntaxFile = f.Name()
-				break
-			}
-		} else if header.FileType == ft {
-			syntaxFile = f.Name()
-			break
+		header, err := highlight.MakeHeader(data)
+		if err != nil {
+			syntaxError("Error reading syntax header file " + f.Name() + ": " + err.Error())
+			continue
 		}
+		candidates = append(candidates, ftCandidate{header, f.Name(), nil, 0})
 	}
 
-	if syntaxFile == "" {
-		// search for the syntax file in the user's custom syntax files
-		for _, f := range config.ListRealRuntimeFiles(config.RTSyntax) {
-			data, err := f.Data()
-			if err != nil {
-				screen.TermMessage("Error loading syntax file " + f.Name() + ": " + err.Error())
-				continue
-			}
+	for i := range candidates {
+		c := &candidates[i]
+		c.score = highlight.FiletypeScore(c.header.FtDetect, b.Path, b.lines[0].data)
+		if chosen == nil && !detect && c.header.FileType == ft {
+			chosen = c
+		}
+	}
 
-			header, err = highlight.MakeHeaderYaml(data)
-			file, err := highlight.ParseFile(data)
-			if err != nil {
-				screen.TermMessage("Error parsing syntax file " + f.Name() + ": " + err.Error())
-				continue
-			}
+	// Keep only the syntaxes whose detection rules match, best first
+	matching := candidates[:0:0]
+	for _, c := range candidates {
+		if c.score > 0 {
+			matching = append(matching, c)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].score > matching[j].score
+	})
+	b.ftCandidates = nil
+	seen := make(map[string]bool)
+	for _, c := range matching {
+		if !seen[c.header.FileType] {
+			seen[c.header.FileType] = true
+			b.ftCandidates = append(b.ftCandidates, c.header.FileType)
+		}
+	}
+	if detect && len(matching) > 0 {
+		chosen = &matching[0]
+	}
 
-			if (ft == "unknown" || ft == "" && highlight.MatchFiletype(header.FtDetect, b.Path, b.lines[0].data)) || header.FileType == ft {
-				syndef, err := highlight.ParseDef(file, header)
-				if err != nil {
-					screen.TermMessage("Error parsing syntax file " + f.Name() + ": " + err.Error())
-					continue
+	if chosen != nil {
+		data := chosen.data
+		if data == nil {
+			for _, f := range config.ListRuntimeFiles(config.RTSyntax) {
+				if f.Name() == chosen.name {
+					var err error
+					data, err = f.Data()
+					if err != nil {
+						syntaxError("Error loading syntax file " + f.Name() + ": " + err.Error())
+					}
+					break
 				}
-				b.SyntaxDef = syndef
-				break
 			}
 		}
-	} else {
-		for _, f := range config.ListRuntimeFiles(config.RTSyntax) {
-			if f.Name() == syntaxFile {
-				data, err := f.Data()
-				if err != nil {
-					screen.TermMessage("Error loading syntax file " + f.Name() + ": " + err.Error())
-					continue
-				}
-
-				file, err := highlight.ParseFile(data)
-				if err != nil {
-					screen.TermMessage("Error parsing syntax file " + f.Name() + ": " + err.Error())
-					continue
-				}
 
-				syndef, err := highlight.ParseDef(file, header)
-				if err != nil {
-					screen.TermMessage("Error parsing syntax file " + f.Name() + ": " + err.Error())
-					continue
-				}
+		if data != nil {
+			file, err := highlight.ParseFile(data)
+			if err != nil {
+				syntaxError("Error parsing syntax file " + chosen.name + ": " + err.Error())
+			} else if syndef, err := highlight.ParseDef(file, chosen.header); err != nil {
+				syntaxError("Error parsing syntax file " + chosen.name + ": " + err.Error())
+			} else {
 				b.SyntaxDef = syndef
-				break
 			}
 		}
 	}
@@ -542,12 +1712,12 @@ func (b *Buffer) UpdateRules() {
 		for _, f := range config.ListRuntimeFiles(config.RTSyntax) {
 			data, err := f.Data()
 			if err != nil {
-				screen.TermMessage("Error parsing syntax file " + f.Name() + ": " + err.Error())
+				syntaxError("Error parsing syntax file " + f.Name() + ": " + err.Error())
 				continue
 			}
 			header, err := highlight.MakeHeaderYaml(data)
 			if err != nil {
-				screen.TermMessage("Error parsing syntax file " + f.Name() + ": " + err.Error())
+				syntaxError("Error parsing syntax file " + f.Name() + ": " + err.Error())
 				continue
 			}
 
@@ -555,7 +1725,7 @@ func (b *Buffer) UpdateRules() {
 				if header.FileType == i {
 					file, err := highlight.ParseFile(data)
 					if err != nil {
-						screen.TermMessage("Error parsing syntax file " + f.Name() + ": " + err.Error())
+						syntaxError("Error parsing syntax file " + f.Name() + ": " + err.Error())
 						continue
 					}
 					files = append(files, file)
@@ -570,17 +1740,33 @@ func (b *Buffer) UpdateRules() {
 		highlight.ResolveIncludes(b.SyntaxDef, files)
 	}
 
-	if b.Highlighter == nil || syntaxFile != "" {
+	if b.Highlighter == nil || chosen != nil {
 		if b.SyntaxDef != nil {
 			b.Settings["filetype"] = b.SyntaxDef.FileType
 			b.Highlighter = highlight.NewHighlighter(b.SyntaxDef)
-			if b.Settings["syntax"].(bool) {
-				b.Highlighter.HighlightStates(b)
-			}
+			// The states are computed lazily by EnsureHighlighted
+			b.hlValid = 0
+			b.hlDirty = false
 		}
 	}
 }
 
+// redetectFiletype detects the filetype of the buffer again, for example
+// because its path has changed
+// A filetype that was set by the user is kept
+func (b *Buffer) redetectFiletype() {
+	if b.ftUserSet {
+		return
+	}
+	b.Settings["filetype"] = "unknown"
+	b.SyntaxDef = nil
+	b.Highlighter = nil
+	b.UpdateRules()
+	if b.Highlighter == nil {
+		b.ClearMatches()
+	}
+}
+
 // ClearMatches clears all of the syntax highlighting for the buffer
 func (b *Buffer) ClearMatches() {
 	for i := range b.lines {
@@ -628,6 +1814,25 @@ func (b *Buffer) GetCursor(n int) *Cursor {
 	return b.cursors[n]
 }
 
+// IsSelected returns whether the character at loc is selected by any cursor
+// A selection includes the character at its start but not the one at its end,
+// whichever direction it was made in
+func (b *Buffer) IsSelected(loc Loc) bool {
+	for _, c := range b.cursors {
+		if !c.HasSelection() {
+			continue
+		}
+		start, end := c.CurSelection[0], c.CurSelection[1]
+		if end.LessThan(start) {
+			start, end = end, start
+		}
+		if loc.GreaterEqual(start) && loc.LessThan(end) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetCursors returns the list of cursors in this buffer
 func (b *Buffer) GetCursors() []*Cursor {
 	return b.cursors
@@ -819,6 +2024,74 @@ func (b *Buffer) FindMatchingBrace(braceType [2]rune, start Loc) (Loc, bool) {
 	return start, true
 }
 
+// indentBlockFiletypes are the filetypes whose blocks are delimited by
+// indentation instead of braces
+var indentBlockFiletypes = map[string]bool{
+	"coffeescript": true,
+	"haskell":      true,
+	"nim":          true,
+	"python":       true,
+	"python2":      true,
+	"yaml":         true,
+}
+
+// EnclosingBlock finds the innermost block that contains loc without parsing
+// the buffer, for example to expand the selection to the current function
+// For most filetypes the block goes from the unmatched '{' before loc to just
+// after its matching '}'. For indentation based filetypes (like python) it
+// goes from the start of the line that the block belongs to until the end of
+// the last line that is indented more than it
+// ok is false if there is no enclosing block
+func (b *Buffer) EnclosingBlock(loc Loc) (start, end Loc, ok bool) {
+	if indentBlockFiletypes[b.Settings["filetype"].(string)] {
+		return b.enclosingIndentBlock(loc.Y)
+	}
+
+	depth := 0
+	for y := util.Clamp(loc.Y, 0, b.LinesNum()-1); y >= 0; y-- {
+		l := []rune(string(b.LineBytes(y)))
+		x := len(l) - 1
+		if y == loc.Y {
+			x = util.Min(loc.X, len(l)) - 1
+		}
+		for ; x >= 0; x-- {
+			switch l[x] {
+			case '}':
+				depth++
+			case '{':
+				if depth > 0 {
+					depth--
+					continue
+				}
+				open := Loc{x, y}
+				close, _ := b.FindMatchingBrace([2]rune{'{', '}'}, open)
+				if close == open {
+					return start, end, false
+				}
+				return open, close.Move(1, b), true
+			}
+		}
+	}
+	return start, end, false
+}
+
+func (b *Buffer) enclosingIndentBlock(n int) (start, end Loc, ok bool) {
+	n = util.Clamp(n, 0, b.LinesNum()-1)
+	parent := b.ParentLine(n)
+	if parent < 0 {
+		return start, end, false
+	}
+
+	level := b.IndentLevel(parent)
+	last := parent
+	for i := parent + 1; i < b.LinesNum() && b.IndentLevel(i) > level; i++ {
+		if len(bytes.TrimSpace(b.LineBytes(i))) > 0 {
+			last = i
+		}
+	}
+	return Loc{0, parent}, Loc{b.LineRuneCount(last), last}, true
+}
+
 // Retab changes all tabs to spaces or vice versa
 func (b *Buffer) Retab() {
 	toSpaces := b.Settings["tabstospaces"].(bool)
@@ -837,12 +2110,21 @@ func (b *Buffer) Retab() {
 			}
 		}
 
-		l = bytes.TrimLeft(l, " \t")
-		b.lines[i].data = append(ws, l...)
+		data := append(ws, bytes.TrimLeft(l, " \t")...)
+		if bytes.Equal(data, l) {
+			continue
+		}
+		b.lines[i].data = data
+		b.lines[i].runesValid = false
+		b.markEdited(i, i, 0)
 		dirty = true
 	}
 
-	b.isModified = dirty
+	if dirty {
+		// The width of the changed lines depends on their columns
+		b.maxWidth.valid = false
+		b.isModified = true
+	}
 }
 
 // ParseCursorLocation turns a cursor location like 10:5 (LINE:COL)
@@ -875,7 +2157,13 @@ func (b *Buffer) Line(i int) string {
 	return string(b.LineBytes(i))
 }
 
+// ExpandedLine returns line n as it is displayed, with every tab expanded to
+// the spaces up to the next tab stop according to the tabsize option
+func (b *Buffer) ExpandedLine(n int) string {
+	return string(util.ExpandTabsAt(b.LineBytes(n), util.IntOpt(b.Settings["tabsize"]), 0))
+}
+
 // WriteLog writes a string to the log buffer
 func WriteLog(s string) {
-	LogBuf.EventHandler.Insert(LogBuf.End(), s)
+	LogBuf.Append(s)
 }
@@ -0,0 +1,1272 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"hash"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/zyedidia/micro/internal/config"
+	ulua "github.com/zyedidia/micro/internal/lua"
+	"github.com/zyedidia/micro/internal/util"
+)
+
+func init() {
+	ulua.L = lua.NewState()
+	config.ConfigDir, _ = ioutil.TempDir("", "micro-buffer-test")
+	config.InitGlobalSettings()
+	config.GlobalSettings["backup"] = false
+	config.GlobalSettings["fastdirty"] = true
+}
+
+// tempFile writes the given contents to a new file in a temporary
+// directory and returns its path
+func tempFile(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestReOpenUndoRedo(t *testing.T) {
+	path := tempFile(t, "reopen.txt", "first line\nsecond line is long\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.GetActiveCursor().GotoLoc(Loc{19, 1})
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("first\n"), 0644))
+	assert.Nil(t, b.ReOpen())
+	assert.Equal(t, "first\n", string(b.Bytes()))
+
+	b.Undo()
+	assert.Equal(t, "first line\nsecond line is long\n", string(b.Bytes()))
+	b.Redo()
+	assert.Equal(t, "first\n", string(b.Bytes()))
+	assert.True(t, InBounds(b.GetActiveCursor().Loc, b))
+	b.RuneAt(b.GetActiveCursor().Loc)
+}
+
+func TestReloadIfChanged(t *testing.T) {
+	path := tempFile(t, "reload.txt", "foo\r\nbar\r\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	later := b.ModTime.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	reloaded, err := b.ReloadIfChanged()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, 0, b.UndoStack.Len())
+	assert.True(t, b.ModTime.Equal(later))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("foo\r\nbaz\r\n"), 0644))
+	reloaded, err = b.ReloadIfChanged()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "foo\r\nbaz\r\n", string(b.Bytes()))
+	assert.False(t, b.Modified())
+}
+
+func TestReOpenClearHistory(t *testing.T) {
+	path := tempFile(t, "reopen.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetOptionNative("clearhistoryonreload", true)
+	b.Insert(Loc{3, 0}, "bar")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("baz\n"), 0644))
+	assert.Nil(t, b.ReOpen())
+	assert.Equal(t, 0, b.UndoStack.Len())
+	assert.Equal(t, 0, b.RedoStack.Len())
+
+	b.Undo()
+	b.Redo()
+	assert.Equal(t, "baz\n", string(b.Bytes()))
+}
+
+func TestReOpenMinimalDiff(t *testing.T) {
+	path := tempFile(t, "reopen.txt", "a\nb\nc\nd\ne\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.GetActiveCursor().GotoLoc(Loc{1, 4})
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("a\nb\nchanged\nd\ne\n"), 0644))
+	assert.Nil(t, b.ReOpen())
+	assert.Equal(t, "a\nb\nchanged\nd\ne\n", string(b.Bytes()))
+	assert.Equal(t, 1, b.UndoStack.Len())
+	d := b.UndoStack.Peek().Deltas[0]
+	assert.Equal(t, "c\n", string(d.Text))
+	assert.Equal(t, Loc{1, 4}, b.GetActiveCursor().Loc)
+	assert.False(t, b.Modified())
+}
+
+func TestEditorConfigSettings(t *testing.T) {
+	path := tempFile(t, "main.c", "int main() {}\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(filepath.Dir(path), ".editorconfig"), []byte(`
+root = true
+
+[*.c]
+indent_style = space
+indent_size = 3
+end_of_line = crlf
+`), 0644))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	assert.Equal(t, true, b.Settings["tabstospaces"])
+	assert.Equal(t, float64(3), b.Settings["tabsize"])
+	assert.Equal(t, "dos", b.Settings["fileformat"])
+	assert.Equal(t, FileFormat(FFDos), b.Endings)
+}
+
+func TestCloseRemovesBackup(t *testing.T) {
+	path := tempFile(t, "close.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	goroutines := runtime.NumGoroutine()
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	b.Settings["backup"] = true
+	b.Insert(Loc{0, 0}, "bar")
+
+	assert.Nil(t, b.Close())
+	_, err = os.Stat(filepath.Join(config.ConfigDir, "backups", util.EscapePath(b.AbsPath)))
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, runtime.NumGoroutine() <= goroutines)
+	for _, buf := range OpenBuffers {
+		assert.NotEqual(t, b, buf)
+	}
+
+	// Closing again does nothing, and doesn't start new backups
+	assert.Nil(t, b.Close())
+	b.Insert(Loc{0, 0}, "baz")
+	assert.True(t, runtime.NumGoroutine() <= goroutines)
+}
+
+func TestCloseSerializes(t *testing.T) {
+	path := tempFile(t, "close.txt", "foo\nbar\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config.GlobalSettings["savecursor"] = true
+	defer func() { config.GlobalSettings["savecursor"] = false }()
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	b.GetActiveCursor().GotoLoc(Loc{1, 1})
+	assert.Nil(t, b.Close())
+
+	b, err = NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Equal(t, Loc{1, 1}, b.StartCursor)
+}
+
+func TestSerializeNow(t *testing.T) {
+	path := tempFile(t, "serialize.txt", "foo\nbar\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config.GlobalSettings["savecursor"] = true
+	config.GlobalSettings["saveundo"] = true
+	defer func() {
+		config.GlobalSettings["savecursor"] = false
+		config.GlobalSettings["saveundo"] = false
+	}()
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	// The buffer was never saved, but the history file is written anyway
+	b.GetActiveCursor().GotoLoc(Loc{2, 1})
+	assert.Nil(t, b.SerializeNow())
+	_, err = os.Stat(b.serializedPath())
+	assert.Nil(t, err)
+
+	// Unsaved changes only update the cursor
+	b.Insert(Loc{0, 0}, "baz")
+	b.GetActiveCursor().GotoLoc(Loc{1, 0})
+	assert.Nil(t, b.SerializeNow())
+	serialized, err := b.readSerialized()
+	assert.Nil(t, err)
+	assert.Equal(t, Loc{1, 0}, serialized.Cursor)
+	assert.Equal(t, 0, serialized.EventHandler.UndoStack.Len())
+
+	// A buffer without cursors doesn't make serializing panic
+	b.cursors = nil
+	assert.Nil(t, b.SerializeNow())
+	assert.Nil(t, b.Serialize())
+}
+
+func TestSerializeFolds(t *testing.T) {
+	path := tempFile(t, "folds.txt", "a\nb\nc\nd\ne\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config.GlobalSettings["savefolds"] = true
+	defer func() { config.GlobalSettings["savefolds"] = false }()
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.Equal(t, []FoldRange(nil), b.Folds())
+
+	// Invalid ranges are dropped
+	b.SetFolds([]FoldRange{{3, 4}, {0, 2}, {2, 2}, {4, 9}})
+	assert.Equal(t, []FoldRange{{0, 2}, {3, 4}}, b.Folds())
+	assert.Nil(t, b.Serialize())
+	assert.Nil(t, b.Close())
+
+	b, err = NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.Equal(t, []FoldRange{{0, 2}, {3, 4}}, b.Folds())
+	assert.Nil(t, b.Close())
+
+	// The folds are discarded if the file changed
+	assert.Nil(t, ioutil.WriteFile(path, []byte("a\n"), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(path, later, later))
+
+	b, err = NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.Equal(t, []FoldRange(nil), b.Folds())
+	assert.Nil(t, b.Close())
+}
+
+func TestSerializeLongPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := dir
+	for i := 0; i < 10; i++ {
+		path = filepath.Join(path, strings.Repeat("d", 40))
+	}
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	path = filepath.Join(path, "long.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("foo\nbar\n"), 0644))
+
+	config.GlobalSettings["savecursor"] = true
+	defer func() { config.GlobalSettings["savecursor"] = false }()
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	b.GetActiveCursor().GotoLoc(Loc{2, 1})
+	assert.Nil(t, b.Close())
+
+	name, hashed := util.EscapePathLimited(b.AbsPath, maxHistoryNameLen)
+	assert.True(t, hashed)
+	_, err = os.Stat(filepath.Join(config.ConfigDir, "buffers", name))
+	assert.Nil(t, err)
+	assert.Equal(t, b.AbsPath, readHistoryIndex()[name])
+
+	b, err = NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Equal(t, Loc{2, 1}, b.StartCursor)
+}
+
+func TestPruneHistory(t *testing.T) {
+	oldConfigDir := config.ConfigDir
+	config.ConfigDir, _ = ioutil.TempDir("", "micro-buffer-test")
+	defer func() {
+		os.RemoveAll(config.ConfigDir)
+		config.ConfigDir = oldConfigDir
+	}()
+	dir := filepath.Join(config.ConfigDir, "buffers")
+	assert.Nil(t, os.Mkdir(dir, os.ModePerm))
+
+	kept := tempFile(t, "100%done.txt", "")
+	defer os.RemoveAll(filepath.Dir(kept))
+	old := tempFile(t, "old.txt", "")
+	defer os.RemoveAll(filepath.Dir(old))
+
+	write := func(name, path string) string {
+		file := filepath.Join(dir, name)
+		f, err := os.Create(file)
+		assert.Nil(t, err)
+		defer f.Close()
+		if path == "" {
+			f.WriteString("history")
+		} else {
+			assert.Nil(t, gob.NewEncoder(f).Encode(SerializedBuffer{Path: path}))
+		}
+		return file
+	}
+	keptFile := write(util.EscapePath(kept), kept)
+	oldFile := write(util.EscapePath(old), old)
+	goneFile := write(util.EscapePath("/no/such/file.txt"), "/no/such/file.txt")
+	hashedFile := write("abc123", "")
+	// The path of a history file without a stored path is unknown, even if
+	// its name looks like an escaped path
+	unknownFile := write(util.EscapePath("/no/such/unknown.txt"), "")
+	assert.Nil(t, writeHistoryIndex(map[string]string{"abc123": "/no/such/long/file.txt"}))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), os.ModePerm))
+
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	assert.Nil(t, os.Chtimes(oldFile, lastWeek, lastWeek))
+
+	entries := ListHistoryEntries()
+	assert.Equal(t, 5, len(entries))
+	for _, e := range entries {
+		switch e.File {
+		case hashedFile:
+			assert.Equal(t, "/no/such/long/file.txt", e.Path)
+		case keptFile:
+			assert.Equal(t, kept, e.Path)
+		case unknownFile:
+			assert.Equal(t, "", e.Path)
+			assert.Equal(t, int64(7), e.Size)
+		}
+	}
+
+	removed, err := PruneHistory(24 * time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, removed)
+
+	for _, f := range []string{oldFile, goneFile, hashedFile} {
+		_, err = os.Stat(f)
+		assert.True(t, os.IsNotExist(err))
+	}
+	for _, f := range []string{keptFile, unknownFile, filepath.Join(dir, "sub")} {
+		_, err = os.Stat(f)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 0, len(readHistoryIndex()))
+
+	// Unknown entries are only removed because of their age
+	removed, err = PruneHistory(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Nil(t, os.Chtimes(unknownFile, lastWeek, lastWeek))
+	removed, err = PruneHistory(24 * time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+}
+
+func TestNoHistoryPaths(t *testing.T) {
+	secret := tempFile(t, "secret.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(secret))
+	public := tempFile(t, "public.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(public))
+
+	config.GlobalSettings["savecursor"] = true
+	config.GlobalSettings["nohistorypaths"] = []interface{}{"*/secret.*"}
+	defer func() {
+		config.GlobalSettings["savecursor"] = false
+		config.GlobalSettings["nohistorypaths"] = []interface{}{}
+	}()
+
+	for _, path := range []string{secret, public} {
+		b, err := NewBufferFromFile(path, BTDefault)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Close())
+
+		_, err = os.Stat(b.serializedPath())
+		assert.Equal(t, path == secret, os.IsNotExist(err), path)
+	}
+}
+
+func TestClone(t *testing.T) {
+	path := tempFile(t, "clone.txt", "foo\nbar\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.Insert(Loc{0, 0}, "a")
+	b.SetOptionNative("tabsize", float64(8))
+
+	c := b.Clone()
+	defer c.Close()
+	assert.Equal(t, "afoo\nbar\n", string(c.Bytes()))
+	assert.Equal(t, 0, c.UndoStack.Len())
+	assert.True(t, c.Modified())
+
+	c.Insert(Loc{0, 1}, "baz")
+	c.SetOptionNative("tabsize", float64(2))
+	assert.Equal(t, "afoo\nbazbar\n", string(c.Bytes()))
+	assert.Equal(t, "afoo\nbar\n", string(b.Bytes()))
+	assert.Equal(t, 1, b.UndoStack.Len())
+	assert.Equal(t, float64(8), b.Settings["tabsize"])
+
+	c.Undo()
+	assert.Equal(t, "afoo\nbar\n", string(c.Bytes()))
+	b.Undo()
+	assert.Equal(t, "foo\nbar\n", string(b.Bytes()))
+	assert.Equal(t, "afoo\nbar\n", string(c.Bytes()))
+
+	// A clone can't overwrite the file of the original
+	assert.NotNil(t, c.Save())
+	copyPath := filepath.Join(filepath.Dir(path), "copy.txt")
+	assert.Nil(t, c.SaveCopy(copyPath))
+	data, err := ioutil.ReadFile(copyPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "afoo\nbar\n", string(data))
+}
+
+func TestInsertText(t *testing.T) {
+	b := NewBufferFromString("ab\n", "", BTDefault)
+	b.SetOptionNative("tabsize", float64(4))
+
+	b.InsertText(Loc{2, 0}, "\tfoo")
+	assert.Equal(t, "ab\tfoo\n", string(b.Bytes()))
+
+	b.SetOptionNative("tabstospaces", true)
+	b.InsertText(Loc{0, 1}, "\tfoo\n\t\tbar")
+	assert.Equal(t, "ab\tfoo\n    foo\n        bar", string(b.Bytes()))
+
+	// The tab stops depend on where the text is inserted, and the
+	// existing tab isn't changed
+	b.InsertText(Loc{2, 0}, "\tx")
+	assert.Equal(t, "ab  x\tfoo\n    foo\n        bar", string(b.Bytes()))
+}
+
+func TestLinesSetLines(t *testing.T) {
+	b := NewBufferFromString("one\ntwo\nthree\nfour", "", BTDefault)
+	lines := b.Lines()
+	assert.Equal(t, []string{"one", "two", "three", "four"}, lines)
+
+	// Lines returns a copy
+	lines[0] = "changed"
+	assert.Equal(t, "one", string(b.LineBytes(0)))
+
+	b.GetActiveCursor().GotoLoc(Loc{4, 3})
+	b.SetLines(lines)
+	assert.Equal(t, lines, b.Lines())
+	assert.Equal(t, Loc{4, 3}, b.GetActiveCursor().Loc)
+
+	tests := [][]string{
+		{"one", "two", "three", "four", "five"},
+		{"one", "two"},
+		{"two", "three"},
+		{"zero", "one", "2", "four"},
+		{""},
+		{"x"},
+	}
+	for _, test := range tests {
+		b = NewBufferFromString("one\ntwo\nthree\nfour", "", BTDefault)
+		b.GetActiveCursor().GotoLoc(b.End())
+		b.SetLines(test)
+		assert.Equal(t, test, b.Lines())
+		assert.True(t, InBounds(b.GetActiveCursor().Loc, b))
+
+		b.Undo()
+		assert.Equal(t, []string{"one", "two", "three", "four"}, b.Lines())
+	}
+}
+
+func TestDiskSizeDelta(t *testing.T) {
+	path := tempFile(t, "size.txt", "foo\nbar\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	delta, err := b.DiskSizeDelta()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), delta)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("foo\nbar\nbaz\n"), 0644))
+	delta, err = b.DiskSizeDelta()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), delta)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("fo"), 0644))
+	delta, err = b.DiskSizeDelta()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-6), delta)
+
+	assert.Nil(t, os.Remove(path))
+	_, err = b.DiskSizeDelta()
+	assert.Equal(t, ErrFileMissing, err)
+
+	_, err = NewBufferFromString("foo", "", BTDefault).DiskSizeDelta()
+	assert.Equal(t, ErrNoPath, err)
+}
+
+func TestNewBufferFromFileAtMatch(t *testing.T) {
+	path := tempFile(t, "match.txt", "first line\nhéllo wörld foo\nfoo again\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFileAtMatch(path, "foo", false)
+	assert.Nil(t, err)
+	assert.Equal(t, Loc{12, 1}, b.StartCursor)
+	assert.Equal(t, Loc{12, 1}, b.GetActiveCursor().Loc)
+	b.Close()
+
+	b, err = NewBufferFromFileAtMatch(path, `w.rld`, true)
+	assert.Nil(t, err)
+	assert.Equal(t, Loc{6, 1}, b.GetActiveCursor().Loc)
+	b.Close()
+
+	b, err = NewBufferFromFileAtMatch(path, "missing", false)
+	assert.Nil(t, err)
+	assert.Equal(t, Loc{0, 0}, b.GetActiveCursor().Loc)
+	b.Close()
+
+	_, err = NewBufferFromFileAtMatch(path, "(", true)
+	assert.NotNil(t, err)
+}
+
+func TestOpenFileTwice(t *testing.T) {
+	path := tempFile(t, "twice.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b1, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	b2, err := NewBufferFromFile(filepath.Join(filepath.Dir(path), ".", "twice.txt"), BTDefault)
+	assert.Nil(t, err)
+	assert.True(t, b1 == b2)
+	assert.Equal(t, 2, b1.Refs())
+
+	assert.Nil(t, b2.Close())
+	assert.Equal(t, 1, b1.Refs())
+	assert.False(t, b1.closed)
+
+	assert.Nil(t, b1.Close())
+	assert.True(t, b1.closed)
+	assert.Equal(t, 0, b1.Refs())
+
+	// Once it is closed the file gets a new buffer
+	b3, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.False(t, b1 == b3)
+	assert.Equal(t, 1, b3.Refs())
+
+	defer func(allow interface{}) {
+		config.GlobalSettings["allowduplicatebuffers"] = allow
+	}(config.GlobalSettings["allowduplicatebuffers"])
+	config.GlobalSettings["allowduplicatebuffers"] = true
+
+	b4, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.False(t, b3 == b4)
+	assert.Nil(t, b4.Close())
+	assert.Nil(t, b3.Close())
+}
+
+func TestSerializeFileFormatChange(t *testing.T) {
+	path := tempFile(t, "format.txt", "héllo\r\nwörld\r\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config.GlobalSettings["savecursor"] = true
+	defer func() { config.GlobalSettings["savecursor"] = false }()
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.Equal(t, "dos", b.Settings["fileformat"])
+	b.GetActiveCursor().GotoLoc(Loc{2, 1})
+	assert.Nil(t, b.Close())
+
+	// Convert the file to unix line endings
+	assert.Nil(t, ioutil.WriteFile(path, []byte("héllo\nwörld\n"), 0644))
+
+	b, err = NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Equal(t, "unix", b.Settings["fileformat"])
+	assert.Equal(t, Loc{2, 1}, b.GetActiveCursor().Loc)
+	assert.Equal(t, "wö", string(b.Substr(Loc{0, 1}, b.GetActiveCursor().Loc)))
+}
+
+func TestReplaceInLine(t *testing.T) {
+	b := NewBufferFromString("foo(bär, baz)\nnext", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	c := b.GetActiveCursor()
+	c.GotoLoc(Loc{12, 0})
+
+	assert.Nil(t, b.ReplaceInLine(0, 4, 7, "quux"))
+	assert.Equal(t, "foo(quux, baz)", string(b.LineBytes(0)))
+	assert.Equal(t, Loc{13, 0}, c.Loc)
+
+	assert.Nil(t, b.ReplaceInLine(0, 0, 3, "f"))
+	assert.Equal(t, "f(quux, baz)", string(b.LineBytes(0)))
+	assert.Equal(t, Loc{11, 0}, c.Loc)
+
+	assert.NotNil(t, b.ReplaceInLine(0, 3, 13, ""))
+	assert.NotNil(t, b.ReplaceInLine(0, 3, 2, ""))
+	assert.NotNil(t, b.ReplaceInLine(2, 0, 0, ""))
+
+	b.Undo()
+	assert.Equal(t, "foo(quux, baz)", string(b.LineBytes(0)))
+	b.Undo()
+	assert.Equal(t, "foo(bär, baz)", string(b.LineBytes(0)))
+	assert.Equal(t, "next", string(b.LineBytes(1)))
+}
+
+func TestReadLineRange(t *testing.T) {
+	text := "one\ntwo\nthree\nfour"
+	path := tempFile(t, "lines.txt", text)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	fb, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer fb.Close()
+	sb := NewBufferFromString(text, "", BTDefault)
+
+	for _, b := range []*Buffer{fb, sb} {
+		lines, err := b.ReadLineRange(1, 3)
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{[]byte("two"), []byte("three")}, lines)
+
+		lines, _ = b.ReadLineRange(-5, 100)
+		assert.Equal(t, 4, len(lines))
+		assert.Equal(t, []byte("four"), lines[3])
+
+		lines, _ = b.ReadLineRange(3, 1)
+		assert.Equal(t, 0, len(lines))
+
+		// The lines are copies
+		lines, _ = b.ReadLineRange(0, 1)
+		lines[0][0] = 'O'
+		assert.Equal(t, "one", b.Line(0))
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	root, _ := filepath.Abs(filepath.Join(string(filepath.Separator), "micro-project"))
+
+	b := NewBufferFromString("", filepath.Join(root, "src", "main.go"), BTDefault)
+	assert.Equal(t, filepath.Join("src", "main.go"), b.DisplayName(root))
+	assert.Equal(t, b.AbsPath, b.DisplayName(filepath.Join(root, "src", "main")))
+	assert.Equal(t, b.AbsPath, b.DisplayName(root+"-other"))
+	assert.Equal(t, b.AbsPath, b.DisplayName(""))
+
+	u, err := user.Current()
+	assert.Nil(t, err)
+	b = NewBufferFromString("", filepath.Join(u.HomeDir, "notes", "todo.txt"), BTDefault)
+	assert.Equal(t, filepath.Join("~", "notes", "todo.txt"), b.DisplayName(root))
+	assert.Equal(t, "todo.txt", b.DisplayName(filepath.Join(u.HomeDir, "notes")))
+
+	assert.Equal(t, "No name", NewBufferFromString("", "", BTDefault).DisplayName(root))
+}
+
+func TestOpenBackup(t *testing.T) {
+	path := tempFile(t, "backup.go", "package main\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	_, err = b.OpenBackup()
+	assert.Equal(t, ErrNoBackup, err)
+
+	b.Insert(b.End(), "\nfunc main() {}\n")
+	b.backups.Wait()
+	b.SetOptionNative("backup", true)
+	defer b.RemoveBackup()
+	assert.Nil(t, b.Backup(false))
+	// Too soon for another backup
+	b.Insert(b.End(), "// after the backup\n")
+	b.backups.Wait()
+
+	backup, err := b.OpenBackup()
+	assert.Nil(t, err)
+	defer backup.Close()
+	data, err := ioutil.ReadFile(b.backupPath())
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), string(backup.Bytes()))
+	assert.Equal(t, "package main\n\nfunc main() {}\n", string(backup.Bytes()))
+	assert.True(t, backup.Type.Readonly)
+	assert.True(t, backup.Type.Scratch)
+	assert.Equal(t, b.Settings["filetype"], backup.Settings["filetype"])
+}
+
+func TestLoadFromReader(t *testing.T) {
+	b := NewBufferFromString("one\ntwo\nthree\nfour\nfive", "gen.txt", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	b.GetActiveCursor().GotoLoc(Loc{4, 4})
+
+	text := "one\r\nTWO\r\n"
+	assert.Nil(t, b.LoadFromReader(strings.NewReader(text), int64(len(text))))
+	assert.Equal(t, "one\nTWO\n", string(b.Bytes()))
+	assert.Equal(t, "gen.txt", b.Path)
+	assert.Equal(t, Loc{0, 2}, b.GetActiveCursor().Loc)
+
+	b.Undo()
+	assert.Equal(t, "one\ntwo\nthree\nfour\nfive", string(b.Bytes()))
+
+	// The second read fails
+	r := iotest.TimeoutReader(iotest.HalfReader(strings.NewReader("partial\ntext")))
+	assert.Equal(t, iotest.ErrTimeout, b.LoadFromReader(r, 0))
+	assert.Equal(t, "one\ntwo\nthree\nfour\nfive", string(b.Bytes()))
+}
+
+func TestSafeLine(t *testing.T) {
+	b := NewBufferFromString("\x1b[31mred\x1b[0m\tok\x03\r\x7f\nnormal line é\n\u009b", "", BTDefault)
+	assert.Equal(t, "^[[31mred^[[0m\tok^C^M^?", b.SafeLine(0))
+	assert.Equal(t, "normal line é", b.SafeLine(1))
+	// Invalid bytes can't come from the file, which is decoded, but can be
+	// inserted
+	b.Insert(b.End(), "\xff")
+	assert.Equal(t, "<0x9b><0xff>", b.SafeLine(2))
+
+	// The control characters are still replaced when they aren't shown
+	b.SetOptionNative("showcontrolchars", false)
+	assert.Equal(t, "\uFFFD[31mred\uFFFD[0m\tok\uFFFD\uFFFD\uFFFD", b.SafeLine(0))
+	assert.Equal(t, "\uFFFD\uFFFD", b.SafeLine(2))
+}
+
+func TestFilterLines(t *testing.T) {
+	b := NewBufferFromString("// TODO: a\nfunc a() {}\n\n// TODO: b\n// todo\nTODO", "", BTDefault)
+	todo := func(n int, data []byte) bool {
+		return bytes.Contains(data, []byte("TODO"))
+	}
+	assert.Equal(t, []int{0, 3, 5}, b.FilterLines(todo))
+	assert.Equal(t, []int{1, 3, 5}, b.FilterLines(func(n int, data []byte) bool {
+		return n%2 == 1
+	}))
+	assert.Nil(t, b.FilterLines(func(n int, data []byte) bool {
+		return false
+	}))
+}
+
+func TestRangeUntilLine(t *testing.T) {
+	b := NewBufferFromString("a: 1\nEOF \nb: 2\nEOF\nrest\nEOF", "", BTDefault)
+	loc, ok := b.RangeUntilLine("EOF")
+	assert.True(t, ok)
+	assert.Equal(t, Loc{0, 3}, loc)
+	assert.Equal(t, "a: 1\nEOF \nb: 2\n", string(b.Substr(b.Start(), loc)))
+
+	loc, ok = b.RangeUntilLine("END")
+	assert.False(t, ok)
+	assert.Equal(t, b.End(), loc)
+}
+
+func TestDirtyHasher(t *testing.T) {
+	used := 0
+	SetDirtyHasher(DirtyHasherFunc(func() hash.Hash {
+		used++
+		return fnv.New128a()
+	}))
+	defer SetDirtyHasher(nil)
+
+	b := NewBufferFromString("foo\nbar", "", BTDefault)
+	b.SetOptionNative("fastdirty", false)
+	assert.Equal(t, 16, len(b.origHash))
+	assert.False(t, b.Modified())
+
+	b.Insert(Loc{3, 0}, "d")
+	assert.True(t, b.Modified())
+	b.Remove(Loc{3, 0}, Loc{4, 0})
+	assert.False(t, b.Modified())
+	assert.True(t, used >= 4)
+}
+
+func TestAppendNewDiskContent(t *testing.T) {
+	path := tempFile(t, "tail.log", "one\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	appendFile := func(text string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = f.WriteString(text)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+	}
+
+	n, err := b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	appendFile("two\nthr")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "one\ntwo\nthr", string(b.Bytes()))
+	assert.False(t, b.Modified())
+
+	appendFile("ee\nfour\n")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "one\ntwo\nthree\nfour\n", string(b.Bytes()))
+	assert.False(t, b.ExternallyModified())
+
+	// Rotated logs have to be reloaded
+	assert.Nil(t, ioutil.WriteFile(path, []byte("new\n"), 0644))
+	_, err = b.AppendNewDiskContent()
+	assert.Equal(t, ErrFileTruncated, err)
+	assert.Nil(t, b.ReOpen())
+	appendFile("more\n")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "new\nmore\n", string(b.Bytes()))
+}
+
+func TestAppendNewDiskContentCRLF(t *testing.T) {
+	path := tempFile(t, "tail.log", "one\r\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.True(t, b.Endings == FFDos)
+
+	appendFile := func(text string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = f.WriteString(text)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+	}
+
+	// The line ending is split between two appends
+	appendFile("two\r")
+	n, err := b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "one\ntwo", string(b.Substr(b.Start(), b.End())))
+
+	appendFile("\nthree\r\n")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "one\ntwo\nthree\n", string(b.Substr(b.Start(), b.End())))
+
+	// Only a '\r' was appended
+	appendFile("\r")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, b.ExternallyModified())
+	appendFile("\n")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "one\ntwo\nthree\n\n", string(b.Substr(b.Start(), b.End())))
+}
+
+func TestAppendNewDiskContentPartialRune(t *testing.T) {
+	path := tempFile(t, "tail.log", "")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	appendFile := func(text string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = f.WriteString(text)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+	}
+
+	// The bytes of é are split between two appends
+	appendFile("caf\xc3")
+	n, err := b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "caf", string(b.Bytes()))
+	assert.False(t, b.ExternallyModified())
+
+	appendFile("\xa9\n")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "café\n", string(b.Bytes()))
+
+	// Only the first byte of a character was appended
+	appendFile("\xe2")
+	n, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "café\n", string(b.Bytes()))
+	appendFile("\x82\xac")
+	_, err = b.AppendNewDiskContent()
+	assert.Nil(t, err)
+	assert.Equal(t, "café\n€", string(b.Bytes()))
+}
+
+func TestSetType(t *testing.T) {
+	b := NewBufferFromString("foo", "", BTDefault)
+
+	assert.Nil(t, b.SetType(BTHelp))
+	assert.True(t, b.Type.Readonly)
+	assert.Equal(t, true, b.Settings["readonly"])
+	b.Insert(b.Start(), "x")
+	assert.Equal(t, "foo", string(b.Bytes()))
+
+	assert.Nil(t, b.SetType(BTDefault))
+	assert.Equal(t, false, b.Settings["readonly"])
+	b.Insert(b.Start(), "x")
+	assert.Equal(t, "xfoo", string(b.Bytes()))
+
+	// The change could not be saved anymore
+	assert.NotNil(t, b.SetType(BTScratch))
+	assert.Equal(t, BTDefault, b.Type)
+
+	b = NewBufferFromString("foo", "", BTDefault)
+	assert.Nil(t, b.SetType(BTScratch))
+	assert.Nil(t, b.SetType(BTLog))
+	assert.NotNil(t, b.SetType(BTInfo))
+
+	b = NewBufferFromString("", "", BTInfo)
+	assert.NotNil(t, b.SetType(BTDefault))
+	assert.Equal(t, BTInfo, b.Type)
+}
+
+func TestMustExist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "typo.txt")
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.Equal(t, "", string(b.Bytes()))
+	b.Close()
+
+	config.GlobalSettings["mustexist"] = true
+	defer func() {
+		config.GlobalSettings["mustexist"] = false
+	}()
+	b, err = NewBufferFromFile(path, BTDefault)
+	assert.Equal(t, os.ErrNotExist, err)
+	assert.Nil(t, b)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("text"), 0644))
+	b, err = NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	assert.Equal(t, "text", string(b.Bytes()))
+	b.Close()
+}
+
+func TestWSLPaths(t *testing.T) {
+	config.GlobalSettings["wslpaths"] = true
+	defer func() {
+		config.GlobalSettings["wslpaths"] = false
+	}()
+	b, err := NewBufferFromFile(`Q:\micro\file.txt`, BTDefault)
+	assert.Nil(t, err)
+	if runtime.GOOS == "windows" {
+		assert.Equal(t, `Q:\micro\file.txt`, b.Path)
+	} else {
+		assert.Equal(t, "/mnt/q/micro/file.txt", b.Path)
+	}
+	b.Close()
+}
+
+func TestInsertLine(t *testing.T) {
+	b := NewBufferFromString("b\nd", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	b.GetActiveCursor().GotoLoc(Loc{1, 1})
+	c := NewCursor(b, Loc{1, 0})
+	b.AddCursor(c)
+
+	b.InsertLine(0, "a")
+	assert.Equal(t, "a\nb\nd", string(b.Bytes()))
+	assert.Equal(t, Loc{1, 1}, c.Loc)
+	assert.Equal(t, Loc{1, 2}, b.GetCursor(0).Loc)
+
+	b.InsertLine(2, "c")
+	assert.Equal(t, "a\nb\nc\nd", string(b.Bytes()))
+	assert.Equal(t, Loc{1, 1}, c.Loc)
+	assert.Equal(t, Loc{1, 3}, b.GetCursor(0).Loc)
+
+	b.InsertLine(b.LinesNum(), "e")
+	assert.Equal(t, "a\nb\nc\nd\ne", string(b.Bytes()))
+	assert.Equal(t, Loc{1, 3}, b.GetCursor(0).Loc)
+
+	// Each line is undone at once
+	b.Undo()
+	assert.Equal(t, "a\nb\nc\nd", string(b.Bytes()))
+	b.Undo()
+	assert.Equal(t, "a\nb\nd", string(b.Bytes()))
+}
+
+func TestExpandedLine(t *testing.T) {
+	b := NewBufferFromString("\tx\na\tb\nabcd\te\nab\t\tc\n界\tx\nno tabs", "", BTDefault)
+	b.SetOptionNative("tabsize", float64(4))
+
+	assert.Equal(t, "    x", b.ExpandedLine(0))
+	assert.Equal(t, "a   b", b.ExpandedLine(1))
+	assert.Equal(t, "abcd    e", b.ExpandedLine(2))
+	assert.Equal(t, "ab      c", b.ExpandedLine(3))
+	// Wide runes take two columns
+	assert.Equal(t, "界  x", b.ExpandedLine(4))
+	assert.Equal(t, "no tabs", b.ExpandedLine(5))
+
+	b.SetOptionNative("tabsize", float64(8))
+	assert.Equal(t, "a       b", b.ExpandedLine(1))
+}
+
+func TestIsSelected(t *testing.T) {
+	b := NewBufferFromString("first line\nsecond line\nthird line", "", BTDefault)
+	assert.False(t, b.IsSelected(Loc{0, 0}))
+
+	c := b.GetActiveCursor()
+	c.SetSelectionStart(Loc{6, 0})
+	c.SetSelectionEnd(Loc{2, 1})
+	// A selection made backwards
+	c2 := NewCursor(b, Loc{0, 2})
+	b.AddCursor(c2)
+	c2.SetSelectionStart(Loc{5, 2})
+	c2.SetSelectionEnd(Loc{1, 1})
+	// A cursor without a selection
+	b.AddCursor(NewCursor(b, Loc{8, 2}))
+
+	assert.False(t, b.IsSelected(Loc{5, 0}))
+	assert.True(t, b.IsSelected(Loc{6, 0}))
+	assert.True(t, b.IsSelected(Loc{10, 0}))
+	// Selected by both cursors
+	assert.True(t, b.IsSelected(Loc{1, 1}))
+	assert.True(t, b.IsSelected(Loc{3, 1}))
+	assert.True(t, b.IsSelected(Loc{4, 2}))
+	assert.False(t, b.IsSelected(Loc{5, 2}))
+	assert.False(t, b.IsSelected(Loc{8, 2}))
+
+	c2.ResetSelection()
+	assert.True(t, b.IsSelected(Loc{1, 1}))
+	assert.False(t, b.IsSelected(Loc{2, 1}))
+}
+
+func TestSurroundRange(t *testing.T) {
+	b := NewBufferFromString("say hello world", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	c := b.GetActiveCursor()
+	c.SetSelectionStart(Loc{4, 0})
+	c.SetSelectionEnd(Loc{9, 0})
+	c.GotoLoc(Loc{9, 0})
+
+	b.SurroundRange(Loc{4, 0}, Loc{9, 0}, "<b>", "</b>")
+	assert.Equal(t, "say <b>hello</b> world", string(b.Bytes()))
+	assert.Equal(t, "hello", string(c.GetSelection()))
+	assert.Equal(t, Loc{12, 0}, c.Loc)
+
+	b.Undo()
+	assert.Equal(t, "say hello world", string(b.Bytes()))
+
+	b = NewBufferFromString("if x {\n\ty()\n}\nz", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	c = b.GetActiveCursor()
+	c.GotoLoc(Loc{0, 3})
+	b.SurroundRange(Loc{1, 2}, Loc{0, 0}, "/*\n", "\n*/")
+	assert.Equal(t, "/*\nif x {\n\ty()\n}\n*/\nz", string(b.Bytes()))
+	assert.Equal(t, Loc{0, 5}, c.Loc)
+
+	b.Undo()
+	assert.Equal(t, "if x {\n\ty()\n}\nz", string(b.Bytes()))
+}
+
+func TestInsertAtCursors(t *testing.T) {
+	b := NewBufferFromString("foo\nbar\nbaz", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	b.GetActiveCursor().GotoLoc(Loc{3, 0})
+	c1 := NewCursor(b, Loc{0, 1})
+	b.AddCursor(c1)
+	c2 := NewCursor(b, Loc{1, 2})
+	b.AddCursor(c2)
+
+	b.InsertAtCursors("()")
+	assert.Equal(t, "foo()\n()bar\nb()az", string(b.Bytes()))
+	assert.Equal(t, Loc{5, 0}, b.GetCursor(0).Loc)
+	assert.Equal(t, Loc{2, 1}, c1.Loc)
+	assert.Equal(t, Loc{3, 2}, c2.Loc)
+
+	// Cursors on the same line, and text with a newline
+	c2.GotoLoc(Loc{4, 1})
+	b.InsertAtCursors("\n")
+	assert.Equal(t, "foo()\n\n()\nba\nr\nb()az", string(b.Bytes()))
+	assert.Equal(t, Loc{0, 1}, b.GetCursor(0).Loc)
+	assert.Equal(t, Loc{0, 3}, c1.Loc)
+	assert.Equal(t, Loc{0, 4}, c2.Loc)
+
+	b.Undo()
+	assert.Equal(t, "foo()\n()bar\nb()az", string(b.Bytes()))
+	b.Undo()
+	assert.Equal(t, "foo\nbar\nbaz", string(b.Bytes()))
+}
+
+func TestDeleteAtCursors(t *testing.T) {
+	b := NewBufferFromString("one two\nthree four\nfive", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	c0 := b.GetActiveCursor()
+	c0.SetSelectionStart(Loc{4, 0})
+	c0.SetSelectionEnd(Loc{7, 0})
+	c0.GotoLoc(Loc{7, 0})
+	// A selection across lines that was made backwards
+	c1 := NewCursor(b, Loc{5, 1})
+	c1.SetSelectionStart(Loc{2, 2})
+	c1.SetSelectionEnd(Loc{5, 1})
+	b.AddCursor(c1)
+	c2 := NewCursor(b, Loc{0, 1})
+	b.AddCursor(c2)
+
+	b.DeleteAtCursors(false)
+	assert.Equal(t, "one \nthreeve", string(b.Bytes()))
+	assert.Equal(t, Loc{4, 0}, c0.Loc)
+	assert.Equal(t, Loc{5, 1}, c1.Loc)
+	assert.Equal(t, Loc{0, 1}, c2.Loc)
+	assert.False(t, c0.HasSelection())
+	assert.False(t, c1.HasSelection())
+
+	b.DeleteAtCursors(true)
+	assert.Equal(t, "onethreve", string(b.Bytes()))
+	assert.Equal(t, Loc{3, 0}, c0.Loc)
+	assert.Equal(t, Loc{7, 0}, c1.Loc)
+	assert.Equal(t, Loc{3, 0}, c2.Loc)
+
+	b.Undo()
+	assert.Equal(t, "one \nthreeve", string(b.Bytes()))
+	b.Undo()
+	assert.Equal(t, "one two\nthree four\nfive", string(b.Bytes()))
+}
+
+func TestLocFromCompilerPos(t *testing.T) {
+	b := NewBufferFromString("ab\nx := \"héllo wörld\"\n", "", BTDefault)
+
+	// the 'w' is byte column 14 and character column 13
+	assert.Equal(t, Loc{12, 1}, b.LocFromCompilerPos(2, 14, true))
+	assert.Equal(t, Loc{12, 1}, b.LocFromCompilerPos(2, 13, false))
+	assert.Equal(t, Loc{14, 1}, b.LocFromCompilerPos(2, 15, false))
+
+	// the second byte of 'é' points to 'é'
+	assert.Equal(t, Loc{7, 1}, b.LocFromCompilerPos(2, 9, true))
+	assert.Equal(t, Loc{8, 1}, b.LocFromCompilerPos(2, 10, true))
+
+	// clamping
+	assert.Equal(t, Loc{0, 0}, b.LocFromCompilerPos(0, 0, true))
+	assert.Equal(t, Loc{2, 0}, b.LocFromCompilerPos(1, 100, false))
+	assert.Equal(t, Loc{18, 1}, b.LocFromCompilerPos(2, 100, true))
+	assert.Equal(t, Loc{0, 2}, b.LocFromCompilerPos(50, 3, false))
+}
+
+func TestEnclosingBlock(t *testing.T) {
+	b := NewBufferFromString("int f(int x) {\n"+
+		"\tif (x) {\n"+
+		"\t\treturn g(x, {1, 2});\n"+
+		"\t}\n"+
+		"\treturn 0;\n"+
+		"}\n", "", BTDefault)
+
+	start, end, ok := b.EnclosingBlock(Loc{3, 2})
+	assert.True(t, ok)
+	assert.Equal(t, Loc{8, 1}, start)
+	assert.Equal(t, Loc{2, 3}, end)
+
+	start, end, ok = b.EnclosingBlock(Loc{17, 2})
+	assert.True(t, ok)
+	assert.Equal(t, Loc{14, 2}, start)
+	assert.Equal(t, Loc{20, 2}, end)
+
+	// the balanced braces before loc on its line are skipped
+	start, end, ok = b.EnclosingBlock(Loc{20, 2})
+	assert.True(t, ok)
+	assert.Equal(t, Loc{8, 1}, start)
+	assert.Equal(t, Loc{2, 3}, end)
+
+	start, end, ok = b.EnclosingBlock(Loc{1, 4})
+	assert.True(t, ok)
+	assert.Equal(t, Loc{13, 0}, start)
+	assert.Equal(t, Loc{1, 5}, end)
+
+	_, _, ok = b.EnclosingBlock(Loc{0, 0})
+	assert.False(t, ok)
+
+	b = NewBufferFromString("def f(x):\n"+
+		"    if x:\n"+
+		"        return 1\n"+
+		"\n"+
+		"        pass\n"+
+		"\n"+
+		"    return 0\n"+
+		"\n"+
+		"y = 2\n", "", BTDefault)
+	b.SetOptionNative("filetype", "python")
+	b.SetOptionNative("tabsize", float64(4))
+
+	start, end, ok = b.EnclosingBlock(Loc{3, 2})
+	assert.True(t, ok)
+	assert.Equal(t, Loc{0, 1}, start)
+	assert.Equal(t, Loc{12, 4}, end)
+
+	start, end, ok = b.EnclosingBlock(Loc{0, 6})
+	assert.True(t, ok)
+	assert.Equal(t, Loc{0, 0}, start)
+	assert.Equal(t, Loc{12, 6}, end)
+
+	_, _, ok = b.EnclosingBlock(Loc{0, 8})
+	assert.False(t, ok)
+}
+
+func TestNewFileTemplate(t *testing.T) {
+	template := tempFile(t, "sh", "#!/bin/sh\n\n")
+	dir := filepath.Dir(template)
+	defer os.RemoveAll(dir)
+
+	defer func(dir interface{}) {
+		config.GlobalSettings["templatedir"] = dir
+	}(config.GlobalSettings["templatedir"])
+	config.GlobalSettings["templatedir"] = dir
+
+	b, err := NewBufferFromFile(filepath.Join(dir, "script.sh"), BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Equal(t, "#!/bin/sh\n\n", string(b.Bytes()))
+	assert.False(t, b.Modified())
+
+	// Buffers that share the text with b don't insert the template again
+	same, err := NewBufferFromFile(filepath.Join(dir, "script.sh"), BTDefault)
+	assert.Nil(t, err)
+	defer same.Close()
+	shared, err := NewBufferFromFile(filepath.Join(dir, "script.sh"), BTScratch)
+	assert.Nil(t, err)
+	defer shared.Close()
+	assert.True(t, shared.SharedBuffer == b.SharedBuffer)
+	assert.Equal(t, "#!/bin/sh\n\n", string(b.Bytes()))
+
+	b.Undo()
+	assert.Equal(t, "", string(b.Bytes()))
+	assert.True(t, b.Modified())
+
+	// No template for this extension
+	txt, err := NewBufferFromFile(filepath.Join(dir, "notes.txt"), BTDefault)
+	assert.Nil(t, err)
+	defer txt.Close()
+	assert.Equal(t, "", string(txt.Bytes()))
+
+	// Existing files are never changed
+	b2, err := NewBufferFromFile(tempFile(t, "old.sh", "echo hi\n"), BTDefault)
+	assert.Nil(t, err)
+	defer os.RemoveAll(filepath.Dir(b2.Path))
+	defer b2.Close()
+	assert.Equal(t, "echo hi\n", string(b2.Bytes()))
+
+	// A template directory that can't be expanded has no templates
+	config.GlobalSettings["templatedir"] = "~micro-no-such-user/templates"
+	assert.Equal(t, "", newFileTemplate("script.sh"))
+}
@@ -9,7 +9,7 @@ import (
 
 // InBounds returns whether the given location is a valid character position in the given buffer
 func InBounds(pos Loc, buf *Buffer) bool {
-	if pos.Y < 0 || pos.Y >= len(buf.lines) || pos.X < 0 || pos.X > utf8.RuneCount(buf.LineBytes(pos.Y)) {
+	if pos.Y < 0 || pos.Y >= len(buf.lines) || pos.X < 0 || pos.X > buf.LineRuneCount(pos.Y) {
 		return false
 	}
 
@@ -76,8 +76,8 @@ func (c *Cursor) GetVisualX() int {
 
 	bytes := c.buf.LineBytes(c.Y)
 	tabsize := int(c.buf.Settings["tabsize"].(float64))
-	if c.X > utf8.RuneCount(bytes) {
-		c.X = utf8.RuneCount(bytes) - 1
+	if c.X > c.buf.LineRuneCount(c.Y) {
+		c.X = c.buf.LineRuneCount(c.Y) - 1
 	}
 
 	return util.StringWidth(bytes, c.X, tabsize)
@@ -102,7 +102,7 @@ func (c *Cursor) Start() {
 func (c *Cursor) StartOfText() {
 	c.Start()
 	for util.IsWhitespace(c.RuneUnder(c.X)) {
-		if c.X == utf8.RuneCount(c.buf.LineBytes(c.Y)) {
+		if c.X == c.buf.LineRuneCount(c.Y) {
 			break
 		}
 		c.Right()
@@ -111,7 +111,7 @@ func (c *Cursor) StartOfText() {
 
 // End moves the cursor to the end of the line it is on
 func (c *Cursor) End() {
-	c.X = utf8.RuneCount(c.buf.LineBytes(c.Y))
+	c.X = c.buf.LineRuneCount(c.Y)
 	c.LastVisualX = c.GetVisualX()
 }
 
@@ -272,7 +272,7 @@ func (c *Cursor) Right() {
 	if c.Loc == c.buf.End() {
 		return
 	}
-	if c.X < utf8.RuneCount(c.buf.LineBytes(c.Y)) {
+	if c.X < c.buf.LineRuneCount(c.Y) {
 		c.X++
 	} else {
 		c.Down()
@@ -293,8 +293,8 @@ func (c *Cursor) Relocate() {
 
 	if c.X < 0 {
 		c.X = 0
-	} else if c.X > utf8.RuneCount(c.buf.LineBytes(c.Y)) {
-		c.X = utf8.RuneCount(c.buf.LineBytes(c.Y))
+	} else if c.X > c.buf.LineRuneCount(c.Y) {
+		c.X = c.buf.LineRuneCount(c.Y)
 	}
 }
 
@@ -320,7 +320,7 @@ func (c *Cursor) SelectWord() {
 	c.SetSelectionStart(Loc{backward, c.Y})
 	c.OrigSelection[0] = c.CurSelection[0]
 
-	lineLen := utf8.RuneCount(c.buf.LineBytes(c.Y)) - 1
+	lineLen := c.buf.LineRuneCount(c.Y) - 1
 	for forward < lineLen && util.IsWordChar(c.RuneUnder(forward+1)) {
 		forward++
 	}
@@ -352,7 +352,7 @@ func (c *Cursor) AddWordToSelection() {
 	if c.Loc.GreaterThan(c.OrigSelection[1]) {
 		forward := c.X
 
-		lineLen := utf8.RuneCount(c.buf.LineBytes(c.Y)) - 1
+		lineLen := c.buf.LineRuneCount(c.Y) - 1
 		for forward < lineLen && util.IsWordChar(c.RuneUnder(forward+1)) {
 			forward++
 		}
@@ -379,7 +379,7 @@ func (c *Cursor) SelectTo(loc Loc) {
 // WordRight moves the cursor one word to the right
 func (c *Cursor) WordRight() {
 	for util.IsWhitespace(c.RuneUnder(c.X)) {
-		if c.X == utf8.RuneCount(c.buf.LineBytes(c.Y)) {
+		if c.X == c.buf.LineRuneCount(c.Y) {
 			c.Right()
 			return
 		}
@@ -387,7 +387,7 @@ func (c *Cursor) WordRight() {
 	}
 	c.Right()
 	for util.IsWordChar(c.RuneUnder(c.X)) {
-		if c.X == utf8.RuneCount(c.buf.LineBytes(c.Y)) {
+		if c.X == c.buf.LineRuneCount(c.Y) {
 			return
 		}
 		c.Right()
@@ -0,0 +1,167 @@
+package buffer
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// PositionEncoding is the unit that the columns of TextEdit positions are
+// counted in
+type PositionEncoding int
+
+const (
+	// PosRunes counts columns in runes, like Loc
+	PosRunes PositionEncoding = iota
+	// PosUTF8 counts columns in bytes
+	PosUTF8
+	// PosUTF16 counts columns in UTF-16 code units, which is the default of
+	// the language server protocol
+	PosUTF16
+)
+
+// A TextEdit replaces the text from Start to End with NewText, like the
+// TextEdits of the language server protocol
+// The X of Start and End is counted in the units of Encoding
+type TextEdit struct {
+	Start    Loc
+	End      Loc
+	NewText  string
+	Encoding PositionEncoding
+}
+
+// runeCol returns the rune column of the column x of line y that is counted
+// in the units of enc
+// Columns past the end of the line are at the end of the line
+func (b *Buffer) runeCol(y, x int, enc PositionEncoding) int {
+	line := b.LineBytes(y)
+	col := 0
+	for i, r := range string(line) {
+		switch enc {
+		case PosUTF8:
+			if i >= x {
+				return col
+			}
+		case PosUTF16:
+			if x <= 0 {
+				return col
+			}
+			x -= utf16Len(r)
+		default:
+			if col >= x {
+				return col
+			}
+		}
+		col++
+	}
+	return col
+}
+
+// utf16Len returns the number of UTF-16 code units that encode r
+func utf16Len(r rune) int {
+	if r >= 0x10000 && r <= utf8.MaxRune {
+		return 2
+	}
+	return 1
+}
+
+// RuneColToUTF16Col returns the column of loc in UTF-16 code units, which is
+// how the language server protocol counts columns by default
+// Runes outside of the basic multilingual plane (such as most emoji) take two
+// code units. Columns past the end of the line are at the end of the line
+func (b *Buffer) RuneColToUTF16Col(loc Loc) int {
+	col := 0
+	for i, r := range []rune(string(b.LineBytes(loc.Y))) {
+		if i >= loc.X {
+			break
+		}
+		col += utf16Len(r)
+	}
+	return col
+}
+
+// UTF16ColToRuneCol returns the rune column of the column u16col of line y
+// that is counted in UTF-16 code units
+// A column in the middle of a rune that takes two code units is after the
+// rune. Columns past the end of the line are at the end of the line
+func (b *Buffer) UTF16ColToRuneCol(y, u16col int) int {
+	return b.runeCol(y, u16col, PosUTF16)
+}
+
+// editLoc converts the position of an edit to a location in the buffer
+// A position on the line after the last line is at the end of the buffer
+func (b *Buffer) editLoc(pos Loc, enc PositionEncoding) (Loc, error) {
+	if pos.Y < 0 || pos.X < 0 || pos.Y > b.LinesNum() {
+		return Loc{}, errors.New("Position " + strconv.Itoa(pos.Y) + ":" + strconv.Itoa(pos.X) + " is outside of the buffer")
+	}
+	if pos.Y == b.LinesNum() {
+		return b.End(), nil
+	}
+	return Loc{b.runeCol(pos.Y, pos.X, enc), pos.Y}, nil
+}
+
+// ApplyEdits applies a list of edits to the buffer as a single undoable event
+// The positions of all edits refer to the text before any of them is applied
+// Edits that insert at the same location are inserted in the order of the
+// list, and before the text of an edit that replaces text from there
+// If any edits overlap, an error is returned and the buffer is left unchanged
+func (b *Buffer) ApplyEdits(edits []TextEdit) error {
+	if b.Type.Readonly {
+		return errors.New("Cannot edit readonly buffer")
+	}
+
+	deltas := make([]Delta, len(edits))
+	for i, e := range edits {
+		start, err := b.editLoc(e.Start, e.Encoding)
+		if err != nil {
+			return err
+		}
+		end, err := b.editLoc(e.End, e.Encoding)
+		if err != nil {
+			return err
+		}
+		if end.LessThan(start) {
+			return errors.New("Edit " + strconv.Itoa(i+1) + " ends before it starts")
+		}
+		deltas[i] = Delta{[]byte(e.NewText), start, end, nil}
+	}
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	// Apply the edits from the bottom up, so that the positions of the edits
+	// that are still to be applied don't move. Of the edits at the same
+	// location, a replacement must be applied before insertions, which would
+	// be removed by it otherwise, and insertions in reverse, which keeps their
+	// text in the order of the list
+	order := make([]int, len(deltas))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := deltas[order[i]], deltas[order[j]]
+		if a.Start != b.Start {
+			return b.Start.LessThan(a.Start)
+		}
+		if (a.Start == a.End) != (b.Start == b.End) {
+			return a.Start != a.End
+		}
+		return order[i] > order[j]
+	})
+
+	sorted := make([]Delta, len(order))
+	for i, k := range order {
+		sorted[i] = deltas[k]
+		if i > 0 && sorted[i].End.GreaterThan(sorted[i-1].Start) {
+			return errors.New("Edits " + strconv.Itoa(k+1) + " and " + strconv.Itoa(order[i-1]+1) + " overlap")
+		}
+	}
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.MultipleReplace(sorted)
+	b.RelocateCursors()
+	b.backupAsync()
+	return nil
+}
@@ -0,0 +1,96 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyEdits(t *testing.T) {
+	b := NewBufferFromString("func foo() {\n\treturn foo\n}\n", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	b.Insert(b.End(), "// end\n")
+
+	err := b.ApplyEdits([]TextEdit{
+		{Start: Loc{8, 1}, End: Loc{11, 1}, NewText: "bar"},
+		{Start: Loc{5, 0}, End: Loc{8, 0}, NewText: "bar"},
+		{Start: Loc{0, 0}, End: Loc{0, 0}, NewText: "// a\n"},
+		{Start: Loc{0, 0}, End: Loc{0, 0}, NewText: "// b\n"},
+		{Start: Loc{1, 2}, End: Loc{0, 4}, NewText: ""},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "// a\n// b\nfunc bar() {\n\treturn bar\n}", string(b.Bytes()))
+
+	// All edits are undone at once
+	b.Undo()
+	assert.Equal(t, "func foo() {\n\treturn foo\n}\n// end\n", string(b.Bytes()))
+	b.Redo()
+	assert.Equal(t, "// a\n// b\nfunc bar() {\n\treturn bar\n}", string(b.Bytes()))
+}
+
+func TestApplyEditsEncoding(t *testing.T) {
+	b := NewBufferFromString("é😀x = 1\n", "", BTDefault)
+
+	// The x is at byte 6, UTF-16 unit 3 and rune 2
+	err := b.ApplyEdits([]TextEdit{{Start: Loc{6, 0}, End: Loc{7, 0}, NewText: "a", Encoding: PosUTF8}})
+	assert.Nil(t, err)
+	err = b.ApplyEdits([]TextEdit{{Start: Loc{3, 0}, End: Loc{4, 0}, NewText: "b", Encoding: PosUTF16}})
+	assert.Nil(t, err)
+	err = b.ApplyEdits([]TextEdit{{Start: Loc{2, 0}, End: Loc{3, 0}, NewText: "c", Encoding: PosRunes}})
+	assert.Nil(t, err)
+	assert.Equal(t, "é😀c = 1\n", string(b.Bytes()))
+
+	// Columns past the end of a line are at its end
+	err = b.ApplyEdits([]TextEdit{{Start: Loc{100, 0}, End: Loc{100, 0}, NewText: ";", Encoding: PosUTF16}})
+	assert.Nil(t, err)
+	assert.Equal(t, "é😀c = 1;\n", string(b.Bytes()))
+}
+
+func TestApplyEditsErrors(t *testing.T) {
+	b := NewBufferFromString("one\ntwo\n", "", BTDefault)
+
+	err := b.ApplyEdits([]TextEdit{
+		{Start: Loc{0, 0}, End: Loc{2, 0}, NewText: "a"},
+		{Start: Loc{1, 0}, End: Loc{1, 1}, NewText: "b"},
+	})
+	assert.NotNil(t, err)
+	err = b.ApplyEdits([]TextEdit{
+		{Start: Loc{1, 0}, End: Loc{3, 0}, NewText: "a"},
+		{Start: Loc{1, 0}, End: Loc{2, 0}, NewText: "b"},
+	})
+	assert.NotNil(t, err)
+	err = b.ApplyEdits([]TextEdit{{Start: Loc{0, 5}, End: Loc{0, 5}, NewText: "a"}})
+	assert.NotNil(t, err)
+	err = b.ApplyEdits([]TextEdit{{Start: Loc{2, 0}, End: Loc{1, 0}, NewText: "a"}})
+	assert.NotNil(t, err)
+	assert.Equal(t, "one\ntwo\n", string(b.Bytes()))
+
+	// Adjacent edits don't overlap
+	err = b.ApplyEdits([]TextEdit{
+		{Start: Loc{0, 0}, End: Loc{3, 0}, NewText: "1"},
+		{Start: Loc{3, 0}, End: Loc{0, 1}, NewText: " "},
+		{Start: Loc{0, 0}, End: Loc{0, 0}, NewText: "<"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "<1 two\n", string(b.Bytes()))
+}
+
+func TestUTF16Col(t *testing.T) {
+	b := NewBufferFromString("a😀b𝄞c\nplain", "", BTDefault)
+
+	// The emoji and the clef take two code units each
+	u16 := []int{0, 1, 3, 4, 6, 7}
+	for x, col := range u16 {
+		assert.Equal(t, col, b.RuneColToUTF16Col(Loc{x, 0}))
+		assert.Equal(t, x, b.UTF16ColToRuneCol(0, col))
+	}
+	assert.NotEqual(t, 4, b.RuneColToUTF16Col(Loc{4, 0}))
+
+	// Between the two code units of the emoji
+	assert.Equal(t, 2, b.UTF16ColToRuneCol(0, 2))
+
+	assert.Equal(t, 7, b.RuneColToUTF16Col(Loc{100, 0}))
+	assert.Equal(t, 5, b.UTF16ColToRuneCol(0, 100))
+	assert.Equal(t, 3, b.RuneColToUTF16Col(Loc{3, 1}))
+	assert.Equal(t, 3, b.UTF16ColToRuneCol(1, 3))
+}
@@ -0,0 +1,98 @@
+package buffer
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// The number of bytes at the start of a file that its encoding is detected
+// from
+const encodingSampleSize = 4096
+
+// A DetectedEncoding is the encoding that the start of a file seems to be in
+// Confidence goes from 0 (a guess) to 1 (certain)
+type DetectedEncoding struct {
+	Name       string
+	Confidence float64
+}
+
+// DetectEncoding guesses the encoding of data from its byte order mark, or
+// from whether it is valid UTF-8 or looks like UTF-16. Anything else is
+// guessed to be windows-1252 (a superset of Latin-1) with a low confidence,
+// since any bytes are valid in it
+// The end of data may be cut in the middle of a character
+func DetectEncoding(data []byte) DetectedEncoding {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return DetectedEncoding{"utf-8", 1}
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return DetectedEncoding{"utf-16le", 1}
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return DetectedEncoding{"utf-16be", 1}
+	}
+
+	// Text in UTF-16 has a zero byte in most of its ASCII characters
+	var zeros [2]int
+	for i, c := range data {
+		if c == 0 {
+			zeros[i%2]++
+		}
+	}
+	if half := len(data) / 2; half > 0 {
+		if zeros[1] > half*3/4 && zeros[0] == 0 {
+			return DetectedEncoding{"utf-16le", 0.8}
+		} else if zeros[0] > half*3/4 && zeros[1] == 0 {
+			return DetectedEncoding{"utf-16be", 0.8}
+		}
+	}
+
+	ascii, multibyte, invalid := 0, 0, 0
+	for i := 0; i < len(data); {
+		if data[i] < utf8.RuneSelf {
+			ascii++
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size <= 1 {
+			if !utf8.FullRune(data[i:]) {
+				// Cut off at the end of the sample
+				break
+			}
+			invalid++
+			i++
+			continue
+		}
+		multibyte++
+		i += size
+	}
+
+	switch {
+	case invalid == 0 && multibyte == 0:
+		// Plain ASCII is the same in all the encodings that micro supports
+		// except UTF-16
+		return DetectedEncoding{"utf-8", 1}
+	case invalid == 0:
+		// Text in other encodings is very unlikely to be valid UTF-8
+		return DetectedEncoding{"utf-8", 0.99}
+	}
+
+	// Any bytes are valid windows-1252, so the only hint is how much of the
+	// text is printable
+	printable := 0
+	for _, c := range data {
+		if (c >= 0x20 && c != 0x7f) || c == '\t' || c == '\n' || c == '\r' {
+			printable++
+		}
+	}
+	return DetectedEncoding{"windows-1252", 0.5 * float64(printable) / float64(len(data))}
+}
+
+// EncodingInfo returns the encoding that the start of the buffer's file was
+// detected to be in when it was opened
+// This is only a hint for the user (for example to reopen the file with
+// another encoding if the confidence is low), the file is always decoded with
+// the encoding option
+func (b *Buffer) EncodingInfo() DetectedEncoding {
+	return b.encodingInfo
+}
@@ -0,0 +1,45 @@
+package buffer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	assert.Equal(t, DetectedEncoding{"utf-8", 1}, DetectEncoding([]byte("plain ascii\n")))
+	assert.Equal(t, DetectedEncoding{"utf-8", 1}, DetectEncoding([]byte("\xef\xbb\xbfbom")))
+	assert.Equal(t, DetectedEncoding{"utf-16le", 1}, DetectEncoding([]byte("\xff\xfeh\x00")))
+	assert.Equal(t, DetectedEncoding{"utf-16le", 0.8}, DetectEncoding([]byte("h\x00i\x00!\x00")))
+	assert.Equal(t, DetectedEncoding{"utf-16be", 0.8}, DetectEncoding([]byte("\x00h\x00i\x00!")))
+
+	// A multibyte character cut off at the end is still valid
+	assert.Equal(t, DetectedEncoding{"utf-8", 0.99}, DetectEncoding([]byte("héllo wörld \xe6\x97")))
+
+	latin1 := DetectEncoding([]byte("h\xe9llo w\xf6rld"))
+	assert.Equal(t, "windows-1252", latin1.Name)
+	assert.True(t, latin1.Confidence <= 0.5)
+	binary := DetectEncoding([]byte("\x01\x02\xff\x03\x90\x04"))
+	assert.True(t, binary.Confidence < latin1.Confidence)
+}
+
+func TestEncodingInfo(t *testing.T) {
+	path := tempFile(t, "utf8.txt", strings.Repeat("日本語のテキスト\n", 1000))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	info := b.EncodingInfo()
+	assert.Equal(t, "utf-8", info.Name)
+	assert.True(t, info.Confidence > 0.9)
+	assert.Equal(t, 1000, b.LinesNum()-1)
+
+	b = NewBufferFromString("caf\xe9 cr\xe8me", "", BTDefault)
+	info = b.EncodingInfo()
+	assert.Equal(t, "windows-1252", info.Name)
+	assert.True(t, info.Confidence < 0.6)
+}
@@ -1,6 +1,7 @@
 package buffer
 
 import (
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -17,7 +18,9 @@ const (
 	// TextEventReplace represents a replace event
 	TextEventReplace = 0
 
-	undoThreshold = 500 // If two events are less than n milliseconds apart, undo both of them
+	// If two events are less than n milliseconds apart, undo both of them
+	// This is the default and can be changed with the 'undogroupwindow' option
+	undoThreshold = 500
 )
 
 // TextEvent holds data for a manipulation on some text that can be undone
@@ -34,6 +37,10 @@ type Delta struct {
 	Text  []byte
 	Start Loc
 	End   Loc
+	// The line endings of the lines of Text that end with a newline, so that
+	// undoing the removal of line breaks restores them (for preserveeol)
+	// It is nil if they are all the default line ending
+	EOLs []byte
 }
 
 // ExecuteTextEvent runs a text event
@@ -41,17 +48,25 @@ func ExecuteTextEvent(t *TextEvent, buf *SharedBuffer) {
 	if t.EventType == TextEventInsert {
 		for _, d := range t.Deltas {
 			buf.insert(d.Start, d.Text)
+			buf.setEOLs(d.Start.Y, d.EOLs)
+			buf.notifyInsert(d.Start, d.Text)
 		}
 	} else if t.EventType == TextEventRemove {
 		for i, d := range t.Deltas {
+			t.Deltas[i].EOLs = buf.lineEOLs(d.Start.Y, d.End.Y)
 			t.Deltas[i].Text = buf.remove(d.Start, d.End)
+			buf.notifyChange(d.Start, d.End, ChangeRemove)
 		}
 	} else if t.EventType == TextEventReplace {
 		for i, d := range t.Deltas {
+			t.Deltas[i].EOLs = buf.lineEOLs(d.Start.Y, d.End.Y)
 			t.Deltas[i].Text = buf.remove(d.Start, d.End)
+			buf.notifyChange(d.Start, d.End, ChangeRemove)
 			buf.insert(d.Start, d.Text)
+			buf.setEOLs(d.Start.Y, d.EOLs)
+			buf.notifyInsert(d.Start, d.Text)
 			t.Deltas[i].Start = d.Start
-			t.Deltas[i].End = Loc{d.Start.X + utf8.RuneCount(d.Text), d.Start.Y}
+			t.Deltas[i].End = d.Start.MoveLA(utf8.RuneCount(d.Text), buf.LineArray)
 		}
 		for i, j := 0, len(t.Deltas)-1; i < j; i, j = i+1, j-1 {
 			t.Deltas[i], t.Deltas[j] = t.Deltas[j], t.Deltas[i]
@@ -72,6 +87,10 @@ type EventHandler struct {
 	active    int
 	UndoStack *TEStack
 	RedoStack *TEStack
+
+	// Events that are closer together than groupWindow are undone
+	// and redone together
+	groupWindow time.Duration
 }
 
 // NewEventHandler returns a new EventHandler
@@ -81,26 +100,45 @@ func NewEventHandler(buf *SharedBuffer, cursors []*Cursor) *EventHandler {
 	eh.RedoStack = new(TEStack)
 	eh.buf = buf
 	eh.cursors = cursors
+	eh.groupWindow = undoThreshold * time.Millisecond
 	return eh
 }
 
-// ApplyDiff takes a string and runs the necessary insertion and deletion events to make
+// ApplyDiff takes a string and runs the necessary replace events to make
 // the buffer equal to that string
 // This means that we can transform the buffer into any string and still preserve undo/redo
-// through insert and delete events
+// The diff is computed line by line (using Myers' algorithm) so only the lines
+// that changed are replaced, with one event for each changed region
 func (eh *EventHandler) ApplyDiff(new string) {
+	// Line endings are normalized the same way as when the buffer is loaded
+	old := strings.Replace(string(eh.buf.Bytes()), "\r\n", "\n", -1)
+	new = strings.Replace(new, "\r\n", "\n", -1)
+
 	differ := dmp.New()
-	diff := differ.DiffMain(string(eh.buf.Bytes()), new, false)
+	oldLines, newLines, lines := differ.DiffLinesToRunes(old, new)
+	diff := differ.DiffCharsToLines(differ.DiffMainRunes(oldLines, newLines, false), lines)
+
 	loc := eh.buf.Start()
-	for _, d := range diff {
-		if d.Type == dmp.DiffDelete {
-			eh.Remove(loc, loc.MoveLA(utf8.RuneCountInString(d.Text), eh.buf.LineArray))
-		} else {
-			if d.Type == dmp.DiffInsert {
-				eh.Insert(loc, d.Text)
+	for i := 0; i < len(diff); i++ {
+		if diff[i].Type == dmp.DiffEqual {
+			loc = loc.MoveLA(utf8.RuneCountInString(diff[i].Text), eh.buf.LineArray)
+			continue
+		}
+
+		// Collect the removed and inserted lines of this changed region
+		var removed, inserted string
+		for ; i < len(diff) && diff[i].Type != dmp.DiffEqual; i++ {
+			if diff[i].Type == dmp.DiffDelete {
+				removed += diff[i].Text
+			} else {
+				inserted += diff[i].Text
 			}
-			loc = loc.MoveLA(utf8.RuneCountInString(d.Text), eh.buf.LineArray)
 		}
+		i--
+
+		end := loc.MoveLA(utf8.RuneCountInString(removed), eh.buf.LineArray)
+		eh.replace(loc, end, inserted)
+		loc = loc.MoveLA(utf8.RuneCountInString(inserted), eh.buf.LineArray)
 	}
 }
 
@@ -110,7 +148,7 @@ func (eh *EventHandler) Insert(start Loc, textStr string) {
 	e := &TextEvent{
 		C:         *eh.cursors[eh.active],
 		EventType: TextEventInsert,
-		Deltas:    []Delta{{text, start, Loc{0, 0}}},
+		Deltas:    []Delta{{text, start, Loc{0, 0}, nil}},
 		Time:      time.Now(),
 	}
 	eh.Execute(e)
@@ -140,7 +178,7 @@ func (eh *EventHandler) Remove(start, end Loc) {
 	e := &TextEvent{
 		C:         *eh.cursors[eh.active],
 		EventType: TextEventRemove,
-		Deltas:    []Delta{{[]byte{}, start, end}},
+		Deltas:    []Delta{{[]byte{}, start, end, nil}},
 		Time:      time.Now(),
 	}
 	eh.Execute(e)
@@ -163,6 +201,37 @@ func (eh *EventHandler) Remove(start, end Loc) {
 	}
 }
 
+// replace creates a replace event for a single range and executes it
+// Cursors inside the range stay where they are and cursors after it move
+// with the text
+func (eh *EventHandler) replace(start, end Loc, text string) {
+	e := &TextEvent{
+		C:         *eh.cursors[eh.active],
+		EventType: TextEventReplace,
+		Deltas:    []Delta{{[]byte(text), start, end, nil}},
+		Time:      time.Now(),
+	}
+	eh.Execute(e)
+	newEnd := e.Deltas[0].End
+
+	for _, c := range eh.cursors {
+		move := func(loc Loc) Loc {
+			if loc.LessThan(end) {
+				return loc
+			} else if loc.Y == end.Y {
+				return Loc{newEnd.X + loc.X - end.X, newEnd.Y}
+			}
+			loc.Y += newEnd.Y - end.Y
+			return loc
+		}
+		c.Loc = move(c.Loc)
+		c.CurSelection[0] = move(c.CurSelection[0])
+		c.CurSelection[1] = move(c.CurSelection[1])
+		c.OrigSelection[0] = move(c.OrigSelection[0])
+		c.OrigSelection[1] = move(c.OrigSelection[1])
+	}
+}
+
 // MultipleReplace creates an multiple insertions executes them
 func (eh *EventHandler) MultipleReplace(deltas []Delta) {
 	e := &TextEvent{
@@ -201,6 +270,20 @@ func (eh *EventHandler) Execute(t *TextEvent) {
 	ExecuteTextEvent(t, eh.buf)
 }
 
+// grouped returns whether the two events happened close enough together
+// to be undone as one
+// Events serialized by older versions have no time and are never grouped
+func (eh *EventHandler) grouped(a, b *TextEvent) bool {
+	if a.Time.IsZero() || b.Time.IsZero() {
+		return false
+	}
+	d := a.Time.Sub(b.Time)
+	if d < 0 {
+		d = -d
+	}
+	return d <= eh.groupWindow
+}
+
 // Undo the first event in the undo stack
 func (eh *EventHandler) Undo() {
 	t := eh.UndoStack.Peek()
@@ -208,7 +291,7 @@ func (eh *EventHandler) Undo() {
 		return
 	}
 
-	startTime := t.Time.UnixNano() / int64(time.Millisecond)
+	prev := t
 
 	eh.UndoOneEvent()
 
@@ -218,10 +301,22 @@ func (eh *EventHandler) Undo() {
 			return
 		}
 
-		if startTime-(t.Time.UnixNano()/int64(time.Millisecond)) > undoThreshold {
+		if !eh.grouped(prev, t) {
+			return
+		}
+		prev = t
+
+		eh.UndoOneEvent()
+	}
+}
+
+// UndoToTime undoes all the events that were executed after the given time
+func (eh *EventHandler) UndoToTime(t time.Time) {
+	for {
+		e := eh.UndoStack.Peek()
+		if e == nil || e.Time.IsZero() || !e.Time.After(t) {
 			return
 		}
-		startTime = t.Time.UnixNano() / int64(time.Millisecond)
 
 		eh.UndoOneEvent()
 	}
@@ -245,6 +340,9 @@ func (eh *EventHandler) UndoOneEvent() {
 	if teCursor.Num >= 0 && teCursor.Num < len(eh.cursors) {
 		t.C = *eh.cursors[teCursor.Num]
 		eh.cursors[teCursor.Num].Goto(teCursor)
+		// The stored cursor may point past the end of the buffer if the
+		// text changed underneath the history (for example after a reload)
+		eh.cursors[teCursor.Num].Relocate()
 	} else {
 		teCursor.Num = -1
 	}
@@ -260,7 +358,7 @@ func (eh *EventHandler) Redo() {
 		return
 	}
 
-	startTime := t.Time.UnixNano() / int64(time.Millisecond)
+	first := t
 
 	eh.RedoOneEvent()
 
@@ -270,7 +368,7 @@ func (eh *EventHandler) Redo() {
 			return
 		}
 
-		if (t.Time.UnixNano()/int64(time.Millisecond))-startTime > undoThreshold {
+		if !eh.grouped(first, t) {
 			return
 		}
 
@@ -292,6 +390,9 @@ func (eh *EventHandler) RedoOneEvent() {
 	if teCursor.Num >= 0 && teCursor.Num < len(eh.cursors) {
 		t.C = *eh.cursors[teCursor.Num]
 		eh.cursors[teCursor.Num].Goto(teCursor)
+		// The stored cursor may point past the end of the buffer if the
+		// text changed underneath the history (for example after a reload)
+		eh.cursors[teCursor.Num].Relocate()
 	} else {
 		teCursor.Num = -1
 	}
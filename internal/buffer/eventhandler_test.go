@@ -0,0 +1,87 @@
+package buffer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// insertAt inserts text into the buffer and backdates the resulting
+// event to the given time
+func insertAt(b *Buffer, loc Loc, text string, t time.Time) {
+	b.Insert(loc, text)
+	b.UndoStack.Peek().Time = t
+}
+
+func TestUndoGroupWindow(t *testing.T) {
+	b := NewBufferFromString("", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(250))
+
+	now := time.Now()
+	insertAt(b, Loc{0, 0}, "a", now)
+	insertAt(b, Loc{1, 0}, "b", now.Add(100*time.Millisecond))
+	insertAt(b, Loc{2, 0}, "c", now.Add(time.Second))
+
+	b.Undo()
+	assert.Equal(t, "ab", string(b.Bytes()))
+	b.Undo()
+	assert.Equal(t, "", string(b.Bytes()))
+	b.Redo()
+	assert.Equal(t, "ab", string(b.Bytes()))
+	b.Redo()
+	assert.Equal(t, "abc", string(b.Bytes()))
+
+	b.SetOptionNative("undogroupwindow", float64(0))
+	b.Undo()
+	b.Undo()
+	assert.Equal(t, "a", string(b.Bytes()))
+}
+
+func TestUndoToTime(t *testing.T) {
+	b := NewBufferFromString("", "", BTDefault)
+
+	now := time.Now()
+	insertAt(b, Loc{0, 0}, "a", now)
+	insertAt(b, Loc{1, 0}, "b", now.Add(time.Second))
+	insertAt(b, Loc{2, 0}, "c", now.Add(2*time.Second))
+
+	b.UndoToTime(now.Add(1500 * time.Millisecond))
+	assert.Equal(t, "ab", string(b.Bytes()))
+	b.UndoToTime(now.Add(-time.Second))
+	assert.Equal(t, "", string(b.Bytes()))
+	assert.Equal(t, 3, b.RedoStack.Len())
+}
+
+func TestUndoWithoutTime(t *testing.T) {
+	b := NewBufferFromString("", "", BTDefault)
+
+	// Events serialized before events were timestamped decode with a zero time
+	insertAt(b, Loc{0, 0}, "a", time.Time{})
+	insertAt(b, Loc{1, 0}, "b", time.Time{})
+
+	b.UndoToTime(time.Time{})
+	assert.Equal(t, "ab", string(b.Bytes()))
+	b.Undo()
+	assert.Equal(t, "a", string(b.Bytes()))
+}
+
+func TestApplyDiffChangedLine(t *testing.T) {
+	b := NewBufferFromString("one\ntwo\nthree\nfour\n", "", BTDefault)
+	b.GetActiveCursor().GotoLoc(Loc{2, 3})
+
+	b.ApplyDiff("one\n2\nthree\nfour\n")
+	assert.Equal(t, "one\n2\nthree\nfour\n", string(b.Bytes()))
+	assert.Equal(t, 1, b.UndoStack.Len())
+	e := b.UndoStack.Peek()
+	assert.Equal(t, Loc{0, 1}, e.Deltas[0].Start)
+	assert.Equal(t, Loc{2, 3}, b.GetActiveCursor().Loc)
+
+	b.ApplyDiff("zero\none\n2\nthree\nfour\n")
+	assert.Equal(t, 2, b.UndoStack.Len())
+	assert.Equal(t, Loc{2, 4}, b.GetActiveCursor().Loc)
+
+	b.UndoOneEvent()
+	b.UndoOneEvent()
+	assert.Equal(t, "one\ntwo\nthree\nfour\n", string(b.Bytes()))
+}
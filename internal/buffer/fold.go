@@ -0,0 +1,35 @@
+package buffer
+
+import (
+	"sort"
+)
+
+// A FoldRange is a range of lines (from Start to End inclusive) that is
+// collapsed
+type FoldRange struct {
+	Start, End int
+}
+
+// Folds returns the collapsed ranges of lines of the buffer, sorted by their
+// first line
+func (b *Buffer) Folds() []FoldRange {
+	return append([]FoldRange(nil), b.folds...)
+}
+
+// SetFolds sets the collapsed ranges of lines of the buffer, which are kept
+// up to date by the code that folds lines. With the savefolds option they are
+// saved with the cursor and undo history of the file
+// Ranges that don't span at least two lines of the buffer are dropped
+func (b *Buffer) SetFolds(folds []FoldRange) {
+	b.folds = nil
+	for _, f := range folds {
+		// The end of the file may not be loaded yet
+		inBuffer := f.End < b.LinesNum() || b.loader != nil
+		if f.Start >= 0 && f.Start < f.End && inBuffer {
+			b.folds = append(b.folds, f)
+		}
+	}
+	sort.Slice(b.folds, func(i, j int) bool {
+		return b.folds[i].Start < b.folds[j].Start
+	})
+}
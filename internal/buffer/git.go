@@ -0,0 +1,73 @@
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// gitCommand is the command that is run to read files from git
+var gitCommand = "git"
+
+// runGit runs git in the given directory and returns its output
+// If git fails, the error contains what git printed to stderr
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command(gitCommand, append([]string{"-C", dir}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// NewBufferFromGit opens a new buffer with the contents of the file at path
+// in the given git revision (for example HEAD)
+// The buffer is named path@rev and is readonly and cannot be saved, so that it
+// can't replace the working copy of the file by accident
+func NewBufferFromGit(path, rev string) (*Buffer, error) {
+	filename, err := util.ReplaceHome(path)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := runGit(filepath.Dir(absPath), "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, errors.New(path + " is not in a git repository: " + err.Error())
+	}
+	root := strings.TrimSpace(string(out))
+	if resolved, err := filepath.EvalSymlinks(filepath.Dir(absPath)); err == nil {
+		absPath = filepath.Join(resolved, filepath.Base(absPath))
+	}
+	rel, err := filepath.Rel(root, absPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, errors.New(path + " is not in the git repository at " + root)
+	}
+
+	data, err := runGit(root, "show", rev+":"+filepath.ToSlash(rel))
+	if err != nil {
+		return nil, errors.New("Cannot read " + path + " at revision " + rev + ": " + err.Error())
+	}
+
+	// The buffer must not have the path of the file, or it would share its
+	// text with (and write history for) the working copy. The path is only
+	// used to detect the filetype
+	b := NewBuffer(bytes.NewReader(data), int64(len(data)), "", Loc{0, 0}, BufType{BTDefault.Kind, true, true, true})
+	b.Path = filename
+	b.redetectFiletype()
+	b.Path = ""
+	b.SetName(path + "@" + rev)
+	return b, nil
+}
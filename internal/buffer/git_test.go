@@ -0,0 +1,61 @@
+package buffer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockGit replaces git with a script that pretends dir is a repository in
+// which HEAD:file.go contains "package main"
+func mockGit(t *testing.T, dir string) func() {
+	script := `#!/bin/sh
+case "$3" in
+rev-parse)
+	if [ "$2" = "` + dir + `" ]; then echo "` + dir + `"; exit 0; fi
+	echo "fatal: not a git repository" >&2; exit 128;;
+show)
+	if [ "$4" = "HEAD:file.go" ]; then printf 'package main\n'; exit 0; fi
+	echo "fatal: invalid object name" >&2; exit 128;;
+esac
+exit 1
+`
+	mock := filepath.Join(dir, "mockgit")
+	assert.Nil(t, ioutil.WriteFile(mock, []byte(script), 0755))
+
+	old := gitCommand
+	gitCommand = mock
+	return func() { gitCommand = old }
+}
+
+func TestNewBufferFromGit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the mock git command is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	defer mockGit(t, dir)()
+
+	path := filepath.Join(dir, "file.go")
+	b, err := NewBufferFromGit(path, "HEAD")
+	assert.Nil(t, err)
+	assert.Equal(t, "package main\n", string(b.Bytes()))
+	assert.Equal(t, path+"@HEAD", b.GetName())
+	assert.True(t, b.Type.Readonly)
+	assert.True(t, b.Type.Scratch)
+	assert.NotNil(t, b.Save())
+	b.Close()
+
+	_, err = NewBufferFromGit(path, "missing")
+	assert.NotNil(t, err)
+
+	_, err = NewBufferFromGit(filepath.Join(os.TempDir(), "elsewhere", "file.go"), "HEAD")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,192 @@
+package buffer
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// RehighlightFrom makes sure that the highlight states are up to date up to
+// the given line
+// Any lines that were edited since the states were last computed are
+// rehighlighted, and the scan stops at the first line after them whose state
+// did not change instead of continuing to the end of the buffer
+func (b *Buffer) RehighlightFrom(line int) {
+	if b.Highlighter == nil || !b.Settings["syntax"].(bool) || b.hlSuspended > 0 {
+		return
+	}
+
+	b.highlightStatesTo(util.Clamp(line, 0, b.LinesNum()-1))
+}
+
+// EnsureHighlighted computes the highlighting of the lines from startLine up
+// to (but not including) endLine
+// The state at the start of every line that has been highlighted is kept, so
+// only the lines between the last computed state and endLine need to be
+// scanned, and edits only invalidate the states after them until the
+// rehighlighted states match the old ones again
+func (b *Buffer) EnsureHighlighted(startLine, endLine int) {
+	if b.Highlighter == nil || !b.Settings["syntax"].(bool) || b.hlSuspended > 0 {
+		return
+	}
+
+	startLine = util.Clamp(startLine, 0, b.LinesNum())
+	endLine = util.Clamp(endLine, startLine, b.LinesNum())
+	if startLine == endLine {
+		return
+	}
+
+	b.highlightStatesTo(endLine - 1)
+	b.Highlighter.HighlightMatches(b, startLine, endLine)
+}
+
+// SuspendHighlight stops the buffer from being rehighlighted until
+// ResumeHighlight is called, so that a batch of edits doesn't pay for
+// highlighting after every edit. Calls can be nested, and every call must be
+// paired with a call to ResumeHighlight, preferably with defer:
+//
+//	b.SuspendHighlight()
+//	defer b.ResumeHighlight()
+func (b *Buffer) SuspendHighlight() {
+	b.hlSuspended++
+}
+
+// ResumeHighlight undoes a call to SuspendHighlight. When the last suspension
+// is resumed, the lines that were edited in the meantime are rehighlighted
+func (b *Buffer) ResumeHighlight() {
+	if b.hlSuspended == 0 {
+		return
+	}
+	b.hlSuspended--
+	if b.hlSuspended == 0 {
+		b.RehighlightFrom(0)
+	}
+}
+
+// IsLargeInsert returns whether text has more bytes than the
+// largeinsertthreshold option, in which case a frontend may want to warn
+// before inserting it
+func (b *Buffer) IsLargeInsert(text string) bool {
+	threshold := util.IntOpt(b.Settings["largeinsertthreshold"])
+	return threshold >= 0 && len(text) > threshold
+}
+
+// InsertChecked inserts text like Insert, but suspends highlighting during the
+// insert if it is large (see IsLargeInsert), and returns whether it did
+func (b *Buffer) InsertChecked(loc Loc, text string) (suspendedHighlight bool) {
+	if !b.IsLargeInsert(text) {
+		b.Insert(loc, text)
+		return false
+	}
+
+	b.SuspendHighlight()
+	defer b.ResumeHighlight()
+	b.Insert(loc, text)
+	return true
+}
+
+// highlightStatesTo updates the highlight states of all the lines up to and
+// including the given line
+func (b *Buffer) highlightStatesTo(line int) {
+	if b.hlDirty {
+		b.hlDirty = false
+		// Lines that were never highlighted don't need to be fixed
+		if b.hlStart < b.hlValid {
+			start := util.Clamp(b.hlStart, 0, b.LinesNum()-1)
+			end := util.Clamp(b.hlEnd, start, b.LinesNum()-1)
+			last := b.Highlighter.ReHighlightStatesUntil(b, start, end, util.Max(end, b.hlValid-1))
+			b.hlValid = util.Max(b.hlValid, last+1)
+		}
+	}
+
+	if b.hlValid <= line {
+		b.hlValid = b.Highlighter.ReHighlightStatesUntil(b, b.hlValid, line, line) + 1
+	}
+}
+
+// Rehighlight returns whether the highlight state of line lineN has to be
+// computed again
+//
+// Deprecated: edited lines are rehighlighted automatically when they are
+// needed, see RehighlightFrom and EnsureHighlighted
+func (b *SharedBuffer) Rehighlight(lineN int) bool {
+	return lineN >= b.hlValid || (b.hlDirty && lineN >= b.hlStart && lineN <= b.hlEnd)
+}
+
+// SetRehighlight marks line lineN as edited if on is true, so that its
+// highlight state is computed again
+//
+// Deprecated: edited lines are rehighlighted automatically when they are
+// needed, see RehighlightFrom and EnsureHighlighted
+func (b *SharedBuffer) SetRehighlight(lineN int, on bool) {
+	if on {
+		b.markEdited(lineN, lineN, 0)
+	}
+}
+
+// A HighlightSpan is a range of runes in a line that are highlighted
+// with the same syntax group
+type HighlightSpan struct {
+	Start, End int
+	Group      string
+}
+
+// HighlightLine returns the highlighted spans of line n, computing the
+// highlighting of the line if necessary
+// If the buffer is not highlighted (or highlighting is suspended) the whole
+// line is a single span with the "default" group
+func (b *Buffer) HighlightLine(n int) []HighlightSpan {
+	lineLen := utf8.RuneCount(b.LineBytes(n))
+	if b.Highlighter == nil || !b.Settings["syntax"].(bool) || b.hlSuspended > 0 || n < 0 || n >= b.LinesNum() {
+		return []HighlightSpan{{0, lineLen, "default"}}
+	}
+
+	b.RehighlightFrom(n)
+	b.Highlighter.HighlightMatches(b, n, n+1)
+	match := b.Match(n)
+
+	starts := make([]int, 0, len(match))
+	for i := range match {
+		if i < lineLen {
+			starts = append(starts, i)
+		}
+	}
+	sort.Ints(starts)
+	if len(starts) == 0 || starts[0] != 0 {
+		starts = append([]int{0}, starts...)
+	}
+
+	var spans []HighlightSpan
+	for i, start := range starts {
+		end := lineLen
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		group := "default"
+		if g, ok := match[start]; ok && g != 0 {
+			group = g.String()
+		}
+
+		if len(spans) > 0 && spans[len(spans)-1].Group == group {
+			spans[len(spans)-1].End = end
+		} else {
+			spans = append(spans, HighlightSpan{start, end, group})
+		}
+	}
+	return spans
+}
+
+// SyntaxContextAt returns the syntax group (such as "comment" or
+// "constant.string") that the rune at loc is highlighted with, or "default"
+// if the buffer is not highlighted
+// At the end of a line it returns the group of the last rune of the line
+func (b *Buffer) SyntaxContextAt(loc Loc) string {
+	spans := b.HighlightLine(loc.Y)
+	for _, s := range spans {
+		if loc.X >= s.Start && loc.X < s.End {
+			return s.Group
+		}
+	}
+	return spans[len(spans)-1].Group
+}
@@ -0,0 +1,382 @@
+package buffer
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zyedidia/micro/internal/config"
+	"github.com/zyedidia/micro/pkg/highlight"
+)
+
+const testSyntax = `filetype: test
+
+detect:
+    filename: "\\.test$"
+
+rules:
+    - statement: "\\b(if|else|return)\\b"
+    - constant.string:
+        start: "\""
+        end: "\""
+        rules: []
+    - comment:
+        start: "/\\*"
+        end: "\\*/"
+        rules: []
+`
+
+var testDef *highlight.Def
+
+func init() {
+	header, _ := highlight.MakeHeaderYaml([]byte(testSyntax))
+	file, _ := highlight.ParseFile([]byte(testSyntax))
+	testDef, _ = highlight.ParseDef(file, header)
+}
+
+// newLazyBuffer creates a buffer using the test syntax without computing
+// any of its highlighting
+func newLazyBuffer(text string) *Buffer {
+	b := NewBufferFromString(text, "", BTDefault)
+	b.SyntaxDef = testDef
+	b.Highlighter = highlight.NewHighlighter(testDef)
+	return b
+}
+
+// newHighlightedBuffer creates a buffer highlighted with the test syntax
+func newHighlightedBuffer(text string) *Buffer {
+	b := newLazyBuffer(text)
+	b.RehighlightFrom(b.LinesNum() - 1)
+	return b
+}
+
+// assertStates checks that the highlight states of the buffer are the same
+// as the states of a freshly highlighted buffer with the same text
+func assertStates(t *testing.T, b *Buffer) {
+	fresh := newHighlightedBuffer(string(b.Bytes()))
+	assert.Equal(t, fresh.LinesNum(), b.LinesNum())
+	for i := 0; i < b.LinesNum(); i++ {
+		if !assert.Equal(t, fresh.State(i), b.State(i), "line", i) {
+			return
+		}
+	}
+}
+
+func TestRehighlightFrom(t *testing.T) {
+	b := newHighlightedBuffer(strings.Repeat("if x { return \"a\" }\n", 200))
+
+	b.Insert(Loc{0, 100}, "/* ")
+	b.RehighlightFrom(0)
+	assertStates(t, b)
+
+	b.Insert(Loc{0, 150}, "*/\n\"\n")
+	b.RehighlightFrom(150)
+	assertStates(t, b)
+
+	b.Remove(Loc{0, 100}, Loc{0, 152})
+	b.RehighlightFrom(100)
+	assertStates(t, b)
+}
+
+func TestSetRehighlight(t *testing.T) {
+	b := newHighlightedBuffer("/* a\nb\nc */\nif\n")
+	assert.False(t, b.Rehighlight(1))
+	assert.True(t, b.Rehighlight(b.LinesNum()))
+
+	b.SetRehighlight(1, false)
+	assert.False(t, b.Rehighlight(1))
+	b.SetRehighlight(1, true)
+	assert.True(t, b.Rehighlight(1))
+	assert.False(t, b.Rehighlight(2))
+	b.RehighlightFrom(1)
+	assert.False(t, b.Rehighlight(1))
+	assertStates(t, b)
+}
+
+func BenchmarkRehighlightFrom(b *testing.B) {
+	buf := newHighlightedBuffer(strings.Repeat("if x { return \"a\" } /* comment */\n", 100000))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Insert(Loc{0, 90000}, "x")
+		buf.RehighlightFrom(90000)
+		buf.Remove(Loc{0, 90000}, Loc{1, 90000})
+		buf.RehighlightFrom(90000)
+	}
+}
+
+func TestEnsureHighlighted(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := newLazyBuffer(strings.Repeat("if x { return \"a\" } /* c */\n", 2000))
+	edits := []string{"/* ", "*/", "\"", "\n", "if "}
+
+	for i := 0; i < 200; i++ {
+		if r.Intn(3) == 0 {
+			y := r.Intn(b.LinesNum())
+			b.Insert(Loc{0, y}, edits[r.Intn(len(edits))])
+		} else if r.Intn(2) == 0 && b.LinesNum() > 2 {
+			y := r.Intn(b.LinesNum() - 1)
+			b.Remove(Loc{0, y}, Loc{0, y + 1})
+		}
+
+		start := r.Intn(b.LinesNum())
+		end := start + 40
+		b.EnsureHighlighted(start, end)
+
+		fresh := newHighlightedBuffer(string(b.Bytes()))
+		fresh.EnsureHighlighted(start, end)
+		for y := 0; y < end && y < b.LinesNum(); y++ {
+			if !assert.Equal(t, fresh.State(y), b.State(y), "state of line", y) {
+				return
+			}
+		}
+		for y := start; y < end && y < b.LinesNum(); y++ {
+			if !assert.Equal(t, fresh.Match(y), b.Match(y), "match of line", y) {
+				return
+			}
+		}
+	}
+}
+
+func BenchmarkEnsureHighlighted(b *testing.B) {
+	buf := newLazyBuffer(strings.Repeat("if x { return \"a\" } /* comment */\n", 100000))
+	r := rand.New(rand.NewSource(1))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := r.Intn(buf.LinesNum())
+		buf.EnsureHighlighted(start, start+50)
+	}
+}
+
+func TestSuspendHighlight(t *testing.T) {
+	b := newHighlightedBuffer(strings.Repeat("if x { return \"a\" }\n", 100))
+
+	b.SuspendHighlight()
+	b.SuspendHighlight()
+	b.Insert(Loc{0, 10}, "/* ")
+	b.EnsureHighlighted(0, b.LinesNum())
+	assert.Equal(t, b.State(9), b.State(10))
+
+	b.ResumeHighlight()
+	b.EnsureHighlighted(0, b.LinesNum())
+	assert.Equal(t, b.State(9), b.State(10))
+
+	b.ResumeHighlight()
+	assertStates(t, b)
+
+	// Extra resumes are ignored
+	b.ResumeHighlight()
+	b.Insert(Loc{0, 20}, "*/")
+	b.RehighlightFrom(20)
+	assertStates(t, b)
+}
+
+func TestInsertChecked(t *testing.T) {
+	b := newHighlightedBuffer(strings.Repeat("if x { return \"a\" }\n", 100))
+	b.SetOptionNative("largeinsertthreshold", float64(10))
+
+	assert.False(t, b.InsertChecked(Loc{0, 10}, "/* "))
+	assert.True(t, b.InsertChecked(Loc{0, 20}, "*/ /* long comment"))
+	assert.Equal(t, 0, b.hlSuspended)
+	assertStates(t, b)
+
+	b.SetOptionNative("largeinsertthreshold", float64(-1))
+	assert.False(t, b.InsertChecked(Loc{0, 30}, strings.Repeat("*/", 100)))
+	b.RehighlightFrom(b.LinesNum() - 1)
+	assertStates(t, b)
+}
+
+func BenchmarkInsertLarge(b *testing.B) {
+	text := strings.Repeat("\" x { return \"a\" } /* comment */\n", 5000)
+	paste := strings.Repeat("if x { return \"b\" }\n", 20000)
+
+	for _, threshold := range []float64{-1, 0} {
+		name := "highlighted"
+		if threshold == 0 {
+			name = "suspended"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				buf := newHighlightedBuffer(text)
+				buf.SetOptionNative("largeinsertthreshold", threshold)
+				buf.EnsureHighlighted(0, buf.LinesNum())
+				buf.InsertChecked(Loc{0, 10}, paste)
+				buf.EnsureHighlighted(0, 50)
+			}
+		})
+	}
+}
+
+// replaceEveryLine replaces the first character of every line, redrawing the
+// lines around each edit like the screen would between edits
+func replaceEveryLine(b *Buffer) {
+	for y := 0; y < b.LinesNum(); y++ {
+		b.Replace(Loc{0, y}, Loc{1, y}, "\"")
+		b.EnsureHighlighted(y, y+50)
+	}
+}
+
+func BenchmarkReplaceEveryLine(b *testing.B) {
+	text := strings.Repeat("\" x { return \"a\" } /* comment */\n", 5000)
+
+	b.Run("highlighted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buf := newHighlightedBuffer(text)
+			replaceEveryLine(buf)
+		}
+	})
+	b.Run("suspended", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buf := newHighlightedBuffer(text)
+			buf.SuspendHighlight()
+			replaceEveryLine(buf)
+			buf.ResumeHighlight()
+		}
+	})
+}
+
+func TestHighlightLine(t *testing.T) {
+	b := newHighlightedBuffer("if x \"str\" /* com\nment */ return\n")
+
+	assert.Equal(t, []HighlightSpan{
+		{0, 2, "statement"},
+		{2, 5, "default"},
+		{5, 10, "constant.string"},
+		{10, 11, "default"},
+		{11, 17, "comment"},
+	}, b.HighlightLine(0))
+	assert.Equal(t, []HighlightSpan{
+		{0, 7, "comment"},
+		{7, 8, "default"},
+		{8, 14, "statement"},
+	}, b.HighlightLine(1))
+
+	plain := NewBufferFromString("if x", "", BTDefault)
+	assert.Equal(t, []HighlightSpan{{0, 4, "default"}}, plain.HighlightLine(0))
+}
+
+func TestFileTypeCandidates(t *testing.T) {
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftext.yaml", `filetype: ftext
+
+detect:
+    filename: "\\.ftd$"
+
+rules:
+    - statement: "\\bif\\b"
+`)
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "fthdr.yaml", `filetype: fthdr
+
+detect:
+    header: "^#!.*fthdr"
+
+rules:
+    - statement: "\\bwhile\\b"
+`)
+
+	b := NewBufferFromString("#!/usr/bin/fthdr\nwhile\n", "script.ftd", BTDefault)
+	assert.Equal(t, "fthdr", b.Settings["filetype"])
+	assert.Equal(t, []string{"fthdr", "ftext"}, b.FileTypeCandidates())
+
+	b = NewBufferFromString("if\n", "plain.ftd", BTDefault)
+	assert.Equal(t, "ftext", b.Settings["filetype"])
+	assert.Equal(t, []string{"ftext"}, b.FileTypeCandidates())
+
+	// Setting the filetype overrides detection
+	b = NewBufferFromString("#!/usr/bin/fthdr\n", "script.ftd", BTDefault)
+	b.SetOptionNative("filetype", "ftext")
+	assert.Equal(t, "ftext", b.SyntaxDef.FileType)
+}
+
+func TestFileTypeOverrides(t *testing.T) {
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftoverride.yaml", `filetype: ftoverride
+
+detect:
+    filename: "\\.fto$"
+
+rules:
+    - statement: "\\bif\\b"
+`)
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftother.yaml", `filetype: ftother
+
+rules:
+    - statement: "\\bwhile\\b"
+`)
+	defer func() {
+		config.GlobalSettings["filetypeoverrides"] = map[string]interface{}{}
+	}()
+
+	config.GlobalSettings["filetypeoverrides"] = map[string]interface{}{
+		".fto":       "ftother",
+		"nosyn.*":    "missing",
+		"*/sub/*.tp": "ftother",
+	}
+
+	b := NewBufferFromString("if\n", "file.fto", BTDefault)
+	assert.Equal(t, "ftother", b.Settings["filetype"])
+
+	b = NewBufferFromString("if\n", "dir/sub/file.tp", BTDefault)
+	assert.Equal(t, "ftother", b.Settings["filetype"])
+
+	// An override without a syntax file leaves the buffer as plain text
+	b = NewBufferFromString("if\n", "nosyn.txt", BTDefault)
+	assert.Nil(t, b.SyntaxDef)
+	assert.Nil(t, b.Highlighter)
+
+	config.GlobalSettings["filetypeoverrides"] = map[string]interface{}{}
+	b = NewBufferFromString("if\n", "file.fto", BTDefault)
+	assert.Equal(t, "ftoverride", b.Settings["filetype"])
+}
+
+func TestSyntaxLoadErrorsReportedOnce(t *testing.T) {
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftbroken.yaml", "filetype: [broken\n")
+
+	countErrors := func() int {
+		n := 0
+		for _, err := range config.SyntaxLoadErrors() {
+			if strings.Contains(err.Error(), "ftbroken") {
+				n++
+			}
+		}
+		return n
+	}
+
+	b := NewBufferFromString("", "a.txt", BTDefault)
+	assert.Equal(t, 1, countErrors())
+
+	b.UpdateRules()
+	NewBufferFromString("", "b.txt", BTDefault)
+	assert.Equal(t, 1, countErrors())
+}
+
+func TestSyntaxContextAt(t *testing.T) {
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftcontext.yaml", `filetype: ftcontext
+
+detect:
+    filename: "\\.ftc$"
+
+rules:
+    - statement: "\\bif\\b"
+    - constant.string:
+        start: "\""
+        end: "\""
+        rules: []
+    - comment:
+        start: "/\\*"
+        end: "\\*/"
+        rules: []
+`)
+
+	b := NewBufferFromString("if x = \"str\" /* multi\nline */ y", "context.ftc", BTDefault)
+	assert.Equal(t, "statement", b.SyntaxContextAt(Loc{0, 0}))
+	assert.Equal(t, "default", b.SyntaxContextAt(Loc{3, 0}))
+	assert.Equal(t, "constant.string", b.SyntaxContextAt(Loc{8, 0}))
+	assert.Equal(t, "comment", b.SyntaxContextAt(Loc{17, 0}))
+	assert.Equal(t, "comment", b.SyntaxContextAt(Loc{22, 0}))
+	assert.Equal(t, "comment", b.SyntaxContextAt(Loc{2, 1}))
+	assert.Equal(t, "default", b.SyntaxContextAt(Loc{8, 1}))
+
+	plain := NewBufferFromString("if x", "", BTDefault)
+	assert.Equal(t, "default", plain.SyntaxContextAt(Loc{0, 0}))
+}
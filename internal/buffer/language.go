@@ -0,0 +1,137 @@
+package buffer
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// languageNames maps the names of files that usually have no extension to
+// their filetype
+var languageNames = map[string]string{
+	"makefile":       "makefile",
+	"gnumakefile":    "makefile",
+	"dockerfile":     "dockerfile",
+	"containerfile":  "dockerfile",
+	"cmakelists.txt": "cmake",
+	"gemfile":        "ruby",
+	"rakefile":       "ruby",
+	"vagrantfile":    "ruby",
+	"podfile":        "ruby",
+	"pkgbuild":       "shell",
+	"apkbuild":       "shell",
+	".bashrc":        "shell",
+	".profile":       "shell",
+	".zshrc":         "zsh",
+	"go.mod":         "go",
+}
+
+// languageInterpreters maps the interpreters of shebang lines (without any
+// version number) to their filetype
+var languageInterpreters = map[string]string{
+	"sh":      "shell",
+	"bash":    "shell",
+	"dash":    "shell",
+	"ash":     "shell",
+	"ksh":     "shell",
+	"zsh":     "zsh",
+	"fish":    "fish",
+	"python":  "python",
+	"ruby":    "ruby",
+	"perl":    "perl",
+	"node":    "javascript",
+	"nodejs":  "javascript",
+	"deno":    "typescript",
+	"lua":     "lua",
+	"luajit":  "lua",
+	"php":     "php",
+	"tclsh":   "tcl",
+	"wish":    "tcl",
+	"awk":     "awk",
+	"gawk":    "awk",
+	"sed":     "sed",
+	"make":    "makefile",
+	"Rscript": "r",
+	"julia":   "julia",
+	"crystal": "crystal",
+	"elixir":  "elixir",
+}
+
+// languageKeywords are words that are typical for a filetype, which are
+// counted to guess the filetype of a file that can't be detected otherwise
+var languageKeywords = map[string][]string{
+	"shell":      {"fi", "then", "elif", "esac", "done", "echo", "export", "local"},
+	"python":     {"def", "import", "elif", "self", "None", "True", "False", "lambda"},
+	"ruby":       {"def", "end", "require", "elsif", "unless", "puts", "nil", "attr_accessor"},
+	"javascript": {"function", "const", "let", "var", "require", "undefined", "=>", "console"},
+	"go":         {"func", "package", "import", "defer", "chan", "struct", ":=", "nil"},
+	"c":          {"#include", "int", "void", "struct", "return", "sizeof", "NULL", "#define"},
+	"lua":        {"local", "function", "end", "then", "elseif", "nil", "require", "~="},
+	"perl":       {"my", "sub", "use", "elsif", "foreach", "unless", "print", "strict;"},
+	"dockerfile": {"FROM", "RUN", "COPY", "CMD", "ENTRYPOINT", "WORKDIR", "EXPOSE", "ENV"},
+	"makefile":   {".PHONY:", "$(MAKE)", "$@", "$<", "all:", "clean:", "ifeq", "endif"},
+}
+
+// languageGuessLines is the number of lines that are looked at to guess the
+// filetype from the content of a file
+const languageGuessLines = 200
+
+// minLanguageScore is the number of keywords of a filetype that a file must
+// contain for its content to count as that filetype
+const minLanguageScore = 3
+
+var shebang = regexp.MustCompile(`^#!\s*(\S+)(?:\s+(\S+))?`)
+var versionSuffix = regexp.MustCompile(`[0-9.]+$`)
+
+// GuessLanguage guesses the filetype of a buffer whose filetype couldn't be
+// detected from its syntax files, from the name of the file, its shebang line
+// and the keywords in its content
+// It returns "unknown" if there is no good guess, and the current filetype if
+// it is known
+func (b *Buffer) GuessLanguage() string {
+	if ft := b.Settings["filetype"].(string); ft != "unknown" && ft != "" {
+		return ft
+	}
+
+	if ft, ok := languageNames[strings.ToLower(filepath.Base(b.Path))]; ok && b.Path != "" {
+		return ft
+	}
+
+	if m := shebang.FindSubmatch(b.LineBytes(0)); m != nil {
+		interp := filepath.Base(string(m[1]))
+		if interp == "env" && len(m[2]) > 0 {
+			interp = string(m[2])
+		}
+		if ft, ok := languageInterpreters[versionSuffix.ReplaceAllString(interp, "")]; ok {
+			return ft
+		}
+	}
+
+	scores := make(map[string]int)
+	for i := 0; i < b.LinesNum() && i < languageGuessLines; i++ {
+		for _, word := range bytes.Fields(b.LineBytes(i)) {
+			for ft, keywords := range languageKeywords {
+				for _, k := range keywords {
+					if string(word) == k {
+						scores[ft]++
+					}
+				}
+			}
+		}
+	}
+
+	// Only a clear winner is a good guess
+	best, bestScore, secondScore := "unknown", 0, 0
+	for ft, score := range scores {
+		if score > bestScore {
+			best, bestScore, secondScore = ft, score, bestScore
+		} else if score > secondScore {
+			secondScore = score
+		}
+	}
+	if bestScore < minLanguageScore || bestScore < 2*secondScore {
+		return "unknown"
+	}
+	return best
+}
@@ -0,0 +1,51 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zyedidia/micro/internal/config"
+)
+
+func TestGuessLanguage(t *testing.T) {
+	b := NewBufferFromString("#!/usr/bin/env python3\nprint('hi')\n", "script", BTDefault)
+	assert.Equal(t, "python", b.GuessLanguage())
+
+	b = NewBufferFromString("#!/bin/bash\necho hi\n", "run", BTDefault)
+	assert.Equal(t, "shell", b.GuessLanguage())
+
+	b = NewBufferFromString("FROM alpine\nRUN true\n", "/src/Dockerfile", BTDefault)
+	assert.Equal(t, "dockerfile", b.GuessLanguage())
+
+	b = NewBufferFromString("if x; then\n\techo a\nelif y; then\n\texport B\nfi\n", "ci-step", BTDefault)
+	assert.Equal(t, "shell", b.GuessLanguage())
+
+	// Too few keywords, or keywords of several languages
+	b = NewBufferFromString("some notes\nthen more\n", "notes", BTDefault)
+	assert.Equal(t, "unknown", b.GuessLanguage())
+	b = NewBufferFromString("def end nil\nlocal function then\n", "mixed", BTDefault)
+	assert.Equal(t, "unknown", b.GuessLanguage())
+
+	// Only files whose filetype is unknown are guessed
+	b = NewBufferFromString("#!/bin/sh\n", "run", BTDefault)
+	b.Settings["filetype"] = "lua"
+	assert.Equal(t, "lua", b.GuessLanguage())
+}
+
+func TestGuessLanguageHighlights(t *testing.T) {
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftguess.yaml", `filetype: dockerfile
+
+detect:
+    filename: "\\.ftguess$"
+
+rules:
+    - statement: "^FROM"
+`)
+
+	b := NewBufferFromString("FROM alpine\n", "Containerfile", BTDefault)
+	assert.Equal(t, "dockerfile", b.Settings["filetype"])
+	assert.NotNil(t, b.SyntaxDef)
+
+	b = NewBufferFromString("#!/usr/bin/env nodejs\n", "tool", BTDefault)
+	assert.Equal(t, "unknown", b.Settings["filetype"])
+}
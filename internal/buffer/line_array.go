@@ -35,11 +35,26 @@ func runeToByteIndex(n int, txt []byte) int {
 type Line struct {
 	data []byte
 
-	state       highlight.State
-	match       highlight.LineMatch
-	rehighlight bool
+	state highlight.State
+	match highlight.LineMatch
+
+	// The number of runes in data, which is counted when it is first needed
+	// after the line has changed
+	runes      int
+	runesValid bool
+
+	// The line ending after the line in the file, which is written again
+	// when the preserveeol option is on
+	eol byte
 }
 
+// The line endings that a line can have in the file
+const (
+	eolDefault = iota // The line ending of the fileformat
+	eolLF
+	eolCRLF
+)
+
 const (
 	// Line ending file formats
 	FFAuto = 0 // Autodetect format
@@ -57,6 +72,24 @@ type LineArray struct {
 	initsize uint64
 }
 
+// clone returns a deep copy of the line array
+// The highlight states are kept but the matches are recomputed when needed
+func (la *LineArray) clone() *LineArray {
+	c := &LineArray{
+		lines:    make([]Line, len(la.lines)),
+		Endings:  la.Endings,
+		initsize: la.initsize,
+	}
+	for i, l := range la.lines {
+		c.lines[i] = Line{
+			data:  append([]byte(nil), l.data...),
+			state: l.state,
+			eol:   l.eol,
+		}
+	}
+	return c
+}
+
 // Append efficiently appends lines together
 // It allocates an additional 10000 lines if the original estimate
 // is incorrect
@@ -81,27 +114,40 @@ func NewLineArray(size uint64, endings FileFormat, reader io.Reader) *LineArray
 	la.lines = make([]Line, 0, 1000)
 	la.initsize = size
 
-	br := bufio.NewReader(reader)
+	la.readLines(bufio.NewReader(reader), endings, -1)
+	return la
+}
+
+// readLines reads lines from br and appends them to the line array, and
+// returns whether it has read all of br
+// It stops after max lines that end with a newline unless max is negative,
+// in which case it reads everything
+func (la *LineArray) readLines(br *bufio.Reader, endings FileFormat, max int) bool {
 	var loaded int
 
 	n := 0
-	for {
+	for n != max {
 		data, err := br.ReadBytes('\n')
 		// Detect the line ending by checking to see if there is a '\r' char
 		// before the '\n'
 		// Even if the file format is set to DOS, the '\r' is removed so
 		// that all lines end with '\n'
+		// The last line has no line ending, so it can't tell the format of
+		// the file
 		dlen := len(data)
-		if dlen > 1 && data[dlen-2] == '\r' {
+		eol := byte(eolDefault)
+		if dlen > 1 && data[dlen-1] == '\n' && data[dlen-2] == '\r' {
 			data = append(data[:dlen-2], '\n')
 			if endings == FFAuto {
 				la.Endings = FFDos
 			}
 			dlen = len(data)
-		} else if dlen > 0 {
+			eol = eolCRLF
+		} else if dlen > 0 && data[dlen-1] == '\n' {
 			if endings == FFAuto {
 				la.Endings = FFUnix
 			}
+			eol = eolLF
 		}
 
 		// If we are loading a large file (greater than 1000) we use the file
@@ -110,7 +156,7 @@ func NewLineArray(size uint64, endings FileFormat, reader io.Reader) *LineArray
 		// We add an extra 10000 to the original estimate to be safe and give
 		// plenty of room for expansion
 		if n >= 1000 && loaded >= 0 {
-			totalLinesNum := int(float64(size) * (float64(n) / float64(loaded)))
+			totalLinesNum := int(float64(la.initsize) * (float64(n) / float64(loaded)))
 			newSlice := make([]Line, len(la.lines), totalLinesNum+10000)
 			copy(newSlice, la.lines)
 			la.lines = newSlice
@@ -124,17 +170,15 @@ func NewLineArray(size uint64, endings FileFormat, reader io.Reader) *LineArray
 
 		if err != nil {
 			if err == io.EOF {
-				la.lines = Append(la.lines, Line{data[:], nil, nil, false})
+				la.lines = Append(la.lines, Line{data: data[:]})
 			}
 			// Last line was read
-			break
-		} else {
-			la.lines = Append(la.lines, Line{data[:dlen-1], nil, nil, false})
+			return true
 		}
+		la.lines = Append(la.lines, Line{data: data[:dlen-1], eol: eol})
 		n++
 	}
-
-	return la
+	return false
 }
 
 // Bytes returns the string that should be written to disk when
@@ -153,11 +197,63 @@ func (la *LineArray) Bytes() []byte {
 	return str
 }
 
+// A lineReader reads the lines of a LineArray one after the other
+type lineReader struct {
+	lines []Line
+	eol   []byte
+	// The rest of the current line and its line ending
+	cur     []byte
+	eolLeft []byte
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.cur) > 0 {
+			k := copy(p[n:], r.cur)
+			r.cur = r.cur[k:]
+			n += k
+		} else if len(r.eolLeft) > 0 {
+			k := copy(p[n:], r.eolLeft)
+			r.eolLeft = r.eolLeft[k:]
+			n += k
+		} else if len(r.lines) > 0 {
+			r.cur = r.lines[0].data
+			r.lines = r.lines[1:]
+			if len(r.lines) > 0 {
+				r.eolLeft = r.eol
+			}
+		} else {
+			break
+		}
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Reader returns a reader of the same text as Bytes, which is read line by
+// line instead of being copied all at once
+// It reads the lines that the LineArray has when Reader is called, but their
+// text is not copied, so the LineArray must not be edited while the reader is
+// in use
+func (la *LineArray) Reader() io.Reader {
+	eol := []byte{'\n'}
+	if la.Endings == FFDos {
+		eol = []byte{'\r', '\n'}
+	}
+	return &lineReader{
+		lines: append([]Line(nil), la.lines...),
+		eol:   eol,
+	}
+}
+
 // newlineBelow adds a newline below the given line number
 func (la *LineArray) newlineBelow(y int) {
-	la.lines = append(la.lines, Line{[]byte{' '}, nil, nil, false})
+	la.lines = append(la.lines, Line{data: []byte{' '}})
 	copy(la.lines[y+2:], la.lines[y+1:])
-	la.lines[y+1] = Line{[]byte{}, la.lines[y].state, nil, false}
+	la.lines[y+1] = Line{data: []byte{}, state: la.lines[y].state}
 }
 
 // Inserts a byte array at a given location
@@ -180,14 +276,42 @@ func (la *LineArray) insertByte(pos Loc, value byte) {
 	la.lines[pos.Y].data = append(la.lines[pos.Y].data, 0)
 	copy(la.lines[pos.Y].data[pos.X+1:], la.lines[pos.Y].data[pos.X:])
 	la.lines[pos.Y].data[pos.X] = value
+	la.lines[pos.Y].runesValid = false
 }
 
 // joinLines joins the two lines a and b
 func (la *LineArray) joinLines(a, b int) {
+	// The line ending between the lines is removed
+	la.lines[a].eol = la.lines[b].eol
 	la.insert(Loc{len(la.lines[a].data), a}, la.lines[b].data)
 	la.deleteLine(b)
 }
 
+// lineEOLs returns the line endings of the lines from start up to (but not
+// including) end, or nil if they all have the default line ending
+func (la *LineArray) lineEOLs(start, end int) []byte {
+	for i := start; i < end; i++ {
+		if la.lines[i].eol != eolDefault {
+			eols := make([]byte, end-start)
+			for j := range eols {
+				eols[j] = la.lines[start+j].eol
+			}
+			return eols
+		}
+	}
+	return nil
+}
+
+// setEOLs sets the line endings of the lines starting at line y, as returned
+// by lineEOLs
+func (la *LineArray) setEOLs(y int, eols []byte) {
+	for i, eol := range eols {
+		if y+i < len(la.lines) {
+			la.lines[y+i].eol = eol
+		}
+	}
+}
+
 // split splits a line at a given position
 func (la *LineArray) split(pos Loc) {
 	la.newlineBelow(pos.Y)
@@ -196,7 +320,9 @@ func (la *LineArray) split(pos Loc) {
 	la.lines[pos.Y].state = nil
 	la.lines[pos.Y].match = nil
 	la.lines[pos.Y+1].match = nil
-	la.lines[pos.Y].rehighlight = true
+	// The new line ending is between the lines
+	la.lines[pos.Y+1].eol = la.lines[pos.Y].eol
+	la.lines[pos.Y].eol = eolDefault
 	la.deleteToEnd(Loc{pos.X, pos.Y})
 }
 
@@ -207,6 +333,7 @@ func (la *LineArray) remove(start, end Loc) []byte {
 	endX := runeToByteIndex(end.X, la.lines[end.Y].data)
 	if start.Y == end.Y {
 		la.lines[start.Y].data = append(la.lines[start.Y].data[:startX], la.lines[start.Y].data[endX:]...)
+		la.lines[start.Y].runesValid = false
 	} else {
 		for i := start.Y + 1; i <= end.Y-1; i++ {
 			la.deleteLine(start.Y + 1)
@@ -221,11 +348,13 @@ func (la *LineArray) remove(start, end Loc) []byte {
 // deleteToEnd deletes from the end of a line to the position
 func (la *LineArray) deleteToEnd(pos Loc) {
 	la.lines[pos.Y].data = la.lines[pos.Y].data[:pos.X]
+	la.lines[pos.Y].runesValid = false
 }
 
 // deleteFromStart deletes from the start of a line to the position
 func (la *LineArray) deleteFromStart(pos Loc) {
 	la.lines[pos.Y].data = la.lines[pos.Y].data[pos.X+1:]
+	la.lines[pos.Y].runesValid = false
 }
 
 // deleteLine deletes the line number
@@ -236,6 +365,7 @@ func (la *LineArray) deleteLine(y int) {
 // DeleteByte deletes the byte at a position
 func (la *LineArray) deleteByte(pos Loc) {
 	la.lines[pos.Y].data = la.lines[pos.Y].data[:pos.X+copy(la.lines[pos.Y].data[pos.X:], la.lines[pos.Y].data[pos.X+1:])]
+	la.lines[pos.Y].runesValid = false
 }
 
 // Substr returns the string representation between two locations
@@ -269,10 +399,41 @@ func (la *LineArray) Start() Loc {
 	return Loc{0, 0}
 }
 
-// End returns the location of the last character in the buffer
+// End returns the location just after the last character in the buffer
+// Like all locations its X is a number of runes, not bytes
 func (la *LineArray) End() Loc {
 	numlines := len(la.lines)
-	return Loc{utf8.RuneCount(la.lines[numlines-1].data), numlines - 1}
+	return Loc{la.LineRuneCount(numlines - 1), numlines - 1}
+}
+
+// EndLineCol returns the 1-based line and column of the end of the buffer, as
+// they should be displayed
+// The line is the number of lines in the buffer, so if the buffer ends with a
+// newline it is the empty line after it
+func (la *LineArray) EndLineCol() (line, col int) {
+	end := la.End()
+	return end.Y + 1, end.X + 1
+}
+
+// LastLine returns the last line of the buffer, which is empty if the buffer
+// ends with a newline
+func (la *LineArray) LastLine() []byte {
+	return la.lines[len(la.lines)-1].data
+}
+
+// LineRuneCount returns the number of runes in line n
+// The count is cached until the line is changed, so unlike counting the runes
+// of LineBytes it is cheap to call repeatedly
+func (la *LineArray) LineRuneCount(n int) int {
+	if n >= len(la.lines) || n < 0 {
+		return 0
+	}
+	l := &la.lines[n]
+	if !l.runesValid {
+		l.runes = utf8.RuneCount(l.data)
+		l.runesValid = true
+	}
+	return l.runes
 }
 
 // LineBytes returns line n as an array of bytes
@@ -302,11 +463,3 @@ func (la *LineArray) SetMatch(lineN int, m highlight.LineMatch) {
 func (la *LineArray) Match(lineN int) highlight.LineMatch {
 	return la.lines[lineN].match
 }
-
-func (la *LineArray) Rehighlight(lineN int) bool {
-	return la.lines[lineN].rehighlight
-}
-
-func (la *LineArray) SetRehighlight(lineN int, on bool) {
-	la.lines[lineN].rehighlight = on
-}
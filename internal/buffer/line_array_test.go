@@ -1,8 +1,11 @@
 package buffer
 
 import (
+	"io/ioutil"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -58,3 +61,81 @@ func TestRemove(t *testing.T) {
 	bytes := la.Bytes()
 	assert.Equal(t, unicode_txt, string(bytes))
 }
+
+func TestEndLineCol(t *testing.T) {
+	text := "foo\nbär"
+	l := NewLineArray(uint64(len(text)), FFAuto, strings.NewReader(text))
+	line, col := l.EndLineCol()
+	assert.Equal(t, 2, line)
+	assert.Equal(t, 4, col)
+	assert.Equal(t, []byte("bär"), l.LastLine())
+
+	text = "foo\nbär\n"
+	l = NewLineArray(uint64(len(text)), FFAuto, strings.NewReader(text))
+	line, col = l.EndLineCol()
+	assert.Equal(t, 3, line)
+	assert.Equal(t, 1, col)
+	assert.Equal(t, []byte{}, l.LastLine())
+}
+
+func TestLineRuneCount(t *testing.T) {
+	b := NewBufferFromString("héllo\nwörld\n\tend", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+
+	check := func() {
+		for i := 0; i < b.LinesNum(); i++ {
+			assert.Equal(t, utf8.RuneCount(b.LineBytes(i)), b.LineRuneCount(i))
+		}
+	}
+	check()
+	assert.Equal(t, 0, b.LineRuneCount(-1))
+	assert.Equal(t, 0, b.LineRuneCount(3))
+
+	b.Insert(Loc{2, 0}, "ää\nö")
+	check()
+	b.Remove(Loc{1, 1}, Loc{3, 2})
+	check()
+	b.Replace(Loc{0, 0}, Loc{1, 0}, "ü")
+	check()
+	b.Undo()
+	check()
+	b.Undo()
+	check()
+	b.Redo()
+	check()
+
+	b.SetOptionNative("tabstospaces", true)
+	b.Retab()
+	check()
+	assert.Equal(t, Loc{b.LineRuneCount(b.LinesNum() - 1), b.LinesNum() - 1}, b.End())
+}
+
+func BenchmarkEnd(b *testing.B) {
+	buf := NewBufferFromString(strings.Repeat("ü", 10000), "", BTDefault)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		end := buf.End()
+		c := buf.GetActiveCursor()
+		c.X = end.X + 1
+		c.Relocate()
+	}
+}
+
+func TestReader(t *testing.T) {
+	for _, text := range []string{unicode_txt, "", "\n\n", "a\r\nb\r\n"} {
+		b := NewBufferFromString(text, "", BTDefault)
+		data, err := ioutil.ReadAll(b.Reader())
+		assert.Nil(t, err)
+		assert.Equal(t, string(b.Bytes()), string(data))
+
+		data, err = ioutil.ReadAll(iotest.OneByteReader(b.Reader()))
+		assert.Nil(t, err)
+		assert.Equal(t, string(b.Bytes()), string(data))
+	}
+
+	b := NewBufferFromString("a\r\nb", "", BTDefault)
+	r := b.Reader()
+	b.Insert(b.End(), "\r\nc")
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "a\r\nb", string(data))
+}
@@ -0,0 +1,125 @@
+package buffer
+
+import (
+	"unicode"
+
+	runewidth "github.com/mattn/go-runewidth"
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// The widest line of a shared buffer is tracked as the buffer is edited so that
+// it only has to be searched for again when the widest line gets shorter
+type maxWidth struct {
+	valid   bool
+	tabsize int
+	width   int
+	line    int
+}
+
+// lineWidth returns the visual width of line n with tabs expanded
+func (b *SharedBuffer) lineWidth(n, tabsize int) int {
+	l := b.LineBytes(n)
+	return util.StringWidth(l, len(l), tabsize)
+}
+
+// updateMaxWidth updates the widest line after an edit changed the lines
+// from start to end (inclusive) and added delta lines (or removed them if
+// negative) below start
+func (b *SharedBuffer) updateMaxWidth(start, end, delta int) {
+	m := &b.maxWidth
+	if !m.valid {
+		return
+	}
+
+	removed := 0
+	if delta < 0 {
+		removed = -delta
+	}
+	// Whether the widest line was changed by the edit, in which case it may
+	// have become shorter
+	edited := false
+	if m.line > start+removed {
+		m.line += delta
+	} else if m.line >= start {
+		edited = true
+	}
+
+	width, line := -1, 0
+	for i := start; i <= end; i++ {
+		if w := b.lineWidth(i, m.tabsize); w > width {
+			width, line = w, i
+		}
+	}
+
+	if width > m.width || (edited && width == m.width) {
+		m.width, m.line = width, line
+	} else if edited {
+		// Some other line may be the widest now
+		m.valid = false
+	}
+}
+
+// MaxLineWidth returns the visual width of the widest line in the buffer, with
+// tabs expanded according to the tabsize option
+func (b *Buffer) MaxLineWidth() int {
+	m := &b.maxWidth
+	tabsize := util.IntOpt(b.Settings["tabsize"])
+	if !m.valid || m.tabsize != tabsize {
+		m.valid, m.tabsize, m.width, m.line = true, tabsize, 0, 0
+		for i := range b.lines {
+			if w := b.lineWidth(i, tabsize); w > m.width {
+				m.width, m.line = w, i
+			}
+		}
+	}
+	return m.width
+}
+
+// WrapPoints returns the indices of the runes of line n that start a new row
+// when the line is soft wrapped to the given display width, with tabs and
+// wide characters taking up as many columns as they are displayed with
+// If the softwrapwords option is on, lines are wrapped at the start of the
+// word that doesn't fit anymore and whitespace may go past the width, unless
+// the word is wider than a whole row
+func (b *Buffer) WrapPoints(n, width int) []int {
+	if width <= 0 {
+		return nil
+	}
+	tabsize := util.IntOpt(b.Settings["tabsize"])
+	words := b.Settings["softwrapwords"].(bool)
+
+	var points []int
+	line := []rune(string(b.LineBytes(n)))
+	widths := make([]int, len(line))
+	// total is the width of the line before the rune, which tabs depend on
+	total := 0
+	// rowStart is the first rune of the current row and wordStart the last
+	// rune in it that follows whitespace
+	rowStart, rowWidth, wordStart := 0, 0, 0
+	for i, r := range line {
+		w := runewidth.RuneWidth(r)
+		if r == '\t' {
+			w = tabsize - total%tabsize
+		}
+		widths[i] = w
+		total += w
+
+		space := unicode.IsSpace(r)
+		for rowWidth+w > width && i > rowStart && !(words && space) {
+			start := i
+			if words && wordStart > rowStart {
+				start = wordStart
+			}
+			points = append(points, start)
+			rowStart, rowWidth = start, 0
+			for _, w := range widths[start:i] {
+				rowWidth += w
+			}
+		}
+		rowWidth += w
+		if space {
+			wordStart = i + 1
+		}
+	}
+	return points
+}
@@ -0,0 +1,119 @@
+package buffer
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// maxWidthOf computes the widest line of the buffer from scratch
+func maxWidthOf(b *Buffer) int {
+	fresh := NewBufferFromString(string(b.Bytes()), "", BTDefault)
+	fresh.Settings["tabsize"] = b.Settings["tabsize"]
+	return fresh.MaxLineWidth()
+}
+
+func TestMaxLineWidth(t *testing.T) {
+	b := NewBufferFromString("ab\n\tc\nlongest line\nx", "", BTDefault)
+	b.SetOptionNative("tabsize", float64(4))
+	assert.Equal(t, 12, b.MaxLineWidth())
+
+	// Lengthen the longest line
+	b.Insert(Loc{12, 2}, "!!")
+	assert.Equal(t, 14, b.MaxLineWidth())
+
+	// Shorten it so that another line is the widest
+	b.Remove(Loc{0, 2}, Loc{14, 2})
+	assert.Equal(t, 5, b.MaxLineWidth())
+
+	// Tabs are expanded with the current tabsize
+	b.SetOptionNative("tabsize", float64(8))
+	assert.Equal(t, 9, b.MaxLineWidth())
+
+	// Splitting the widest line
+	b.Insert(Loc{0, 0}, "abcdefghij")
+	assert.Equal(t, 12, b.MaxLineWidth())
+	b.Insert(Loc{6, 0}, "\n")
+	assert.Equal(t, 9, b.MaxLineWidth())
+
+	// Joining lines
+	b.Remove(Loc{6, 0}, Loc{0, 1})
+	assert.Equal(t, 12, b.MaxLineWidth())
+
+	// Retab replaces every tab with tabsize spaces, whatever its column
+	r := NewBufferFromString("ab\n  \tx\nabc", "", BTDefault)
+	r.SetOptionNative("tabsize", float64(4))
+	assert.Equal(t, 5, r.MaxLineWidth())
+	r.hlDirty = false
+	r.SetOptionNative("tabstospaces", true)
+	r.Retab()
+	assert.Equal(t, 7, r.MaxLineWidth())
+	assert.Equal(t, maxWidthOf(r), r.MaxLineWidth())
+	assert.True(t, r.hlDirty)
+	assert.Equal(t, 1, r.hlStart)
+	assert.Equal(t, 1, r.hlEnd)
+	assert.True(t, r.Modified())
+}
+
+func TestMaxLineWidthRandomEdits(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := NewBufferFromString(strings.Repeat("a line\n\tand\nanother longer line\n", 50), "", BTDefault)
+	b.MaxLineWidth()
+	edits := []string{"xxxxxxxxxxxxxxxxxxxxxxxxxx", "\t", "\n", "a\nb\nc"}
+
+	for i := 0; i < 500; i++ {
+		y := r.Intn(b.LinesNum())
+		x := r.Intn(len(b.LineBytes(y)) + 1)
+		if r.Intn(2) == 0 {
+			b.Insert(Loc{x, y}, edits[r.Intn(len(edits))])
+		} else {
+			end := Loc{x, y}.Move(r.Intn(60), b)
+			if end.GreaterThan(b.End()) {
+				end = b.End()
+			}
+			b.Remove(Loc{x, y}, end)
+		}
+		if !assert.Equal(t, maxWidthOf(b), b.MaxLineWidth(), "edit", i) {
+			return
+		}
+	}
+}
+
+func BenchmarkMaxLineWidth(b *testing.B) {
+	buf := NewBufferFromString("the longest line of the buffer\n"+strings.Repeat("a line\n\tand\n", 50000), "", BTDefault)
+	buf.MaxLineWidth()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Edits of lines other than the widest one don't need a rescan
+		y := 1 + i%(buf.LinesNum()-1)
+		buf.Insert(Loc{0, y}, "x")
+		buf.MaxLineWidth()
+		buf.Remove(Loc{0, y}, Loc{1, y})
+		buf.MaxLineWidth()
+	}
+}
+
+func TestWrapPoints(t *testing.T) {
+	b := NewBufferFromString("hello world foo\n你好世界\n\tab\nabcdefghij k", "", BTDefault)
+	b.SetOptionNative("tabsize", float64(4))
+
+	assert.Equal(t, []int{8}, b.WrapPoints(0, 8))
+	assert.Equal(t, []int{5, 10}, b.WrapPoints(0, 5))
+	assert.Equal(t, []int(nil), b.WrapPoints(0, 15))
+	assert.Equal(t, []int{2}, b.WrapPoints(1, 5))
+	assert.Equal(t, []int{1, 2, 3}, b.WrapPoints(1, 3))
+	assert.Equal(t, []int{1, 2, 3}, b.WrapPoints(1, 1))
+	assert.Equal(t, []int{2}, b.WrapPoints(2, 5))
+	assert.Equal(t, []int(nil), b.WrapPoints(0, 0))
+
+	b.SetOptionNative("softwrapwords", true)
+	assert.Equal(t, []int{6, 12}, b.WrapPoints(0, 8))
+	// The space after "hello" may go past the width
+	assert.Equal(t, []int{6, 12}, b.WrapPoints(0, 5))
+	assert.Equal(t, []int{2}, b.WrapPoints(1, 5))
+	// Words wider than a row are broken
+	assert.Equal(t, []int{4, 8}, b.WrapPoints(3, 4))
+}
@@ -0,0 +1,104 @@
+package buffer
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// LoadedLines receives the lines of files that buffers from
+// NewBufferIncremental have loaded in the background
+// The main loop must call the functions it receives, which add the lines to
+// their buffers, so that buffers are only ever changed by the main goroutine
+var LoadedLines = make(chan func(), 16)
+
+// The number of lines that are loaded in the background before they are
+// added to the buffer
+const loadChunkLines = 10000
+
+// A loader loads the rest of a file in the background after the buffer has
+// been created from its first lines
+type loader struct {
+	r *bufio.Reader
+	// Whether the buffer was readonly before it was made readonly for the
+	// duration of the loading
+	readonly bool
+	// Closed to stop the loading when the buffer is closed
+	stop chan struct{}
+}
+
+// load reads the rest of the file in chunks and sends them to LoadedLines
+// It closes the file (if it is an io.Closer) when it is done
+func (l *loader) load(b *Buffer, file io.Reader) {
+	if c, ok := file.(io.Closer); ok {
+		defer c.Close()
+	}
+	for {
+		chunk := new(LineArray)
+		done := chunk.readLines(l.r, FFAuto, loadChunkLines)
+		select {
+		case LoadedLines <- func() { b.addLoadedLines(l, chunk.lines, done) }:
+		case <-l.stop:
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// addLoadedLines adds lines that l has loaded to the end of the buffer, and
+// finishes the loading if they are the last lines of the file
+func (b *Buffer) addLoadedLines(l *loader, lines []Line, done bool) {
+	if b.loader != l {
+		// The loading has been stopped
+		return
+	}
+	b.lines = append(b.lines, lines...)
+	b.maxWidth.valid = false
+	if done {
+		b.Type.Readonly = l.readonly
+		b.loader = nil
+		if !b.Settings["fastdirty"].(bool) {
+			calcHash(b, &b.origHash)
+		}
+	}
+}
+
+// NewBufferIncremental creates a new buffer like NewBuffer, but only reads the
+// first firstLines lines of r before it returns, and calls onFirstScreen once
+// they are available
+// The rest of r is loaded in the background (see LoadedLines) and closed when
+// it has been read if it is an io.Closer. While the buffer is loading, LinesNum
+// grows as lines are added, the lines that have been loaded can be read, and
+// the buffer is readonly and can't be saved
+func NewBufferIncremental(r io.Reader, size int64, path string, btype BufType, firstLines int, onFirstScreen func()) *Buffer {
+	b := newBuffer(r, size, path, Loc{-1, -1}, btype, util.Max(firstLines, 1))
+	if onFirstScreen != nil {
+		onFirstScreen()
+	}
+	if b.loader != nil {
+		go b.loader.load(b, r)
+	} else if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	return b
+}
+
+// IsFullyLoaded returns false if the buffer is still loading its file in the
+// background
+func (b *Buffer) IsFullyLoaded() bool {
+	return b.loader == nil
+}
+
+// stopLoading stops the loading of the buffer's file in the background, and
+// leaves the buffer with the lines that have been loaded so far
+func (b *Buffer) stopLoading() {
+	if b.loader == nil {
+		return
+	}
+	close(b.loader.stop)
+	b.Type.Readonly = b.loader.readonly
+	b.loader = nil
+}
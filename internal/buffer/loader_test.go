@@ -0,0 +1,69 @@
+package buffer
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBufferIncremental(t *testing.T) {
+	var text strings.Builder
+	for i := 0; i < 3*loadChunkLines; i++ {
+		text.WriteString("line " + strconv.Itoa(i) + "\n")
+	}
+	path := tempFile(t, "large.txt", text.String())
+	defer os.RemoveAll(filepath.Dir(path))
+
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	firstScreen := false
+	b := NewBufferIncremental(file, int64(text.Len()), path, BTDefault, 50, func() {
+		firstScreen = true
+	})
+	defer b.Close()
+
+	// Nothing else is added until the main loop receives the loaded lines
+	assert.True(t, firstScreen)
+	assert.False(t, b.IsFullyLoaded())
+	assert.Equal(t, 50, b.LinesNum())
+	assert.Equal(t, "line 49", b.Line(49))
+	assert.True(t, b.Type.Readonly)
+	assert.False(t, b.Modified())
+	assert.Equal(t, ErrNotLoaded, b.Save())
+
+	lines, err := b.ReadLineRange(40, 45)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(lines))
+	lines, err = b.ReadLineRange(40, 60)
+	assert.Equal(t, ErrNotLoaded, err)
+	assert.Equal(t, 10, len(lines))
+
+	for !b.IsFullyLoaded() {
+		f := <-LoadedLines
+		f()
+	}
+	assert.Equal(t, 3*loadChunkLines+1, b.LinesNum())
+	lines, err = b.ReadLineRange(40, 60)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(lines))
+	assert.Equal(t, text.String(), string(b.Bytes()))
+	assert.False(t, b.Type.Readonly)
+	assert.False(t, b.Modified())
+}
+
+func TestNewBufferIncrementalSmall(t *testing.T) {
+	firstScreen := false
+	b := NewBufferIncremental(strings.NewReader("a\nb"), 3, "", BTDefault, 50, func() {
+		firstScreen = true
+	})
+	defer b.Close()
+
+	assert.True(t, firstScreen)
+	assert.True(t, b.IsFullyLoaded())
+	assert.Equal(t, "a\nb", string(b.Bytes()))
+	assert.False(t, b.Type.Readonly)
+}
@@ -68,9 +68,9 @@ func DiffLA(a, b Loc, buf *LineArray) int {
 	loc := 0
 	for i := a.Y + 1; i < b.Y; i++ {
 		// + 1 for the newline
-		loc += utf8.RuneCount(buf.LineBytes(i)) + 1
+		loc += buf.LineRuneCount(i) + 1
 	}
-	loc += utf8.RuneCount(buf.LineBytes(a.Y)) - a.X + b.X + 1
+	loc += buf.LineRuneCount(a.Y) - a.X + b.X + 1
 	return loc
 }
 
@@ -80,7 +80,7 @@ func (l Loc) right(buf *LineArray) Loc {
 		return Loc{l.X + 1, l.Y}
 	}
 	var res Loc
-	if l.X < utf8.RuneCount(buf.LineBytes(l.Y)) {
+	if l.X < buf.LineRuneCount(l.Y) {
 		res = Loc{l.X + 1, l.Y}
 	} else {
 		res = Loc{0, l.Y + 1}
@@ -97,7 +97,7 @@ func (l Loc) left(buf *LineArray) Loc {
 	if l.X > 0 {
 		res = Loc{l.X - 1, l.Y}
 	} else {
-		res = Loc{utf8.RuneCount(buf.LineBytes(l.Y - 1)), l.Y - 1}
+		res = Loc{buf.LineRuneCount(l.Y - 1), l.Y - 1}
 	}
 	return res
 }
@@ -135,3 +135,22 @@ func ByteOffset(pos Loc, buf *Buffer) int {
 	loc += len(buf.Line(y)[:x])
 	return loc
 }
+
+// LocFromCompilerPos converts a 1-based line and column, as reported by a
+// compiler or linter, to a location in the buffer. If colIsBytes is true the
+// column counts bytes (like gcc and clang), otherwise it counts characters.
+// Positions outside of the buffer are clamped to the closest valid location
+func (b *Buffer) LocFromCompilerPos(line, col int, colIsBytes bool) Loc {
+	y := util.Clamp(line-1, 0, b.LinesNum()-1)
+	l := b.LineBytes(y)
+	if !colIsBytes {
+		return Loc{util.Clamp(col-1, 0, utf8.RuneCount(l)), y}
+	}
+
+	n := util.Clamp(col-1, 0, len(l))
+	// a byte column in the middle of a character points to that character
+	for n > 0 && n < len(l) && !utf8.RuneStart(l[n]) {
+		n--
+	}
+	return Loc{utf8.RuneCount(l[:n]), y}
+}
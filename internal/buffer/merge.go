@@ -0,0 +1,174 @@
+package buffer
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// The markers around the two sides of a conflict in merged text
+const (
+	conflictMine   = "<<<<<<< mine\n"
+	conflictSep    = "=======\n"
+	conflictTheirs = ">>>>>>> theirs\n"
+)
+
+// A ConflictRange is a conflict in the text returned by ThreeWayMerge
+// Start is the line of its first marker, and End the line after its last
+// marker
+type ConflictRange struct {
+	Start int
+	End   int
+}
+
+// splitLines splits text into lines that keep their newline
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// matchLines returns, for every line of base, the line of other that it is
+// matched with by a diff of the two, or -1 if it was removed in other
+func matchLines(base, other string) []int {
+	differ := dmp.New()
+	baseRunes, otherRunes, _ := differ.DiffLinesToRunes(base, other)
+	diff := differ.DiffMainRunes(baseRunes, otherRunes, false)
+
+	match := make([]int, len(baseRunes))
+	o, a := 0, 0
+	for _, d := range diff {
+		n := utf8.RuneCountInString(d.Text)
+		switch d.Type {
+		case dmp.DiffEqual:
+			for i := 0; i < n; i++ {
+				match[o+i] = a + i
+			}
+			o += n
+			a += n
+		case dmp.DiffDelete:
+			for i := 0; i < n; i++ {
+				match[o+i] = -1
+			}
+			o += n
+		case dmp.DiffInsert:
+			a += n
+		}
+	}
+	return match
+}
+
+// merge3 merges the changes from base to mine and from base to theirs like
+// diff3 does
+// Regions that both sides changed differently become conflicts, which
+// contain both versions between conflict markers
+func merge3(base, mine, theirs string) (string, []ConflictRange) {
+	baseLines, mineLines, theirLines := splitLines(base), splitLines(mine), splitLines(theirs)
+	matchMine, matchTheirs := matchLines(base, mine), matchLines(base, theirs)
+
+	var merged []string
+	var conflicts []ConflictRange
+	add := func(lines []string) {
+		merged = append(merged, lines...)
+		// A side that doesn't end with a newline must not be joined with a
+		// conflict marker after it
+		if n := len(merged); n > 0 && !strings.HasSuffix(merged[n-1], "\n") {
+			merged[n-1] += "\n"
+		}
+	}
+	equal := func(a, b []string) bool {
+		return strings.Join(a, "") == strings.Join(b, "")
+	}
+
+	o, a, t := 0, 0, 0
+	for {
+		// Lines that are unchanged on both sides
+		n := 0
+		for o+n < len(baseLines) && matchMine[o+n] == a+n && matchTheirs[o+n] == t+n {
+			n++
+		}
+		if n > 0 {
+			merged = append(merged, baseLines[o:o+n]...)
+			o, a, t = o+n, a+n, t+n
+			continue
+		}
+		if o == len(baseLines) && a == len(mineLines) && t == len(theirLines) {
+			break
+		}
+
+		// Find the end of the changed region, which is the next line of
+		// base that both sides kept
+		o2 := o
+		for o2 < len(baseLines) && (matchMine[o2] < 0 || matchTheirs[o2] < 0) {
+			o2++
+		}
+		a2, t2 := len(mineLines), len(theirLines)
+		if o2 < len(baseLines) {
+			a2, t2 = matchMine[o2], matchTheirs[o2]
+		}
+
+		b, m, th := baseLines[o:o2], mineLines[a:a2], theirLines[t:t2]
+		switch {
+		case equal(m, b):
+			merged = append(merged, th...)
+		case equal(th, b), equal(m, th):
+			merged = append(merged, m...)
+		default:
+			c := ConflictRange{Start: len(merged)}
+			merged = append(merged, conflictMine)
+			add(m)
+			merged = append(merged, conflictSep)
+			add(th)
+			merged = append(merged, conflictTheirs)
+			c.End = len(merged)
+			conflicts = append(conflicts, c)
+		}
+		o, a, t = o2, a2, t2
+	}
+	return strings.Join(merged, ""), conflicts
+}
+
+// ThreeWayMerge merges the changes that were made to the buffer since its file
+// was base with the changes that were made to the file on disk, which is now
+// theirs
+// base and theirs are the contents of the file in the buffer's encoding.
+// Regions that were changed differently in the buffer and on disk are
+// conflicts, which contain both versions between conflict markers and are
+// returned as ranges of lines of the merged text. The merged text uses unix
+// line endings and can be put into the buffer with ApplyDiff
+func (b *Buffer) ThreeWayMerge(base, theirs []byte) (merged string, conflicts []ConflictRange, err error) {
+	enc, err := htmlindex.Get(b.Settings["encoding"].(string))
+	if err != nil {
+		return "", nil, err
+	}
+	decode := func(data []byte) (string, error) {
+		data, _, err := transform.Bytes(enc.NewDecoder(), data)
+		if err != nil {
+			return "", err
+		}
+		if sep := lineSeparator(b.Settings); sep != "" {
+			if data, err = splitRecords(data, sep); err != nil {
+				return "", err
+			}
+		}
+		return strings.Replace(string(data), "\r\n", "\n", -1), nil
+	}
+
+	baseText, err := decode(base)
+	if err != nil {
+		return "", nil, err
+	}
+	theirText, err := decode(theirs)
+	if err != nil {
+		return "", nil, err
+	}
+	mine := strings.Replace(string(b.Bytes()), "\r\n", "\n", -1)
+
+	merged, conflicts = merge3(baseText, mine, theirText)
+	return merged, conflicts, nil
+}
@@ -0,0 +1,43 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreeWayMerge(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+	b := NewBufferFromString(base, "", BTDefault)
+	b.Replace(Loc{0, 1}, Loc{3, 1}, "TWO")
+	b.Insert(b.End(), "six\n")
+
+	// The changes are in different places
+	merged, conflicts, err := b.ThreeWayMerge([]byte(base), []byte("zero\none\ntwo\nthree\nfive\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(conflicts))
+	assert.Equal(t, "zero\none\nTWO\nthree\nfive\nsix\n", merged)
+
+	// Both sides made the same change
+	merged, conflicts, _ = b.ThreeWayMerge([]byte(base), []byte("one\nTWO\nthree\nfour\nfive\n"))
+	assert.Equal(t, 0, len(conflicts))
+	assert.Equal(t, "one\nTWO\nthree\nfour\nfive\nsix\n", merged)
+}
+
+func TestThreeWayMergeConflict(t *testing.T) {
+	base := "one\ntwo\nthree\n"
+	b := NewBufferFromString(base, "", BTDefault)
+	b.Replace(Loc{0, 1}, Loc{3, 1}, "mine")
+
+	merged, conflicts, err := b.ThreeWayMerge([]byte(base), []byte("one\ntheirs\nthree\nfour\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "one\n<<<<<<< mine\nmine\n=======\ntheirs\n>>>>>>> theirs\nthree\nfour\n", merged)
+	assert.Equal(t, []ConflictRange{{1, 6}}, conflicts)
+
+	// A conflict at the end of a file without a final newline
+	b = NewBufferFromString("a\nb", "", BTDefault)
+	b.Replace(Loc{0, 1}, Loc{1, 1}, "c")
+	merged, conflicts, _ = b.ThreeWayMerge([]byte("a\nb"), []byte("a\nd"))
+	assert.Equal(t, "a\n<<<<<<< mine\nc\n=======\nd\n>>>>>>> theirs\n", merged)
+	assert.Equal(t, []ConflictRange{{1, 6}}, conflicts)
+}
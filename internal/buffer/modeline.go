@@ -0,0 +1,163 @@
+package buffer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zyedidia/micro/internal/config"
+)
+
+// modelineLines is the number of lines at the start and at the end of a file
+// that are searched for a modeline
+const modelineLines = 5
+
+var vimModeline = regexp.MustCompile(`(?:^|\s)(?:vi|vim|Vim|ex):\s*(.*)`)
+var emacsModeline = regexp.MustCompile(`-\*-\s*(.*?)\s*-\*-`)
+var validFiletype = regexp.MustCompile(`^[\w.+-]+$`)
+
+// modelineFiletypes maps the names that vim and emacs use for some filetypes
+// to the filetype micro uses
+var modelineFiletypes = map[string]string{
+	"sh":          "shell",
+	"bash":        "shell",
+	"cpp":         "c++",
+	"js":          "javascript",
+	"make":        "makefile",
+	"text":        "unknown",
+	"fundamental": "unknown",
+}
+
+// parseVimModeline returns the settings of a vim modeline such as
+// "vim: ts=4 et" or "vim: set ts=4 et:"
+func parseVimModeline(line string) map[string]string {
+	m := vimModeline.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+
+	var fields []string
+	opts := m[1]
+	if strings.HasPrefix(opts, "set ") || strings.HasPrefix(opts, "se ") {
+		// The options end at the first colon
+		opts = opts[strings.Index(opts, " "):]
+		if i := strings.Index(opts, ":"); i >= 0 {
+			opts = opts[:i]
+		}
+		fields = strings.Fields(opts)
+	} else {
+		fields = strings.FieldsFunc(opts, func(r rune) bool {
+			return r == ':' || r == ' ' || r == '\t'
+		})
+	}
+
+	settings := make(map[string]string)
+	for _, f := range fields {
+		name, value := f, ""
+		if i := strings.Index(f, "="); i >= 0 {
+			name, value = f[:i], f[i+1:]
+		}
+		switch name {
+		case "ts", "tabstop":
+			settings["tabsize"] = value
+		case "et", "expandtab":
+			settings["tabstospaces"] = "true"
+		case "noet", "noexpandtab":
+			settings["tabstospaces"] = "false"
+		case "ft", "filetype", "syn", "syntax":
+			settings["filetype"] = value
+		}
+	}
+	return settings
+}
+
+// parseEmacsModeline returns the settings of an emacs modeline such as
+// "-*- mode: python; tab-width: 4 -*-"
+func parseEmacsModeline(line string) map[string]string {
+	m := emacsModeline.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+
+	settings := make(map[string]string)
+	if !strings.Contains(m[1], ":") {
+		// The short form only names the mode
+		settings["filetype"] = strings.ToLower(m[1])
+		return settings
+	}
+	for _, f := range strings.Split(m[1], ";") {
+		i := strings.Index(f, ":")
+		if i < 0 {
+			continue
+		}
+		name, value := strings.ToLower(strings.TrimSpace(f[:i])), strings.TrimSpace(f[i+1:])
+		switch name {
+		case "mode":
+			settings["filetype"] = strings.ToLower(value)
+		case "tab-width":
+			settings["tabsize"] = value
+		case "indent-tabs-mode":
+			settings["tabstospaces"] = strconv.FormatBool(value == "nil")
+		}
+	}
+	return settings
+}
+
+// Modeline returns the settings that a vim or emacs modeline in the first or
+// last lines of the buffer asks for, converted to micro's options
+// Only tabsize, tabstospaces and filetype are recognized. Values that are not
+// valid for these options are ignored
+func (b *Buffer) Modeline() map[string]interface{} {
+	settings := make(map[string]interface{})
+
+	n := b.LinesNum()
+	for i := 0; i < n; i++ {
+		if i >= modelineLines && i < n-modelineLines {
+			i = n - modelineLines
+		}
+		line := string(b.LineBytes(i))
+		opts := parseVimModeline(line)
+		if opts == nil {
+			opts = parseEmacsModeline(line)
+		}
+
+		for k, v := range opts {
+			switch k {
+			case "tabsize":
+				if size, err := strconv.Atoi(v); err == nil && size > 0 {
+					settings[k] = float64(size)
+				}
+			case "tabstospaces":
+				settings[k] = v == "true"
+			case "filetype":
+				if ft, ok := modelineFiletypes[v]; ok {
+					v = ft
+				}
+				if validFiletype.MatchString(v) {
+					settings[k] = v
+				}
+			}
+		}
+	}
+	return settings
+}
+
+// applyModeline applies the settings of the buffer's modeline, if the modeline
+// option is on
+// The modeline takes precedence over all other settings. If it sets the
+// filetype, the settings for that filetype are applied first
+func (b *Buffer) applyModeline() {
+	if !b.Settings["modeline"].(bool) {
+		return
+	}
+
+	settings := b.Modeline()
+	if ft, ok := settings["filetype"]; ok && ft != b.Settings["filetype"] {
+		b.Settings["filetype"] = ft
+		b.UpdateRules()
+		config.InitLocalSettings(b.Settings, b.Path)
+	}
+	for k, v := range settings {
+		b.Settings[k] = v
+	}
+}
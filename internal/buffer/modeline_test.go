@@ -0,0 +1,53 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zyedidia/micro/internal/config"
+)
+
+func TestModeline(t *testing.T) {
+	defer func(modeline interface{}) {
+		config.GlobalSettings["modeline"] = modeline
+	}(config.GlobalSettings["modeline"])
+	config.GlobalSettings["modeline"] = true
+
+	b := NewBufferFromString("#!/bin/sh\necho hi\n# vim: ts=2 et ft=python\n", "", BTDefault)
+	assert.Equal(t, map[string]interface{}{"tabsize": float64(2), "tabstospaces": true, "filetype": "python"}, b.Modeline())
+	assert.Equal(t, float64(2), b.Settings["tabsize"])
+	assert.Equal(t, true, b.Settings["tabstospaces"])
+	assert.Equal(t, "python", b.Settings["filetype"])
+
+	b = NewBufferFromString("/* vim: set tabstop=8 noexpandtab filetype=cpp: */\nint x;\n", "", BTDefault)
+	assert.Equal(t, float64(8), b.Settings["tabsize"])
+	assert.Equal(t, false, b.Settings["tabstospaces"])
+	assert.Equal(t, "c++", b.Settings["filetype"])
+
+	b = NewBufferFromString("# -*- mode: Ruby; tab-width: 3; indent-tabs-mode: nil -*-\nputs 1\n", "", BTDefault)
+	assert.Equal(t, float64(3), b.Settings["tabsize"])
+	assert.Equal(t, true, b.Settings["tabstospaces"])
+	assert.Equal(t, "ruby", b.Settings["filetype"])
+
+	b = NewBufferFromString(";; -*- lisp -*-\n", "", BTDefault)
+	assert.Equal(t, "lisp", b.Settings["filetype"])
+
+	// Invalid values and options outside of the safe subset are ignored
+	b = NewBufferFromString("# vim: ts=-1 ft=../x modeline shell=/bin/evil\n", "", BTDefault)
+	assert.Equal(t, map[string]interface{}{}, b.Modeline())
+
+	// Only the first and last lines are searched
+	text := "a\n\n\n\n\n# vim: ts=7\n\n\n\n\n\n"
+	b = NewBufferFromString(text, "", BTDefault)
+	assert.Equal(t, float64(4), b.Settings["tabsize"])
+}
+
+func TestModelineOption(t *testing.T) {
+	// Modelines are off by default
+	b := NewBufferFromString("// vim: ts=2\n", "", BTDefault)
+	assert.Equal(t, float64(4), b.Settings["tabsize"])
+
+	b.SetOptionNative("modeline", true)
+	b.applyModeline()
+	assert.Equal(t, float64(2), b.Settings["tabsize"])
+}
@@ -0,0 +1,63 @@
+package buffer
+
+import "unicode/utf8"
+
+// A ChangeKind says whether a change to a buffer inserted or removed text
+type ChangeKind int
+
+const (
+	ChangeInsert ChangeKind = TextEventInsert
+	ChangeRemove ChangeKind = TextEventRemove
+)
+
+// A changeObserver is a function registered with OnChange
+type changeObserver struct {
+	fn      func(start, end Loc, kind ChangeKind)
+	removed bool
+}
+
+// OnChange registers fn to be called after every change to the text of the
+// buffer, including undo and redo. Changes that replace text are reported as
+// a removal followed by an insertion
+// For insertions start and end delimit the inserted text, and for removals
+// they delimit the removed text as it was before the removal
+// The observers are shared by all the buffers that share the same text. The
+// returned function unregisters fn and may be called from within a callback
+func (b *Buffer) OnChange(fn func(start, end Loc, kind ChangeKind)) (unsubscribe func()) {
+	sb := b.SharedBuffer
+	o := &changeObserver{fn: fn}
+	sb.observers = append(sb.observers, o)
+
+	return func() {
+		if o.removed {
+			return
+		}
+		o.removed = true
+		for i, other := range sb.observers {
+			if other == o {
+				// Make a new slice so that notifications that are in progress
+				// are not disturbed
+				sb.observers = append(sb.observers[:i:i], sb.observers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// notifyChange calls the observers of the buffer with the given change
+func (b *SharedBuffer) notifyChange(start, end Loc, kind ChangeKind) {
+	for _, o := range b.observers {
+		if !o.removed {
+			o.fn(start, end, kind)
+		}
+	}
+}
+
+// notifyInsert calls the observers of the buffer with the insertion of text
+// at start
+func (b *SharedBuffer) notifyInsert(start Loc, text []byte) {
+	if len(b.observers) == 0 {
+		return
+	}
+	b.notifyChange(start, start.MoveLA(utf8.RuneCount(text), b.LineArray), ChangeInsert)
+}
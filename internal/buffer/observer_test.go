@@ -0,0 +1,69 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type change struct {
+	start, end Loc
+	kind       ChangeKind
+}
+
+func TestOnChange(t *testing.T) {
+	b := NewBufferFromString("hello\nworld\n", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+
+	var changes []change
+	unsubscribe := b.OnChange(func(start, end Loc, kind ChangeKind) {
+		changes = append(changes, change{start, end, kind})
+	})
+
+	b.Insert(Loc{5, 0}, " there\nnew")
+	assert.Equal(t, []change{{Loc{5, 0}, Loc{3, 1}, ChangeInsert}}, changes)
+
+	changes = nil
+	b.Remove(Loc{0, 1}, Loc{0, 2})
+	assert.Equal(t, []change{{Loc{0, 1}, Loc{0, 2}, ChangeRemove}}, changes)
+
+	changes = nil
+	b.Undo()
+	assert.Equal(t, []change{{Loc{0, 1}, Loc{0, 2}, ChangeInsert}}, changes)
+
+	changes = nil
+	b.Replace(Loc{0, 0}, Loc{5, 0}, "hi")
+	assert.Equal(t, []change{
+		{Loc{0, 0}, Loc{5, 0}, ChangeRemove},
+		{Loc{0, 0}, Loc{2, 0}, ChangeInsert},
+	}, changes)
+
+	changes = nil
+	unsubscribe()
+	unsubscribe()
+	b.Insert(Loc{0, 0}, "x")
+	assert.Equal(t, 0, len(changes))
+}
+
+func TestOnChangeUnsubscribeInCallback(t *testing.T) {
+	b := NewBufferFromString("", "", BTDefault)
+
+	calls := make([]int, 3)
+	var unsubscribe [3]func()
+	unsubscribe[0] = b.OnChange(func(start, end Loc, kind ChangeKind) {
+		calls[0]++
+		// Unsubscribing an observer that hasn't been called yet skips it
+		unsubscribe[0]()
+		unsubscribe[1]()
+	})
+	unsubscribe[1] = b.OnChange(func(start, end Loc, kind ChangeKind) {
+		calls[1]++
+	})
+	unsubscribe[2] = b.OnChange(func(start, end Loc, kind ChangeKind) {
+		calls[2]++
+	})
+
+	b.Insert(Loc{0, 0}, "a")
+	b.Insert(Loc{0, 0}, "b")
+	assert.Equal(t, []int{1, 0, 2}, calls)
+}
@@ -0,0 +1,91 @@
+package buffer
+
+import (
+	"regexp"
+)
+
+// An OutlineEntry is a symbol (such as a function or a type) defined at the
+// top level of the buffer
+type OutlineEntry struct {
+	Name string
+	Line int
+}
+
+// defaultOutlinePatterns are the regexes that find the symbols of a filetype
+// for Outline when the outlinepatterns option is empty
+var defaultOutlinePatterns = map[string][]string{
+	"go": {
+		`^func\s+(?:\([^)]*\)\s*)?(\w+)`,
+		`^type\s+(\w+)`,
+	},
+	"javascript": {
+		`^(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)`,
+		`^(?:export\s+)?(?:default\s+)?class\s+(\w+)`,
+	},
+	"lua": {
+		`^(?:local\s+)?function\s+([\w.:]+)`,
+	},
+	"python": {
+		`^(?:async\s+)?def\s+(\w+)`,
+		`^class\s+(\w+)`,
+	},
+	"ruby": {
+		`^(?:def|class|module)\s+([\w.:?!]+)`,
+	},
+	"rust": {
+		`^(?:pub(?:\([^)]*\))?\s+)?(?:async\s+)?(?:unsafe\s+)?fn\s+(\w+)`,
+		`^(?:pub(?:\([^)]*\))?\s+)?(?:struct|enum|trait|mod)\s+(\w+)`,
+	},
+}
+
+// outlinePatterns returns the compiled regexes of the outlinepatterns option,
+// or the default ones of the filetype if it is empty
+func (b *Buffer) outlinePatterns() []*regexp.Regexp {
+	var patterns []string
+	if opt, ok := b.Settings["outlinepatterns"].([]interface{}); ok {
+		for _, p := range opt {
+			if s, ok := p.(string); ok {
+				patterns = append(patterns, s)
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		patterns = defaultOutlinePatterns[b.Settings["filetype"].(string)]
+	}
+
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		if r, err := regexp.Compile(p); err == nil {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Outline returns the symbols that are defined in the buffer, in the order of
+// their lines, without parsing it
+// A line that matches one of the regexes of the outline patterns defines a
+// symbol, named after the first group of the regex if it has one or the
+// whole match otherwise. The result is empty for filetypes without patterns
+func (b *Buffer) Outline() []OutlineEntry {
+	patterns := b.outlinePatterns()
+	entries := []OutlineEntry{}
+	if len(patterns) == 0 {
+		return entries
+	}
+
+	for i := 0; i < b.LinesNum(); i++ {
+		l := b.LineBytes(i)
+		for _, r := range patterns {
+			if m := r.FindSubmatch(l); m != nil {
+				name := m[0]
+				if len(m) > 1 && m[1] != nil {
+					name = m[1]
+				}
+				entries = append(entries, OutlineEntry{string(name), i})
+				break
+			}
+		}
+	}
+	return entries
+}
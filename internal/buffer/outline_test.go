@@ -0,0 +1,57 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutline(t *testing.T) {
+	b := NewBufferFromString("package main\n"+
+		"\n"+
+		"type point struct {\n"+
+		"\tx, y int\n"+
+		"}\n"+
+		"\n"+
+		"func (p point) String() string {\n"+
+		"\tf := func() {}\n"+
+		"\treturn \"\"\n"+
+		"}\n"+
+		"\n"+
+		"func main() {\n"+
+		"}\n", "", BTDefault)
+	b.SetOptionNative("filetype", "go")
+
+	assert.Equal(t, []OutlineEntry{
+		{"point", 2},
+		{"String", 6},
+		{"main", 11},
+	}, b.Outline())
+
+	b = NewBufferFromString("import os\n"+
+		"\n"+
+		"class Shape:\n"+
+		"    def area(self):\n"+
+		"        pass\n"+
+		"\n"+
+		"async def fetch():\n"+
+		"    pass\n"+
+		"\n"+
+		"def main():\n"+
+		"    pass\n", "", BTDefault)
+	b.SetOptionNative("filetype", "python")
+
+	assert.Equal(t, []OutlineEntry{
+		{"Shape", 2},
+		{"fetch", 6},
+		{"main", 9},
+	}, b.Outline())
+
+	// The patterns can be overridden
+	b.SetOptionNative("outlinepatterns", []interface{}{`^\s+def\s+\w+`})
+	assert.Equal(t, []OutlineEntry{{"    def area", 3}}, b.Outline())
+
+	b = NewBufferFromString("def main():\n", "", BTDefault)
+	b.SetOptionNative("filetype", "unknown")
+	assert.Equal(t, []OutlineEntry{}, b.Outline())
+}
@@ -0,0 +1,186 @@
+package buffer
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxPatchOffset is the number of lines above and below its stated position
+// that a hunk's context is searched for when it does not match exactly
+const maxPatchOffset = 100
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// A hunk is one section of a unified diff
+type hunk struct {
+	// Line (0-indexed) where the old text starts
+	start int
+	// Number of lines of old text
+	count int
+
+	old []byte
+	new []byte
+}
+
+// parsePatch parses the hunks of a unified diff for a single file
+func parsePatch(patch string) ([]hunk, error) {
+	var hunks []hunk
+
+	lines := strings.Split(patch, "\n")
+	for i := 0; i < len(lines); i++ {
+		match := hunkHeader.FindStringSubmatch(lines[i])
+		if match == nil {
+			continue
+		}
+
+		h := hunk{}
+		h.start, _ = strconv.Atoi(match[1])
+		h.count = 1
+		if match[2] != "" {
+			h.count, _ = strconv.Atoi(match[2])
+		}
+		newCount := 1
+		if match[4] != "" {
+			newCount, _ = strconv.Atoi(match[4])
+		}
+		// A hunk with no old lines gives the line after which to insert
+		if h.count > 0 {
+			h.start--
+		}
+
+		// Track which side the previous line belongs to for "\ No newline"
+		var lastOld, lastNew bool
+		oldLeft, newLeft := h.count, newCount
+		for i+1 < len(lines) {
+			l := lines[i+1]
+			if strings.HasPrefix(l, "\\") {
+				if lastOld {
+					h.old = h.old[:len(h.old)-1]
+				}
+				if lastNew {
+					h.new = h.new[:len(h.new)-1]
+				}
+				i++
+				continue
+			}
+			if oldLeft == 0 && newLeft == 0 {
+				break
+			}
+			i++
+
+			if l == "" {
+				// Some tools strip the space from empty context lines
+				l = " "
+			}
+			text := append([]byte(l[1:]), '\n')
+			switch l[0] {
+			case ' ':
+				h.old = append(h.old, text...)
+				h.new = append(h.new, text...)
+				oldLeft--
+				newLeft--
+				lastOld, lastNew = true, true
+			case '-':
+				h.old = append(h.old, text...)
+				oldLeft--
+				lastOld, lastNew = true, false
+			case '+':
+				h.new = append(h.new, text...)
+				newLeft--
+				lastOld, lastNew = false, true
+			default:
+				return nil, errors.New("Malformed patch line: " + l)
+			}
+		}
+		if oldLeft != 0 || newLeft != 0 {
+			return nil, errors.New("Patch hunk at line " + match[1] + " is truncated")
+		}
+
+		hunks = append(hunks, h)
+	}
+
+	if len(hunks) == 0 {
+		return nil, errors.New("Patch contains no hunks")
+	}
+
+	return hunks, nil
+}
+
+// hunkRange returns the range of text in the buffer that the hunk would
+// replace if it started at the given line
+func (b *Buffer) hunkRange(start, count int) (Loc, Loc, bool) {
+	if start < 0 || start+count > b.LinesNum() {
+		return Loc{}, Loc{}, false
+	}
+	if start == b.LinesNum() {
+		// Only possible for insertions at the very end of the buffer
+		return b.End(), b.End(), true
+	}
+	if start+count == b.LinesNum() {
+		// The last line of the buffer has no newline after it
+		return Loc{0, start}, b.End(), true
+	}
+	return Loc{0, start}, Loc{0, start + count}, true
+}
+
+// ApplyPatch applies a unified diff to the buffer as a single undoable
+// event
+// If a hunk's context does not match at its stated line, nearby lines are
+// searched for it (like patch(1) does). If a hunk cannot be found an error is
+// returned and the buffer is left unchanged
+func (b *Buffer) ApplyPatch(patch string) error {
+	if b.Type.Readonly {
+		return errors.New("Cannot patch readonly buffer")
+	}
+
+	hunks, err := parsePatch(patch)
+	if err != nil {
+		return err
+	}
+
+	var deltas []Delta
+	// lines added by hunks that have been applied so far
+	shift := 0
+	// offset at which the previous hunk was found
+	offset := 0
+	// first line that the next hunk is allowed to touch
+	minLine := 0
+	for i, h := range hunks {
+		found := false
+		var start, end Loc
+		var line int
+		for d := 0; d <= maxPatchOffset && !found; d++ {
+			for _, o := range []int{offset + d, offset - d} {
+				line = h.start + o
+				if line < minLine {
+					continue
+				}
+				s, e, ok := b.hunkRange(line, h.count)
+				if ok && string(b.Substr(s, e)) == string(h.old) {
+					start, end, found = s, e, true
+					offset = o
+					break
+				}
+			}
+		}
+		if !found {
+			return errors.New("Hunk " + strconv.Itoa(i+1) + " of patch does not apply")
+		}
+		minLine = line + h.count
+
+		start.Y += shift
+		end.Y += shift
+		deltas = append(deltas, Delta{h.new, start, end, nil})
+		shift += strings.Count(string(h.new), "\n") - strings.Count(string(h.old), "\n")
+	}
+
+	b.EventHandler.cursors = b.cursors
+	b.EventHandler.active = b.curCursor
+	b.MultipleReplace(deltas)
+	b.RelocateCursors()
+	b.backupAsync()
+
+	return nil
+}
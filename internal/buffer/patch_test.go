@@ -0,0 +1,120 @@
+package buffer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const patchOrig = `one
+two
+three
+four
+five
+six
+seven
+eight
+nine
+ten
+`
+
+func TestApplyPatch(t *testing.T) {
+	b := NewBufferFromString(patchOrig, "", BTDefault)
+
+	err := b.ApplyPatch(`--- a/numbers.txt
++++ b/numbers.txt
+@@ -1,3 +1,4 @@
+ one
+-two
++2
++two and a half
+ three
+@@ -8,3 +9,3 @@
+ eight
+ nine
+-ten
++TEN
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, "one\n2\ntwo and a half\nthree\nfour\nfive\nsix\nseven\neight\nnine\nTEN\n", string(b.Bytes()))
+	assert.Equal(t, 1, b.UndoStack.Len())
+
+	b.UndoOneEvent()
+	assert.Equal(t, patchOrig, string(b.Bytes()))
+	b.RedoOneEvent()
+	assert.Equal(t, "one\n2\ntwo and a half\nthree\nfour\nfive\nsix\nseven\neight\nnine\nTEN\n", string(b.Bytes()))
+}
+
+func TestApplyPatchOffset(t *testing.T) {
+	b := NewBufferFromString("zero\n"+patchOrig, "", BTDefault)
+
+	err := b.ApplyPatch(`@@ -4,2 +4,2 @@
+ four
+-five
++5
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, "zero\none\ntwo\nthree\nfour\n5\nsix\nseven\neight\nnine\nten\n", string(b.Bytes()))
+}
+
+func TestApplyPatchNoNewline(t *testing.T) {
+	b := NewBufferFromString("a\nb", "", BTDefault)
+
+	err := b.ApplyPatch(`@@ -2 +2,2 @@
+-b
+\ No newline at end of file
++b
++c
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, "a\nb\nc\n", string(b.Bytes()))
+}
+
+func TestApplyPatchMismatch(t *testing.T) {
+	b := NewBufferFromString(patchOrig, "", BTDefault)
+
+	err := b.ApplyPatch(`@@ -1,2 +1,2 @@
+ one
+-two
++2
+@@ -5,2 +5,2 @@
+ five
+-not six
++6
+`)
+	assert.NotNil(t, err)
+	assert.Equal(t, patchOrig, string(b.Bytes()))
+	assert.Equal(t, 0, b.UndoStack.Len())
+}
+
+func TestApplyPatchBackup(t *testing.T) {
+	path := tempFile(t, "numbers.txt", patchOrig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetOptionNative("backup", true)
+	defer b.RemoveBackup()
+
+	err = b.ApplyPatch(`@@ -1,2 +1,2 @@
+ one
+-two
++2
+`)
+	assert.Nil(t, err)
+	b.backups.Wait()
+	data, err := ioutil.ReadFile(b.backupPath())
+	assert.Nil(t, err)
+	assert.Equal(t, string(b.Bytes()), string(data))
+
+	b.SetOptionNative("readonly", true)
+	assert.NotNil(t, b.ApplyPatch(`@@ -1,1 +1,1 @@
+-one
++1
+`))
+	assert.Equal(t, "one\n2\nthree\n", string(b.Bytes()[:12]))
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -24,9 +26,17 @@ import (
 // because hashing is too slow
 const LargeFileThreshold = 50000
 
+// isDir returns whether path is an existing directory
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
 // overwriteFile opens the given file for writing, truncating if one exists, and then calls
 // the supplied function with the file as io.Writer object, also making sure the file is
 // closed afterwards.
+// Writing over the file in place (instead of renaming a new file over it) keeps
+// its owner, permissions and extended attributes, such as SELinux contexts
 func overwriteFile(name string, enc encoding.Encoding, fn func(io.Writer) error, withSudo bool) (err error) {
     var writeCloser io.WriteCloser
 
@@ -65,6 +75,276 @@ func overwriteFile(name string, enc encoding.Encoding, fn func(io.Writer) error,
     return
 }
 
+// writeLines writes the buffer's lines to the writer using the buffer's line
+// endings and returns the number of bytes written
+// If eofnewline is true, a line ending is added at the end if there is not
+// already one
+func (b *Buffer) writeLines(file io.Writer, eofnewline bool) (n int, e error) {
+	if len(b.lines) == 0 {
+		return
+	}
+	return b.writeRange(file, b.Start(), b.End(), eofnewline)
+}
+
+// writeRange writes the text between start and end to file the same way
+// writeLines writes the whole buffer
+func (b *Buffer) writeRange(file io.Writer, start, end Loc, eofnewline bool) (n int, e error) {
+	// end of line
+	eol := b.lineEnding()
+
+	// The line endings that lines had in the file are kept if preserveeol is
+	// on, unless the lines are separated by a custom separator
+	preserve := b.Settings["preserveeol"].(bool) && lineSeparator(b.Settings) == ""
+	lineEOL := func(l Line) []byte {
+		if preserve {
+			switch l.eol {
+			case eolLF:
+				return []byte{'\n'}
+			case eolCRLF:
+				return []byte{'\r', '\n'}
+			}
+		}
+		return eol
+	}
+
+	// tabs are only expanded in the written file, never in the buffer
+	tabmode := b.Settings["tabstospacesonsave"].(string)
+	tabsize := util.IntOpt(b.Settings["tabsize"])
+	line := func(y int) []byte {
+		data := b.lines[y].data
+		from, to := 0, len(data)
+		if y == start.Y {
+			from = runeToByteIndex(start.X, data)
+		}
+		if y == end.Y {
+			to = runeToByteIndex(end.X, data)
+		}
+		if tabmode == "off" {
+			return data[from:to]
+		}
+		return util.ExpandTabs(data[from:to], tabsize, tabmode == "leading")
+	}
+
+	// write lines
+	last := line(start.Y)
+	if n, e = file.Write(last); e != nil {
+		return
+	}
+
+	for y := start.Y + 1; y <= end.Y; y++ {
+		last = line(y)
+		// The line ending of the previous line
+		lineEnd := lineEOL(b.lines[y-1])
+		if _, e = file.Write(lineEnd); e != nil {
+			return
+		}
+		if _, e = file.Write(last); e != nil {
+			return
+		}
+		n += len(lineEnd) + len(last)
+	}
+
+	if eofnewline && len(last) > 0 {
+		if _, e = file.Write(eol); e != nil {
+			return
+		}
+		n += len(eol)
+	}
+	return
+}
+
+// lineEnding returns what lines are separated with when the buffer is written
+func (b *Buffer) lineEnding() []byte {
+	if sep := lineSeparator(b.Settings); sep != "" {
+		return []byte(sep)
+	} else if b.Endings == FFDos {
+		return []byte{'\r', '\n'}
+	}
+	return []byte{'\n'}
+}
+
+// WriteRange writes the text between start and end to w, with the line ending
+// of the buffer between lines, without building it in memory first like
+// Substr does
+func (b *Buffer) WriteRange(w io.Writer, start, end Loc) error {
+	if start.GreaterThan(end) {
+		start, end = end, start
+	}
+	if !InBounds(start, b) || !InBounds(end, b) {
+		return errors.New("Range is outside of the buffer")
+	}
+
+	eol := b.lineEnding()
+	for y := start.Y; y <= end.Y; y++ {
+		l := b.LineBytes(y)
+		from, to := 0, len(l)
+		if y == start.Y {
+			from = runeToByteIndex(start.X, l)
+		}
+		if y == end.Y {
+			to = runeToByteIndex(end.X, l)
+		}
+		if _, err := w.Write(l[from:to]); err != nil {
+			return err
+		}
+		if y < end.Y {
+			if _, err := w.Write(eol); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// makeParents makes sure the parent directories of the given file exist,
+// creating them if the 'mkparents' option is on
+func (b *Buffer) makeParents(absFilename string) error {
+	// Get the leading path to the file | "." is returned if there's no leading path provided
+	if dirname := filepath.Dir(absFilename); dirname != "." {
+		// Check if the parent dirs don't exist
+		if _, statErr := os.Stat(dirname); os.IsNotExist(statErr) {
+			// Prompt to make sure they want to create the dirs that are missing
+			if b.Settings["mkparents"].(bool) {
+				// Create all leading dir(s) since they don't exist
+				if mkdirallErr := os.MkdirAll(dirname, os.ModePerm); mkdirallErr != nil {
+					// If there was an error creating the dirs
+					return mkdirallErr
+				}
+			} else {
+				return errors.New("Parent dirs don't exist, enable 'mkparents' for auto creation")
+			}
+		}
+	}
+	return nil
+}
+
+// ftExcluded returns whether the filetype of the buffer is in the list of
+// filetypes of the given global option
+func (b *Buffer) ftExcluded(option string) bool {
+	exclude, _ := config.GlobalSettings[option].([]interface{})
+	for _, ft := range exclude {
+		if ft == b.Settings["filetype"] {
+			return true
+		}
+	}
+	return false
+}
+
+// keepTrailingWS returns whether the trailing whitespace of the buffer must be
+// kept even if rmtrailingws is on, because its filetype is in the
+// rmtrailingwsexclude option
+func (b *Buffer) keepTrailingWS() bool {
+	return b.ftExcluded("rmtrailingwsexclude")
+}
+
+// eofNewline returns whether a newline must be added at the end of the buffer
+// when it is saved, which eofnewline asks for unless the filetype is in the
+// eofnewlineexclude option
+func (b *Buffer) eofNewline() bool {
+	return b.Settings["eofnewline"].(bool) && !b.ftExcluded("eofnewlineexclude")
+}
+
+// prepareForSave makes the changes to the buffer that the rmtrailingws and
+// eofnewline options ask for before the buffer is written
+func (b *Buffer) prepareForSave() {
+	if b.Settings["rmtrailingws"].(bool) && !b.keepTrailingWS() {
+		for i, l := range b.lines {
+			leftover := utf8.RuneCount(bytes.TrimRightFunc(l.data, unicode.IsSpace))
+
+			linelen := utf8.RuneCount(l.data)
+			b.Remove(Loc{leftover, i}, Loc{linelen, i})
+		}
+
+		b.RelocateCursors()
+	}
+
+	if max := util.IntOpt(b.Settings["maxtrailingblanklines"]); max >= 0 {
+		b.trimTrailingBlankLines(max)
+	}
+
+	if b.eofNewline() {
+		// The buffer ends with a newline if its last line is empty, so a
+		// file that already ends with one doesn't get another on every save
+		if end := b.End(); end.X > 0 {
+			b.Insert(end, "\n")
+		}
+	}
+}
+
+// trimTrailingBlankLines removes the blank lines at the end of the buffer
+// beyond the first max ones
+// The empty line after the final newline isn't a blank line, so whether the
+// buffer ends with a newline doesn't change. This is left to eofnewline
+func (b *Buffer) trimTrailingBlankLines(max int) {
+	last := b.LinesNum() - 1
+	content := last
+	for content >= 0 && util.IsBytesWhitespace(b.LineBytes(content)) {
+		content--
+	}
+
+	lineEnd := func(n int) Loc {
+		if n < 0 {
+			return b.Start()
+		}
+		return Loc{b.LineRuneCount(n), n}
+	}
+
+	if len(b.LineBytes(last)) == 0 {
+		// Keep the final newline
+		if content+1+max < last {
+			b.Remove(Loc{0, content + 1 + max}, Loc{0, last})
+		}
+	} else if content+max < last {
+		b.Remove(lineEnd(content+max), b.End())
+	}
+	b.RelocateCursors()
+}
+
+// RenderForSave returns the bytes that SaveAs would write to the file, without
+// changing the buffer or writing anything to disk
+// It returns nil if the buffer's encoding is not supported
+func (b *Buffer) RenderForSave() []byte {
+	enc, err := htmlindex.Get(b.Settings["encoding"].(string))
+	if err != nil {
+		return nil
+	}
+
+	c := b.Clone()
+	c.prepareForSave()
+
+	var buf bytes.Buffer
+	w := transform.NewWriter(&buf, enc.NewEncoder())
+	if _, err := c.writeLines(w, false); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// SaveWouldChangeFile returns whether saving the buffer would change the file
+// on disk, taking into account the changes that are made when saving (such as
+// eofnewline and rmtrailingws) and changes that were made to the file by other
+// programs
+// A file that doesn't exist would always change
+func (b *Buffer) SaveWouldChangeFile() (bool, error) {
+	if b.Path == "" {
+		return true, ErrNoPath
+	}
+	if _, err := htmlindex.Get(b.Settings["encoding"].(string)); err != nil {
+		return true, err
+	}
+
+	data, err := ioutil.ReadFile(b.AbsPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return true, err
+	}
+	return !bytes.Equal(data, b.RenderForSave()), nil
+}
+
 // Save saves the buffer to its default path
 func (b *Buffer) Save() error {
 	return b.SaveAs(b.Path)
@@ -75,6 +355,121 @@ func (b *Buffer) SaveAs(filename string) error {
 	return b.saveToFile(filename, false)
 }
 
+// LastSaveInfo returns when the last successful save of the buffer finished,
+// how long writing the file took and how many bytes were written
+// All of them are zero if the buffer hasn't been saved yet
+func (b *Buffer) LastSaveInfo() (at time.Time, duration time.Duration, n int) {
+	return b.lastSaveAt, b.lastSaveDuration, b.lastSaveBytes
+}
+
+// SaveCopy writes the buffer to the given file without changing the buffer's
+// path or its modified status
+// Unlike SaveAs the buffer itself is never changed, so options such as
+// eofnewline only affect what is written to the file
+func (b *Buffer) SaveCopy(filename string) error {
+	if b.loader != nil {
+		return ErrNotLoaded
+	}
+	return b.saveRange(filename, b.Start(), b.End())
+}
+
+// SaveRange writes the text between start and end to the given file without
+// changing the buffer
+// A range covering the whole buffer is written the same way as SaveCopy
+func (b *Buffer) SaveRange(filename string, start, end Loc) error {
+	if start.GreaterThan(end) {
+		start, end = end, start
+	}
+	if !InBounds(start, b) || !InBounds(end, b) {
+		return errors.New("Range is outside of the buffer")
+	}
+	if start == b.Start() && end == b.End() {
+		return b.SaveCopy(filename)
+	}
+	return b.saveRange(filename, start, end)
+}
+
+// saveRange writes the text between start and end to the given file, which
+// SaveCopy and SaveRange do the same way
+func (b *Buffer) saveRange(filename string, start, end Loc) error {
+	if b.saveErr != nil {
+		return b.saveErr
+	}
+	absFilename, _ := util.ReplaceHome(filename)
+	if isDir(absFilename) {
+		return ErrPathIsDirectory
+	}
+	if err := b.makeParents(absFilename); err != nil {
+		return err
+	}
+
+	enc, err := htmlindex.Get(b.Settings["encoding"].(string))
+	if err != nil {
+		return err
+	}
+
+	return overwriteFile(absFilename, enc, func(file io.Writer) error {
+		_, e := b.writeRange(file, start, end, b.eofNewline())
+		return e
+	}, false)
+}
+
+// Rename moves the buffer's file to newPath and makes the buffer use the new
+// path. The filetype is detected again and the cursor and undo history of the
+// file are moved along with it
+// If the buffer's file doesn't exist on disk (because it was never saved)
+// only the path of the buffer is changed
+func (b *Buffer) Rename(newPath string) error {
+	if newPath == "" {
+		return ErrNoPath
+	}
+	if b.Type.Scratch {
+		return errors.New("Cannot rename scratch buffer")
+	}
+
+	absFilename, _ := util.ReplaceHome(newPath)
+	absPath, err := filepath.Abs(absFilename)
+	if err != nil {
+		return err
+	}
+	if absPath == b.AbsPath {
+		return nil
+	}
+
+	if b.Path != "" && !b.clone {
+		if _, err := os.Stat(b.AbsPath); err == nil {
+			if _, err := os.Stat(absPath); err == nil {
+				return errors.New("Cannot rename to " + newPath + ": file already exists")
+			}
+			if err := b.makeParents(absPath); err != nil {
+				return err
+			}
+			if err := os.Rename(b.AbsPath, absPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	oldPath, oldAbsPath, oldBackup := b.Path, b.AbsPath, b.backupPath()
+	b.Path = newPath
+	b.AbsPath = absPath
+	if b.name == oldPath {
+		b.name = ""
+	}
+	b.updateFileKey()
+
+	if oldPath != "" && !b.clone {
+		os.Rename(oldBackup, b.backupPath())
+		if err := b.moveSerialized(oldAbsPath); err != nil {
+			return err
+		}
+	}
+
+	b.redetectFiletype()
+	b.ModTime, _ = util.GetModTime(absPath)
+	return nil
+}
+
 func (b *Buffer) SaveWithSudo() error {
 	return b.SaveAsWithSudo(b.Path)
 }
@@ -83,61 +478,63 @@ func (b *Buffer) SaveAsWithSudo(filename string) error {
 	return b.saveToFile(filename, true)
 }
 
-func (b *Buffer) saveToFile(filename string, withSudo bool) error {
+func (b *Buffer) saveToFile(filename string, withSudo bool) (result error) {
+	if b.OnAfterSave != nil {
+		defer func() {
+			b.OnAfterSave(result)
+		}()
+	}
+
 	var err error
+	if filename == "" {
+		return ErrNoPath
+	}
+	if b.loader != nil {
+		return ErrNotLoaded
+	}
+	if b.saveErr != nil {
+		return b.saveErr
+	}
 	if b.Type.Readonly {
 		return errors.New("Cannot save readonly buffer")
 	}
 	if b.Type.Scratch {
 		return errors.New("Cannot save scratch buffer")
 	}
+	if b.clone {
+		if absPath, _ := filepath.Abs(filename); absPath == b.AbsPath {
+			return errors.New("Cannot save a clone over the file of its original, use SaveCopy instead")
+		}
+	}
 	if withSudo && runtime.GOOS == "windows" {
 	    return errors.New("Save with sudo not supported on Windows")
 	}
-
-	b.UpdateRules()
-	if b.Settings["rmtrailingws"].(bool) {
-		for i, l := range b.lines {
-			leftover := utf8.RuneCount(bytes.TrimRightFunc(l.data, unicode.IsSpace))
-
-			linelen := utf8.RuneCount(l.data)
-			b.Remove(Loc{leftover, i}, Loc{linelen, i})
-		}
-
-		b.RelocateCursors()
+	if absFilename, _ := util.ReplaceHome(filename); isDir(absFilename) {
+		return ErrPathIsDirectory
 	}
 
-	if b.Settings["eofnewline"].(bool) {
-		end := b.End()
-		if b.RuneAt(Loc{end.X - 1, end.Y}) != '\n' {
-			b.Insert(end, "\n")
+	b.UpdateRules()
+	b.prepareForSave()
+	if b.OnBeforeSave != nil {
+		if err := b.OnBeforeSave(); err != nil {
+			return err
 		}
 	}
 
 	// Update the last time this file was updated after saving
 	defer func() {
 		b.ModTime, _ = util.GetModTime(filename)
+		if info, e := os.Stat(filename); e == nil {
+			b.diskSize = info.Size()
+		}
 		err = b.Serialize()
 	}()
 
 	// Removes any tilde and replaces with the absolute path to home
 	absFilename, _ := util.ReplaceHome(filename)
 
-	// Get the leading path to the file | "." is returned if there's no leading path provided
-	if dirname := filepath.Dir(absFilename); dirname != "." {
-		// Check if the parent dirs don't exist
-		if _, statErr := os.Stat(dirname); os.IsNotExist(statErr) {
-			// Prompt to make sure they want to create the dirs that are missing
-			if b.Settings["mkparents"].(bool) {
-				// Create all leading dir(s) since they don't exist
-				if mkdirallErr := os.MkdirAll(dirname, os.ModePerm); mkdirallErr != nil {
-					// If there was an error creating the dirs
-					return mkdirallErr
-				}
-			} else {
-				return errors.New("Parent dirs don't exist, enable 'mkparents' for auto creation")
-			}
-		}
+	if err = b.makeParents(absFilename); err != nil {
+		return err
 	}
 
 	var fileSize int
@@ -148,38 +545,21 @@ func (b *Buffer) saveToFile(filename string, withSudo bool) error {
 	}
 
 	fwriter := func(file io.Writer) (e error) {
-		if len(b.lines) == 0 {
-			return
-		}
-
-		// end of line
-		var eol []byte
-		if b.Endings == FFDos {
-			eol = []byte{'\r', '\n'}
-		} else {
-			eol = []byte{'\n'}
-		}
-
-		// write lines
-		if fileSize, e = file.Write(b.lines[0].data); e != nil {
-			return
-		}
-
-		for _, l := range b.lines[1:] {
-			if _, e = file.Write(eol); e != nil {
-				return
-			}
-			if _, e = file.Write(l.data); e != nil {
-				return
-			}
-			fileSize += len(eol) + len(l.data)
-		}
+		fileSize, e = b.writeLines(file, false)
 		return
 	}
 
+	start := time.Now()
 	if err = overwriteFile(absFilename, enc, fwriter, withSudo); err != nil {
 	    return err
 	}
+	b.lastSaveAt = time.Now()
+	b.lastSaveDuration = b.lastSaveAt.Sub(start)
+	b.lastSaveBytes = fileSize
+	if info, e := os.Stat(absFilename); e == nil {
+		// The encoding may change the size of the text
+		b.lastSaveBytes = int(info.Size())
+	}
 
 	if !b.Settings["fastdirty"].(bool) {
 		if fileSize > LargeFileThreshold {
@@ -190,9 +570,17 @@ func (b *Buffer) saveToFile(filename string, withSudo bool) error {
 		}
 	}
 
+	oldPath := b.Path
 	b.Path = filename
 	absPath, _ := filepath.Abs(filename)
 	b.AbsPath = absPath
 	b.isModified = false
+	b.updateFileKey()
+	if filepath.Ext(oldPath) != filepath.Ext(filename) {
+		// The new extension may belong to another language
+		b.redetectFiletype()
+	}
+	// The clone now has a file of its own
+	b.clone = false
 	return err
 }
@@ -0,0 +1,681 @@
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zyedidia/micro/internal/config"
+)
+
+func TestSaveCopy(t *testing.T) {
+	path := tempFile(t, "orig.txt", "foo\nbar")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetOptionNative("fastdirty", false)
+	b.SetOptionNative("eofnewline", true)
+	b.SetOptionNative("fileformat", "dos")
+	b.Insert(Loc{0, 0}, "new ")
+
+	copyPath := filepath.Join(filepath.Dir(path), "copy.txt")
+	assert.Nil(t, b.SaveCopy(copyPath))
+
+	data, err := ioutil.ReadFile(copyPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "new foo\r\nbar\r\n", string(data))
+
+	assert.Equal(t, path, b.Path)
+	assert.True(t, b.Modified())
+	assert.Equal(t, 2, b.LinesNum())
+
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo\nbar", string(data))
+}
+
+func TestSaveRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	b := NewBufferFromString("one\ntwo\nthree\nfour", "", BTDefault)
+	b.SetOptionNative("fileformat", "dos")
+	path := filepath.Join(dir, "range.txt")
+
+	assert.Nil(t, b.SaveRange(path, Loc{2, 2}, Loc{1, 0}))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "ne\r\ntwo\r\nth", string(data))
+
+	b.SetOptionNative("eofnewline", true)
+	assert.Nil(t, b.SaveRange(path, b.Start(), b.End()))
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "one\r\ntwo\r\nthree\r\nfour\r\n", string(data))
+
+	assert.NotNil(t, b.SaveRange(path, Loc{0, 0}, Loc{0, 10}))
+	assert.Equal(t, "", b.Path)
+	assert.Equal(t, ErrPathIsDirectory, b.SaveRange(dir, Loc{0, 1}, Loc{2, 2}))
+
+	// Part of the buffer is written with the same options as all of it
+	b = NewBufferFromString("a\tb\r\n\tc\nd\n", "", BTDefault)
+	b.SetOptionNative("tabsize", float64(2))
+	b.SetOptionNative("eofnewline", true)
+	b.SetOptionNative("preserveeol", true)
+	assert.Nil(t, b.SetOption("tabstospacesonsave", "all"))
+	assert.Nil(t, b.SaveRange(path, Loc{0, 0}, Loc{2, 1}))
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "a b\r\n  c\n", string(data))
+}
+
+func TestTabsToSpacesOnSave(t *testing.T) {
+	path := tempFile(t, "tabs.txt", "")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	text := "\tif x {\n\t\ts := \"a\tb\"\n\t}"
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.Insert(b.Start(), text)
+
+	b.SetOptionNative("tabsize", float64(2))
+	assert.Nil(t, b.SetOption("tabstospacesonsave", "leading"))
+	assert.Nil(t, b.Save())
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "  if x {\n    s := \"a\tb\"\n  }", string(data))
+	assert.Equal(t, text, string(b.Bytes()))
+
+	assert.Nil(t, b.SetOption("tabstospacesonsave", "all"))
+	assert.Nil(t, b.Save())
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "  if x {\n    s := \"a b\"\n  }", string(data))
+	assert.Equal(t, text, string(b.Bytes()))
+
+	assert.NotNil(t, b.SetOption("tabstospacesonsave", "some"))
+}
+
+func TestSaveNoPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	b := NewBufferFromString("text", "", BTDefault)
+	defer b.Close()
+	assert.Equal(t, ErrNoPath, b.Save())
+	assert.Equal(t, "No name", b.GetName())
+
+	path := filepath.Join(dir, "real.txt")
+	assert.Nil(t, b.SaveAs(path))
+	assert.Equal(t, path, b.Path)
+	assert.False(t, b.Modified())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "text", string(data))
+	assert.Nil(t, b.Save())
+}
+
+func TestRename(t *testing.T) {
+	config.PluginAddRuntimeFileFromMemory(config.RTSyntax, "ftrename.yaml", `filetype: ftrename
+
+detect:
+    filename: "\\.ftr$"
+
+rules:
+    - statement: "\\bif\\b"
+`)
+
+	defer func(saveundo interface{}) {
+		config.GlobalSettings["saveundo"] = saveundo
+	}(config.GlobalSettings["saveundo"])
+	config.GlobalSettings["saveundo"] = true
+
+	path := tempFile(t, "orig.txt", "if x\n")
+	dir := filepath.Dir(path)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.Insert(Loc{0, 0}, "a")
+	assert.Nil(t, b.Save())
+	assert.NotEqual(t, "ftrename", b.Settings["filetype"])
+
+	oldHistory := b.serializedPath()
+	newPath := filepath.Join(dir, "renamed.ftr")
+	assert.Nil(t, b.Rename(newPath))
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(newPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "aif x\n", string(data))
+
+	assert.Equal(t, newPath, b.Path)
+	assert.Equal(t, "ftrename", b.Settings["filetype"])
+	assert.NotNil(t, b.SyntaxDef)
+
+	_, err = os.Stat(oldHistory)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(b.serializedPath())
+	assert.Nil(t, err)
+
+	// Renaming onto an existing file fails
+	other := filepath.Join(dir, "other.txt")
+	assert.Nil(t, ioutil.WriteFile(other, []byte("other"), 0644))
+	assert.NotNil(t, b.Rename(other))
+	assert.Equal(t, newPath, b.Path)
+}
+
+func TestRenameUnsaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	b := NewBufferFromString("foo", "", BTDefault)
+	path := filepath.Join(dir, "new.txt")
+	assert.Nil(t, b.Rename(path))
+	assert.Equal(t, path, b.Path)
+	assert.Equal(t, path, b.GetName())
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, b.Save())
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(data))
+}
+
+func TestSaveAsRedetectsFiletype(t *testing.T) {
+	config.AddRuntimeFilesFromAssets(config.RTSyntax, "runtime/syntax", "go.yaml")
+	config.AddRuntimeFilesFromAssets(config.RTSyntaxHeader, "runtime/syntax", "go.hdr")
+
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	b := NewBufferFromString("package foo\n", filepath.Join(dir, "foo.txt"), BTDefault)
+	assert.Equal(t, "unknown", b.Settings["filetype"])
+	assert.Nil(t, b.SaveAs(filepath.Join(dir, "foo.go")))
+	assert.Equal(t, "go", b.Settings["filetype"])
+	assert.NotNil(t, b.Highlighter)
+
+	// A filetype set by the user is kept
+	b = NewBufferFromString("package foo\n", filepath.Join(dir, "bar.txt"), BTDefault)
+	b.SetOptionNative("filetype", "off")
+	assert.Nil(t, b.SaveAs(filepath.Join(dir, "bar.go")))
+	assert.Equal(t, "off", b.Settings["filetype"])
+	assert.Nil(t, b.SyntaxDef)
+}
+
+func TestRenderForSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-buffer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		text     string
+		settings map[string]interface{}
+	}{
+		{"foo\nbar", nil},
+		{"foo  \n\tbar\t", map[string]interface{}{"rmtrailingws": true}},
+		{"foo\nbar", map[string]interface{}{"eofnewline": true, "fileformat": "dos"}},
+		{"foo \nb", map[string]interface{}{"eofnewline": true, "rmtrailingws": true}},
+		{"\tfoo\tbar\n", map[string]interface{}{"tabstospacesonsave": "leading"}},
+		{"héllo\nwörld", map[string]interface{}{"encoding": "utf-16", "eofnewline": true}},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, "render"+string(rune('a'+i))+".txt")
+		b := NewBufferFromString(test.text, "", BTDefault)
+		for k, v := range test.settings {
+			b.SetOptionNative(k, v)
+		}
+
+		before := string(b.Bytes())
+		rendered := b.RenderForSave()
+		assert.Equal(t, before, string(b.Bytes()))
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+
+		assert.Nil(t, b.SaveAs(path))
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), string(rendered))
+	}
+}
+
+func TestSaveRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"\n",
+		"foo",
+		"foo\n",
+		"foo\n\n",
+		"foo\nbar",
+		"foo\nbar\n",
+		"foo\r\nbar",
+		"foo\r\nbar\r\n",
+		"é",
+	}
+
+	for _, text := range tests {
+		path := tempFile(t, "roundtrip.txt", text)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		for i := 0; i < 2; i++ {
+			b, err := NewBufferFromFile(path, BTDefault)
+			assert.Nil(t, err)
+			assert.Nil(t, b.Save())
+			assert.Nil(t, b.Close())
+
+			data, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Equal(t, text, string(data))
+		}
+	}
+}
+
+func TestSaveEOFNewline(t *testing.T) {
+	tests := []struct {
+		text, saved string
+	}{
+		{"", ""},
+		{"a", "a\n"},
+		{"é", "é\n"},
+		{"foo\n", "foo\n"},
+		{"foo\r\nbar", "foo\r\nbar\r\n"},
+	}
+
+	for _, test := range tests {
+		path := tempFile(t, "eofnewline.txt", test.text)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		for i := 0; i < 2; i++ {
+			b, err := NewBufferFromFile(path, BTDefault)
+			assert.Nil(t, err)
+			b.SetOptionNative("eofnewline", true)
+			assert.Nil(t, b.Save())
+			assert.Nil(t, b.Close())
+
+			data, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Equal(t, test.saved, string(data))
+		}
+	}
+}
+
+func TestSaveEOFNewlineIdempotent(t *testing.T) {
+	tests := []string{"foo\n", "foo", "foo\n\n", "foo\n  ", "foo\r\nbar\r\n", "\n"}
+
+	for _, text := range tests {
+		path := tempFile(t, "idempotent.txt", text)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		b, err := NewBufferFromFile(path, BTDefault)
+		assert.Nil(t, err)
+		b.SetOptionNative("eofnewline", true)
+
+		var sizes []int64
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, b.Save())
+			info, err := os.Stat(path)
+			assert.Nil(t, err)
+			sizes = append(sizes, info.Size())
+		}
+		assert.Nil(t, b.Close())
+
+		assert.Equal(t, sizes[0], sizes[1], text)
+		assert.Equal(t, sizes[1], sizes[2], text)
+		if text == "foo\n" {
+			assert.Equal(t, int64(len(text)), sizes[0])
+		}
+	}
+}
+
+func TestLineSeparator(t *testing.T) {
+	defer func(sep interface{}) {
+		config.GlobalSettings["lineseparator"] = sep
+	}(config.GlobalSettings["lineseparator"])
+	config.GlobalSettings["lineseparator"] = "\x00"
+
+	path := tempFile(t, "files.lst", "one\x00two\x00three\x00")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Equal(t, 4, b.LinesNum())
+	assert.Equal(t, "two", string(b.LineBytes(1)))
+
+	assert.Nil(t, b.ReplaceInLine(1, 0, 3, "TWO"))
+	b.Insert(b.End(), "four")
+	assert.Nil(t, b.Save())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "one\x00TWO\x00three\x00four", string(data))
+}
+
+func TestLineSeparatorNewlines(t *testing.T) {
+	defer func(sep interface{}) {
+		config.GlobalSettings["lineseparator"] = sep
+	}(config.GlobalSettings["lineseparator"])
+	config.GlobalSettings["lineseparator"] = "\x00"
+
+	text := "one\x00two\nlines\x00three\x00"
+	path := tempFile(t, "newlines.lst", text)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	// Saving would turn the newline into a separator
+	assert.Equal(t, ErrSeparatorNewlines, b.Save())
+	assert.Equal(t, ErrSeparatorNewlines, b.SaveCopy(path+".copy"))
+	assert.Equal(t, ErrSeparatorNewlines, b.SaveRange(path+".copy", Loc{0, 1}, Loc{2, 2}))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, text, string(data))
+
+	// The file can be saved once its records no longer contain newlines
+	assert.Nil(t, ioutil.WriteFile(path, []byte("one\x00two\x00"), 0644))
+	assert.Nil(t, b.ReOpen())
+	b.Insert(b.End(), "three")
+	assert.Nil(t, b.Save())
+}
+
+func TestSeparatorReaderError(t *testing.T) {
+	r, err := separatorReader(iotest.TimeoutReader(strings.NewReader("a\x00b\x00")), "\x00")
+	assert.Equal(t, iotest.ErrTimeout, err)
+	data, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "a\nb\n", string(data))
+}
+
+func TestMaxTrailingBlankLines(t *testing.T) {
+	tests := []struct {
+		text       string
+		max        float64
+		eofnewline bool
+		saved      string
+	}{
+		{"a\n\nb\n\n\n\n\n\n", 1, false, "a\n\nb\n\n"},
+		{"a\n\nb\n\n\n\n\n\n", 0, false, "a\n\nb\n"},
+		{"a\n\nb\n\n\n\n\n\n", -1, false, "a\n\nb\n\n\n\n\n\n"},
+		{"a\n\nb\n\n\n\n\n\n", 10, false, "a\n\nb\n\n\n\n\n\n"},
+		// Without a final newline none is added, unless eofnewline is on
+		{"a\n \n\t", 0, false, "a"},
+		{"a\n \n\t", 0, true, "a\n"},
+		{"a\n \n\t", 1, true, "a\n \n"},
+		{"\n\n\n", 1, false, "\n"},
+	}
+
+	for _, test := range tests {
+		b := NewBufferFromString(test.text, "", BTDefault)
+		b.SetOptionNative("maxtrailingblanklines", test.max)
+		b.SetOptionNative("eofnewline", test.eofnewline)
+		assert.Equal(t, test.saved, string(b.RenderForSave()))
+	}
+}
+
+func TestSaveWouldChangeFile(t *testing.T) {
+	path := tempFile(t, "wouldchange.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetOptionNative("eofnewline", true)
+
+	changed, err := b.SaveWouldChangeFile()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	// Saving adds the newline back
+	b.Remove(Loc{3, 0}, b.End())
+	assert.True(t, b.Modified())
+	changed, err = b.SaveWouldChangeFile()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	b.Insert(b.End(), "bar")
+	changed, err = b.SaveWouldChangeFile()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	// The buffer is unmodified, but the file was changed by another program
+	assert.Nil(t, b.ReOpen())
+	assert.False(t, b.Modified())
+	assert.Nil(t, ioutil.WriteFile(path, []byte("other\n"), 0644))
+	changed, err = b.SaveWouldChangeFile()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	assert.Nil(t, os.Remove(path))
+	changed, err = b.SaveWouldChangeFile()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	b = NewBufferFromString("foo", "", BTDefault)
+	changed, err = b.SaveWouldChangeFile()
+	assert.Equal(t, ErrNoPath, err)
+	assert.True(t, changed)
+}
+
+func TestSaveToDirectory(t *testing.T) {
+	path := tempFile(t, "dir.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.Insert(b.End(), "bar\n")
+
+	// The file is replaced by a directory while it is open
+	assert.Nil(t, os.Remove(path))
+	assert.Nil(t, os.Mkdir(path, 0755))
+	assert.Equal(t, ErrPathIsDirectory, b.Save())
+	assert.True(t, b.Modified())
+
+	// It can still be saved somewhere else
+	other := filepath.Join(filepath.Dir(path), "other.txt")
+	assert.Nil(t, b.SaveAs(other))
+	data, err := ioutil.ReadFile(other)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo\nbar\n", string(data))
+}
+
+func TestSaveHooks(t *testing.T) {
+	path := tempFile(t, "hooks.txt", "old\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetOptionNative("rmtrailingws", true)
+
+	abort := errors.New("aborted")
+	var seen string
+	var result error
+	b.OnBeforeSave = func() error {
+		seen = string(b.Bytes())
+		return abort
+	}
+	b.OnAfterSave = func(err error) {
+		result = err
+	}
+
+	b.Replace(b.Start(), b.End(), "new  \n")
+	assert.Equal(t, abort, b.Save())
+	assert.Equal(t, "new\n", seen)
+	assert.Equal(t, abort, result)
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "old\n", string(data))
+
+	b.OnBeforeSave = func() error {
+		b.Insert(b.Start(), "// saved\n")
+		return nil
+	}
+	assert.Nil(t, b.Save())
+	assert.Nil(t, result)
+	data, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "// saved\nnew\n", string(data))
+
+	b.Type.Readonly = true
+	assert.NotNil(t, b.Save())
+	assert.NotNil(t, result)
+}
+
+func TestRmTrailingWSExclude(t *testing.T) {
+	config.GlobalSettings["rmtrailingwsexclude"] = []interface{}{"markdown"}
+	defer func() {
+		config.GlobalSettings["rmtrailingwsexclude"] = []interface{}{}
+	}()
+
+	b := NewBufferFromString("func f() {  \n}\n", "", BTDefault)
+	b.SetOptionNative("filetype", "go")
+	b.SetOptionNative("rmtrailingws", true)
+	assert.Equal(t, "func f() {\n}\n", string(b.RenderForSave()))
+
+	b = NewBufferFromString("line  \nbreak\n", "", BTDefault)
+	b.SetOptionNative("filetype", "markdown")
+	b.SetOptionNative("rmtrailingws", true)
+	assert.Equal(t, "line  \nbreak\n", string(b.RenderForSave()))
+}
+
+func TestEOFNewlineExclude(t *testing.T) {
+	config.GlobalSettings["eofnewlineexclude"] = []interface{}{"json"}
+	defer func() {
+		config.GlobalSettings["eofnewlineexclude"] = []interface{}{}
+	}()
+	dir, err := ioutil.TempDir("", "micro-eofnewline")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		ft, name, text, saved string
+	}{
+		{"go", "main.go", "package main", "package main\n"},
+		{"json", "data.json", "{}", "{}"},
+	} {
+		b := NewBufferFromString(test.text, "", BTDefault)
+		b.SetOptionNative("filetype", test.ft)
+		b.SetOptionNative("eofnewline", true)
+		path := filepath.Join(dir, test.name)
+		assert.Nil(t, b.SaveAs(path))
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, test.saved, string(data))
+		b.Close()
+	}
+}
+
+func TestPreserveEOL(t *testing.T) {
+	path := tempFile(t, "mixed.txt", "a\r\nb\nc\r\nd\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.SetOptionNative("fileformat", "dos")
+	b.SetOptionNative("preserveeol", true)
+	b.SetOptionNative("undogroupwindow", float64(0))
+
+	b.Insert(Loc{1, 1}, "x")
+	b.Insert(Loc{0, 3}, "new\n")
+	assert.Nil(t, b.Save())
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "a\r\nbx\nc\r\nnew\r\nd\n", string(data))
+
+	// Joining two lines keeps the line ending of the second one
+	b.Remove(Loc{1, 0}, Loc{0, 1})
+	assert.Equal(t, "abx\nc\r\nnew\r\nd\n", string(b.RenderForSave()))
+
+	// Undoing the join restores the line ending of the first line
+	b.Undo()
+	assert.Equal(t, "a\r\nbx\nc\r\nnew\r\nd\n", string(b.RenderForSave()))
+	b.Redo()
+	assert.Equal(t, "abx\nc\r\nnew\r\nd\n", string(b.RenderForSave()))
+	b.Undo()
+	b.MultipleReplace([]Delta{{[]byte("z"), Loc{0, 0}, Loc{1, 2}, nil}})
+	assert.Equal(t, "z\r\nnew\r\nd\n", string(b.RenderForSave()))
+	b.Undo()
+	assert.Equal(t, "a\r\nbx\nc\r\nnew\r\nd\n", string(b.RenderForSave()))
+	b.Remove(Loc{1, 0}, Loc{0, 1})
+
+	b.SetOptionNative("preserveeol", false)
+	assert.Equal(t, "abx\r\nc\r\nnew\r\nd\r\n", string(b.RenderForSave()))
+}
+
+func TestLastSaveInfo(t *testing.T) {
+	path := tempFile(t, "lastsave.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	at, duration, n := b.LastSaveInfo()
+	assert.True(t, at.IsZero())
+	assert.Equal(t, time.Duration(0), duration)
+	assert.Equal(t, 0, n)
+
+	before := time.Now()
+	b.Insert(b.End(), "bar\n")
+	assert.Nil(t, b.Save())
+
+	at, duration, n = b.LastSaveInfo()
+	assert.False(t, at.Before(before))
+	assert.False(t, at.After(time.Now()))
+	assert.True(t, duration >= 0)
+	assert.Equal(t, 8, n)
+
+	// A failed save doesn't change it
+	assert.NotNil(t, b.SaveAs(filepath.Dir(path)))
+	at2, duration2, n2 := b.LastSaveInfo()
+	assert.Equal(t, at, at2)
+	assert.Equal(t, duration, duration2)
+	assert.Equal(t, n, n2)
+}
+
+func TestWriteRange(t *testing.T) {
+	b := NewBufferFromString("héllo\nwörld\nfoo\nbar", "", BTDefault)
+
+	var out bytes.Buffer
+	assert.Nil(t, b.WriteRange(&out, Loc{2, 0}, Loc{2, 2}))
+	assert.Equal(t, "llo\nwörld\nfo", out.String())
+	assert.Equal(t, string(b.Substr(Loc{2, 0}, Loc{2, 2})), out.String())
+
+	// Reversed range
+	out.Reset()
+	assert.Nil(t, b.WriteRange(&out, Loc{3, 1}, Loc{1, 1}))
+	assert.Equal(t, "ör", out.String())
+
+	out.Reset()
+	assert.Nil(t, b.WriteRange(&out, b.Start(), b.End()))
+	assert.Equal(t, "héllo\nwörld\nfoo\nbar", out.String())
+
+	b.SetOptionNative("fileformat", "dos")
+	out.Reset()
+	assert.Nil(t, b.WriteRange(&out, Loc{5, 0}, Loc{0, 3}))
+	assert.Equal(t, "\r\nwörld\r\nfoo\r\n", out.String())
+
+	assert.NotNil(t, b.WriteRange(&out, Loc{0, 0}, Loc{0, 4}))
+	assert.NotNil(t, b.WriteRange(&out, Loc{0, 0}, Loc{6, 0}))
+}
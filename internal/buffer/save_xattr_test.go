@@ -0,0 +1,34 @@
+// +build linux
+
+package buffer
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Saving writes over the file in place instead of renaming a temporary file
+// over it, so the extended attributes of the file are kept
+func TestSaveKeepsXattrs(t *testing.T) {
+	path := tempFile(t, "xattr.txt", "foo\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := syscall.Setxattr(path, "user.micro.test", []byte("value"), 0); err != nil {
+		t.Skip("extended attributes are not supported:", err)
+	}
+
+	b, err := NewBufferFromFile(path, BTDefault)
+	assert.Nil(t, err)
+	defer b.Close()
+	b.Insert(b.End(), "bar\n")
+	assert.Nil(t, b.Save())
+
+	value := make([]byte, 16)
+	n, err := syscall.Getxattr(path, "user.micro.test", value)
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value[:n]))
+}
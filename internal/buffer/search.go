@@ -2,8 +2,10 @@ package buffer
 
 import (
 	"regexp"
+	"sort"
 	"unicode/utf8"
 
+	runewidth "github.com/mattn/go-runewidth"
 	"github.com/zyedidia/micro/internal/util"
 )
 
@@ -37,6 +39,13 @@ func (b *Buffer) findDown(r *regexp.Regexp, start, end Loc) ([2]Loc, bool) {
 			l = util.SliceStart(l, end.X)
 		}
 
+		if b.Settings["searchexpandtabs"].(bool) {
+			if m, ok := b.findExpanded(r, i, charpos, charpos+utf8.RuneCount(l)); ok {
+				return m, true
+			}
+			continue
+		}
+
 		match := r.FindIndex(l)
 
 		if match != nil {
@@ -78,6 +87,13 @@ func (b *Buffer) findUp(r *regexp.Regexp, start, end Loc) ([2]Loc, bool) {
 			l = util.SliceStart(l, end.X)
 		}
 
+		if b.Settings["searchexpandtabs"].(bool) {
+			if m, ok := b.findExpanded(r, i, charpos, charpos+utf8.RuneCount(l)); ok {
+				return m, true
+			}
+			continue
+		}
+
 		match := r.FindIndex(l)
 
 		if match != nil {
@@ -89,6 +105,43 @@ func (b *Buffer) findUp(r *regexp.Regexp, start, end Loc) ([2]Loc, bool) {
 	return [2]Loc{}, false
 }
 
+// expandLine returns line with its tabs expanded to spaces, and the offset in
+// the expanded line at which each of its runes starts, followed by the length
+// of the expanded line
+func expandLine(line []byte, tabsize int) ([]byte, []int) {
+	expanded := make([]byte, 0, len(line))
+	offsets := make([]int, 0, len(line)+1)
+	width := 0
+	for _, r := range string(line) {
+		offsets = append(offsets, len(expanded))
+		if r == '\t' {
+			ts := tabsize - (width % tabsize)
+			expanded = append(expanded, util.Spaces(ts)...)
+			width += ts
+		} else {
+			expanded = append(expanded, string(r)...)
+			width += runewidth.RuneWidth(r)
+		}
+	}
+	return expanded, append(offsets, len(expanded))
+}
+
+// findExpanded finds the first match of r between startX and endX of line y
+// when the tabs of the line are expanded, for the searchexpandtabs option
+// A match that starts or ends in the middle of a tab includes the whole tab
+func (b *Buffer) findExpanded(r *regexp.Regexp, y, startX, endX int) ([2]Loc, bool) {
+	line, offsets := expandLine(b.LineBytes(y), util.IntOpt(b.Settings["tabsize"]))
+	for _, m := range r.FindAllIndex(line, -1) {
+		if m[0] < offsets[startX] || m[1] > offsets[endX] {
+			continue
+		}
+		start := sort.SearchInts(offsets, m[0]+1) - 1
+		end := sort.SearchInts(offsets, m[1])
+		return [2]Loc{{start, y}, {end, y}}, true
+	}
+	return [2]Loc{}, false
+}
+
 // FindNext finds the next occurrence of a given string in the buffer
 // It returns the start and end location of the match (if found) and
 // a boolean indicating if it was found
@@ -162,7 +215,7 @@ func (b *Buffer) ReplaceRegex(start, end Loc, search *regexp.Regexp, replace []b
 		from := Loc{charpos, i}
 		to := Loc{charpos + utf8.RuneCount(l), i}
 
-		deltas = append(deltas, Delta{newText, from, to})
+		deltas = append(deltas, Delta{newText, from, to, nil})
 	}
 	b.MultipleReplace(deltas)
 
@@ -0,0 +1,43 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindNextExpandTabs(t *testing.T) {
+	b := NewBufferFromString("func f() {\n\tif x {\n\t\treturn\n  \tend\n\t}\n}\n", "", BTDefault)
+	b.SetOptionNative("tabsize", float64(4))
+
+	find := func(s string, from Loc) ([2]Loc, bool) {
+		m, found, err := b.FindNext(s, b.Start(), b.End(), from, true, true)
+		assert.Nil(t, err)
+		return m, found
+	}
+
+	// Without expansion the tabs don't match spaces
+	m, found := find("^  +", Loc{0, 1})
+	assert.True(t, found)
+	assert.Equal(t, [2]Loc{{0, 3}, {2, 3}}, m)
+
+	b.SetOptionNative("searchexpandtabs", true)
+	m, found = find("^  +", Loc{0, 1})
+	assert.True(t, found)
+	assert.Equal(t, [2]Loc{{0, 1}, {1, 1}}, m)
+	m, _ = find("^  +", Loc{0, 2})
+	assert.Equal(t, [2]Loc{{0, 2}, {2, 2}}, m)
+	// Two spaces and a tab expand to four spaces
+	m, _ = find("^  +", Loc{0, 3})
+	assert.Equal(t, [2]Loc{{0, 3}, {3, 3}}, m)
+
+	// A match in part of a tab includes the tab
+	m, _ = find("^ {6}", Loc{0, 2})
+	assert.Equal(t, [2]Loc{{0, 2}, {2, 2}}, m)
+	m, _ = find("return", Loc{0, 0})
+	assert.Equal(t, [2]Loc{{2, 2}, {8, 2}}, m)
+
+	// Matches before the start of the search are skipped
+	m, _ = find(" ", Loc{1, 2})
+	assert.Equal(t, [2]Loc{{1, 2}, {2, 2}}, m)
+}
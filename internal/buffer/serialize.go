@@ -2,9 +2,12 @@ package buffer
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"golang.org/x/text/encoding"
@@ -14,62 +17,314 @@ import (
 )
 
 // The SerializedBuffer holds the types that get serialized when a buffer is saved
-// These are used for the savecursor and saveundo options
+// These are used for the savecursor, saveundo and savefolds options
+// Locations count lines and runes and the text of events always uses '\n' for
+// newlines, so the serialized data stays valid when the file format of the
+// file changes between sessions
 type SerializedBuffer struct {
 	EventHandler *EventHandler
 	Cursor       Loc
 	ModTime      time.Time
+	Folds        []FoldRange
+	// Path is the absolute path of the file, which can't always be recovered
+	// from the name of the serialized file
+	Path string
+}
+
+// savesHistory returns whether any of the options that save information about
+// the file in config.ConfigDir/buffers is on
+func (b *Buffer) savesHistory() bool {
+	return b.Settings["savecursor"].(bool) || b.Settings["saveundo"].(bool) || b.Settings["savefolds"].(bool)
 }
 
 // Serialize serializes the buffer to config.ConfigDir/buffers
 func (b *Buffer) Serialize() error {
-	if !b.Settings["savecursor"].(bool) && !b.Settings["saveundo"].(bool) {
+	if !b.savesHistory() {
 		return nil
 	}
-	if b.Path == "" {
+	if b.Path == "" || b.clone || config.NoHistoryPath(b.AbsPath) {
 		return nil
 	}
 
-	name := config.ConfigDir + "/buffers/" + util.EscapePath(b.AbsPath)
+	var folds []FoldRange
+	if b.Settings["savefolds"].(bool) {
+		folds = b.folds
+	}
+
+	return b.writeSerialized(SerializedBuffer{
+		b.EventHandler,
+		b.serializedCursor(),
+		b.ModTime,
+		folds,
+		b.AbsPath,
+	})
+}
 
-	return overwriteFile(name, encoding.Nop, func(file io.Writer) error {
-		err := gob.NewEncoder(file).Encode(SerializedBuffer{
-			b.EventHandler,
-			b.GetActiveCursor().Loc,
-			b.ModTime,
-		})
+// SerializeNow serializes the buffer even if it has unsaved changes, so that
+// it can be called when micro is about to exit (because of a signal or a
+// crash for example)
+// The undo history of a modified buffer doesn't match the file on disk, so for
+// modified buffers only the cursor is updated and the history and folds that
+// were serialized when the buffer was last saved are kept
+func (b *Buffer) SerializeNow() error {
+	if !b.Modified() {
+		return b.Serialize()
+	}
+	if !b.savesHistory() {
+		return nil
+	}
+	if b.Path == "" || b.clone || config.NoHistoryPath(b.AbsPath) {
+		return nil
+	}
+
+	// If there is no serialized history the zero ModTime makes sure that
+	// no undo history is loaded from the file
+	buffer, _ := b.readSerialized()
+	buffer.Cursor = b.serializedCursor()
+	buffer.Path = b.AbsPath
+	return b.writeSerialized(buffer)
+}
+
+// serializedCursor returns the location of the cursor that should be
+// serialized
+// A buffer that is being created or torn down may have no cursors
+func (b *Buffer) serializedCursor() Loc {
+	if b.curCursor >= 0 && b.curCursor < len(b.cursors) {
+		return b.GetActiveCursor().Loc
+	}
+	return b.StartCursor
+}
+
+// maxHistoryNameLen is the longest name of a file in config.ConfigDir/buffers
+// The history of files with longer escaped paths is stored under the hash of
+// the path
+const maxHistoryNameLen = 255
+
+// historyIndex is the file in config.ConfigDir/buffers that maps the hashed
+// names of history files to the paths of the files they belong to
+const historyIndex = "index.json"
+
+// serializedPath returns the path of the file the buffer is serialized to
+func (b *Buffer) serializedPath() string {
+	name, _ := util.EscapePathLimited(b.AbsPath, maxHistoryNameLen)
+	return config.ConfigDir + "/buffers/" + name
+}
+
+// readHistoryIndex reads the mapping from hashed history file names to the
+// paths of the files they belong to
+func readHistoryIndex() map[string]string {
+	index := make(map[string]string)
+	data, err := ioutil.ReadFile(config.ConfigDir + "/buffers/" + historyIndex)
+	if err == nil {
+		json.Unmarshal(data, &index)
+	}
+	return index
+}
+
+// writeHistoryIndex writes the mapping from hashed history file names to the
+// paths of the files they belong to
+func writeHistoryIndex(index map[string]string) error {
+	data, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
 		return err
+	}
+	return ioutil.WriteFile(config.ConfigDir+"/buffers/"+historyIndex, append(data, '\n'), 0644)
+}
+
+// writeSerialized writes the given info to the buffer's serialized file
+func (b *Buffer) writeSerialized(buffer SerializedBuffer) error {
+	if name, hashed := util.EscapePathLimited(b.AbsPath, maxHistoryNameLen); hashed {
+		index := readHistoryIndex()
+		if index[name] != b.AbsPath {
+			index[name] = b.AbsPath
+			if err := writeHistoryIndex(index); err != nil {
+				return err
+			}
+		}
+	}
+
+	return overwriteFile(b.serializedPath(), encoding.Nop, func(file io.Writer) error {
+		return gob.NewEncoder(file).Encode(buffer)
 	}, false)
 }
 
+// readSerialized reads the info from the buffer's serialized file
+func (b *Buffer) readSerialized() (SerializedBuffer, error) {
+	var buffer SerializedBuffer
+	file, err := os.Open(b.serializedPath())
+	if err != nil {
+		return buffer, err
+	}
+	defer file.Close()
+
+	err = gob.NewDecoder(file).Decode(&buffer)
+	return buffer, err
+}
+
+// moveSerialized moves the serialized file of the buffer from the name it had
+// when the buffer's path was oldAbsPath to the name for its current path
+func (b *Buffer) moveSerialized(oldAbsPath string) error {
+	oldName, oldHashed := util.EscapePathLimited(oldAbsPath, maxHistoryNameLen)
+	newName, newHashed := util.EscapePathLimited(b.AbsPath, maxHistoryNameLen)
+	if oldName == newName {
+		return nil
+	}
+	oldFile := config.ConfigDir + "/buffers/" + oldName
+	if _, err := os.Stat(oldFile); err != nil {
+		return nil
+	}
+	if err := os.Rename(oldFile, b.serializedPath()); err != nil {
+		return err
+	}
+
+	if oldHashed || newHashed {
+		index := readHistoryIndex()
+		delete(index, oldName)
+		if newHashed {
+			index[newName] = b.AbsPath
+		}
+		return writeHistoryIndex(index)
+	}
+	return nil
+}
+
 // Unserialize loads the buffer info from config.ConfigDir/buffers
 func (b *Buffer) Unserialize() error {
-	// If either savecursor or saveundo is turned on, we need to load the serialized information
+	// If either savecursor, saveundo or savefolds is turned on, we need to load the serialized information
 	// from ~/.config/micro/buffers
-	if b.Path == "" {
+	if b.Path == "" || b.clone || config.NoHistoryPath(b.AbsPath) {
 		return nil
 	}
-	file, err := os.Open(config.ConfigDir + "/buffers/" + util.EscapePath(b.AbsPath))
-	defer file.Close()
-	if err == nil {
-		var buffer SerializedBuffer
-		decoder := gob.NewDecoder(file)
-		err = decoder.Decode(&buffer)
-		if err != nil {
-			return errors.New(err.Error() + "\nYou may want to remove the files in ~/.config/micro/buffers (these files\nstore the information for the 'saveundo' and 'savecursor' options) if\nthis problem persists.\nThis may be caused by upgrading to version 2.0, and removing the 'buffers'\ndirectory will reset the cursor and undo history and solve the problem.")
+	if _, err := os.Stat(b.serializedPath()); err != nil {
+		return nil
+	}
+
+	buffer, err := b.readSerialized()
+	if err != nil {
+		return errors.New(err.Error() + "\nYou may want to remove the files in ~/.config/micro/buffers (these files\nstore the information for the 'saveundo' and 'savecursor' options) if\nthis problem persists.\nThis may be caused by upgrading to version 2.0, and removing the 'buffers'\ndirectory will reset the cursor and undo history and solve the problem.")
+	}
+	if b.Settings["savecursor"].(bool) {
+		b.StartCursor = buffer.Cursor
+	}
+
+	if b.Settings["saveundo"].(bool) {
+		// We should only use last time's eventhandler if the file wasn't modified by someone else in the meantime
+		if b.ModTime == buffer.ModTime && buffer.EventHandler != nil {
+			b.EventHandler = buffer.EventHandler
+			b.EventHandler.cursors = b.cursors
+			b.EventHandler.buf = b.SharedBuffer
+		}
+	}
+
+	// The folds are dropped if the file was changed since they were saved
+	if b.Settings["savefolds"].(bool) && b.ModTime == buffer.ModTime {
+		b.SetFolds(buffer.Folds)
+	}
+	return nil
+}
+
+// A HistoryEntry describes the serialized cursor and undo history of a file
+type HistoryEntry struct {
+	// Path of the file that the history belongs to (empty if it is unknown)
+	Path string
+	// Path of the history file in config.ConfigDir/buffers
+	File string
+	// Size of the history file in bytes
+	Size int64
+	// Time at which the history was last written
+	LastUsed time.Time
+}
+
+// ListHistoryEntries returns the entries of the cursor and undo history in
+// config.ConfigDir/buffers
+func ListHistoryEntries() []HistoryEntry {
+	dir := filepath.Join(config.ConfigDir, "buffers")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	index := readHistoryIndex()
+	var entries []HistoryEntry
+	for _, f := range files {
+		if !f.Mode().IsRegular() || f.Name() == historyIndex {
+			continue
+		}
+
+		path, ok := index[f.Name()]
+		if !ok {
+			path = historyPath(filepath.Join(dir, f.Name()))
+		}
+		entries = append(entries, HistoryEntry{
+			Path:     path,
+			File:     filepath.Join(dir, f.Name()),
+			Size:     f.Size(),
+			LastUsed: f.ModTime(),
+		})
+	}
+	return entries
+}
+
+// historyPath returns the path of the file that the history file belongs to,
+// as stored in the history itself
+// Escaped names can't be decoded reliably (a % in the name may have been a %
+// in the path), so the path is empty if the history doesn't store it or
+// doesn't match the name of the history file
+func historyPath(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var buffer SerializedBuffer
+	if gob.NewDecoder(f).Decode(&buffer) != nil || buffer.Path == "" {
+		return ""
+	}
+	if name, _ := util.EscapePathLimited(buffer.Path, maxHistoryNameLen); name != filepath.Base(file) {
+		return ""
+	}
+	return buffer.Path
+}
+
+// PruneHistory removes the history entries whose file no longer exists, or
+// that haven't been used for longer than olderThan (if it is positive)
+// Entries whose file is unknown are only removed because of their age
+// It returns the number of entries that were removed
+func PruneHistory(olderThan time.Duration) (removed int, err error) {
+	cutoff := time.Now().Add(-olderThan)
+	index := readHistoryIndex()
+	indexChanged := false
+
+	for _, e := range ListHistoryEntries() {
+		stale := olderThan > 0 && e.LastUsed.Before(cutoff)
+		if !stale && e.Path != "" {
+			_, statErr := os.Stat(e.Path)
+			stale = os.IsNotExist(statErr)
 		}
-		if b.Settings["savecursor"].(bool) {
-			b.StartCursor = buffer.Cursor
+		if !stale {
+			continue
 		}
 
-		if b.Settings["saveundo"].(bool) {
-			// We should only use last time's eventhandler if the file wasn't modified by someone else in the meantime
-			if b.ModTime == buffer.ModTime {
-				b.EventHandler = buffer.EventHandler
-				b.EventHandler.cursors = b.cursors
-				b.EventHandler.buf = b.SharedBuffer
+		if rmErr := os.Remove(e.File); rmErr != nil {
+			if err == nil {
+				err = rmErr
 			}
+			continue
+		}
+		removed++
+
+		name := filepath.Base(e.File)
+		if _, ok := index[name]; ok {
+			delete(index, name)
+			indexChanged = true
 		}
 	}
-	return nil
+
+	if indexChanged {
+		if idxErr := writeHistoryIndex(index); idxErr != nil && err == nil {
+			err = idxErr
+		}
+	}
+	return removed, err
 }
@@ -18,6 +18,8 @@ func (b *Buffer) SetOptionNative(option string, nativeValue interface{}) error {
 	} else if option == "statusline" {
 		screen.Redraw()
 	} else if option == "filetype" {
+		ft := nativeValue.(string)
+		b.ftUserSet = ft != "unknown" && ft != ""
 		b.UpdateRules()
 	} else if option == "fileformat" {
 		switch b.Settings["fileformat"].(string) {
@@ -37,6 +39,8 @@ func (b *Buffer) SetOptionNative(option string, nativeValue interface{}) error {
 		b.isModified = true
 	} else if option == "readonly" {
 		b.Type.Readonly = nativeValue.(bool)
+	} else if option == "undogroupwindow" {
+		b.EventHandler.groupWindow = undoGroupWindow(b.Settings)
 	}
 
 	return nil
@@ -0,0 +1,61 @@
+package buffer
+
+// A BufferSnapshot is a copy of the text, cursors and modified status of a
+// buffer at some point, which the buffer can be restored to later
+type BufferSnapshot struct {
+	lines     []string
+	cursors   []Cursor
+	curCursor int
+	modified  bool
+}
+
+// Snapshot returns a snapshot of the buffer, which can be used as a point to
+// go back to with Restore (for example before a risky operation)
+// Snapshots are independent of the undo stack
+func (b *Buffer) Snapshot() *BufferSnapshot {
+	s := &BufferSnapshot{
+		lines:     make([]string, len(b.lines)),
+		cursors:   make([]Cursor, len(b.cursors)),
+		curCursor: b.curCursor,
+		modified:  b.Modified(),
+	}
+	for i, l := range b.lines {
+		s.lines[i] = string(l.data)
+	}
+	for i, c := range b.cursors {
+		s.cursors[i] = *c
+	}
+	return s
+}
+
+// Restore changes the text, cursors and modified status of the buffer back to
+// the snapshot
+// The text is changed as a single undoable event, so the restore itself can be
+// undone
+func (b *Buffer) Restore(s *BufferSnapshot) {
+	if b.Type.Readonly {
+		return
+	}
+
+	b.SetLines(s.lines)
+
+	for len(b.cursors) > len(s.cursors) {
+		b.RemoveCursor(len(b.cursors) - 1)
+	}
+	for i := range s.cursors {
+		if i < len(b.cursors) {
+			b.cursors[i].Goto(s.cursors[i])
+		} else {
+			c := NewCursor(b, s.cursors[i].Loc)
+			c.Goto(s.cursors[i])
+			b.AddCursor(c)
+		}
+	}
+	b.SetCurCursor(s.curCursor)
+	b.UpdateCursors()
+	b.RelocateCursors()
+
+	if b.Settings["fastdirty"].(bool) {
+		b.isModified = s.modified
+	}
+}
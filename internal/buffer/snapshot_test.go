@@ -0,0 +1,47 @@
+package buffer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	text := "first line\nsecond line\nthird line\n"
+	b := NewBufferFromString(text, "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+	b.GetActiveCursor().GotoLoc(Loc{3, 1})
+	c := NewCursor(b, Loc{5, 2})
+	c.SetSelectionStart(Loc{0, 2})
+	c.SetSelectionEnd(Loc{5, 2})
+	b.AddCursor(c)
+	b.SetCurCursor(1)
+
+	s := b.Snapshot()
+
+	b.Insert(Loc{0, 0}, strings.Repeat("inserted\n", 100))
+	b.Remove(Loc{0, 101}, Loc{0, 102})
+	b.Replace(Loc{0, 0}, Loc{5, 0}, "changed")
+	b.ClearCursors()
+	b.GetActiveCursor().GotoLoc(Loc{2, 50})
+	assert.True(t, b.Modified())
+
+	b.Restore(s)
+	assert.Equal(t, text, string(b.Bytes()))
+	assert.False(t, b.Modified())
+	assert.Equal(t, 2, b.NumCursors())
+	assert.Equal(t, 1, b.GetActiveCursor().Num)
+	assert.Equal(t, Loc{3, 1}, b.GetCursor(0).Loc)
+	assert.Equal(t, Loc{5, 2}, b.GetCursor(1).Loc)
+	assert.Equal(t, "third", string(b.GetCursor(1).GetSelection()))
+
+	// The restore can be undone, and the snapshot is not changed by edits
+	b.Undo()
+	assert.Equal(t, 103, b.LinesNum())
+	b.Redo()
+	assert.Equal(t, text, string(b.Bytes()))
+	b.Insert(Loc{0, 0}, "x")
+	b.Restore(s)
+	assert.Equal(t, text, string(b.Bytes()))
+}
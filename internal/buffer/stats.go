@@ -0,0 +1,132 @@
+package buffer
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// BufferStats holds the statistics of some text in a buffer
+// Line breaks count as one rune and one byte
+type BufferStats struct {
+	Lines int
+	Words int
+	Runes int
+	Bytes int
+}
+
+// Stats returns the statistics of the whole buffer
+func (b *Buffer) Stats() BufferStats {
+	return b.StatsRange(b.Start(), b.End())
+}
+
+// StatsRange returns the statistics of the text between start and end
+// Words are the runs of characters that are separated by whitespace
+func (b *Buffer) StatsRange(start, end Loc) BufferStats {
+	if start.GreaterThan(end) {
+		start, end = end, start
+	}
+	if start.LessThan(b.Start()) {
+		start = b.Start()
+	}
+	if end.GreaterThan(b.End()) {
+		end = b.End()
+	}
+
+	var s BufferStats
+	s.Lines = end.Y - start.Y + 1
+	if end.X == 0 && end.Y > start.Y {
+		// The range ends with a line break
+		s.Lines--
+	}
+
+	for y := start.Y; y <= end.Y; y++ {
+		line := b.LineBytes(y)
+		if y == end.Y {
+			line = util.SliceStart(line, end.X)
+		}
+		if y == start.Y {
+			line = util.SliceEnd(line, start.X)
+		}
+
+		inWord := false
+		for len(line) > 0 {
+			r, size := utf8.DecodeRune(line)
+			line = line[size:]
+
+			s.Runes++
+			s.Bytes += size
+			if unicode.IsSpace(r) {
+				inWord = false
+			} else if !inWord {
+				inWord = true
+				s.Words++
+			}
+		}
+
+		if y != end.Y {
+			s.Runes++
+			s.Bytes++
+		}
+	}
+	return s
+}
+
+// RangeSize returns the number of runes and bytes between start and end, as
+// they would be written to the file
+// A line break counts as one rune, and as two bytes if the fileformat is dos
+func (b *Buffer) RangeSize(start, end Loc) (runes, bytes int) {
+	if start.GreaterThan(end) {
+		start, end = end, start
+	}
+	if start.LessThan(b.Start()) {
+		start = b.Start()
+	}
+	if end.GreaterThan(b.End()) {
+		end = b.End()
+	}
+
+	eol := 1
+	if b.Endings == FFDos {
+		eol = 2
+	}
+	for y := start.Y; y <= end.Y; y++ {
+		line := b.LineBytes(y)
+		if y == end.Y {
+			line = util.SliceStart(line, end.X)
+		}
+		if y == start.Y {
+			line = util.SliceEnd(line, start.X)
+		}
+		runes += utf8.RuneCount(line)
+		bytes += len(line)
+
+		if y != end.Y {
+			runes++
+			bytes += eol
+		}
+	}
+	return runes, bytes
+}
+
+// LinesOverLength returns the numbers of the lines that are wider than max
+// visual columns, with tabs expanded according to the tabsize option and wide
+// characters taking two columns
+func (b *Buffer) LinesOverLength(max int) []int {
+	tabsize := util.IntOpt(b.Settings["tabsize"])
+
+	var lines []int
+	for i, l := range b.lines {
+		// Without tabs a line is never wider than its number of bytes, so
+		// short lines can be skipped quickly
+		if len(l.data) <= max && !bytes.ContainsRune(l.data, '\t') {
+			continue
+		}
+		if util.StringWidth(l.data, utf8.RuneCount(l.data), tabsize) > max {
+			lines = append(lines, i)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,60 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	b := NewBufferFromString("Hello, world!\nÇa va? — très bien\n\n  end", "", BTDefault)
+
+	assert.Equal(t, BufferStats{
+		Lines: 4,
+		Words: 8,
+		Runes: 39,
+		Bytes: 43,
+	}, b.Stats())
+
+	// "world!\nÇa"
+	assert.Equal(t, BufferStats{
+		Lines: 2,
+		Words: 2,
+		Runes: 9,
+		Bytes: 10,
+	}, b.StatsRange(Loc{2, 1}, Loc{7, 0}))
+
+	// A range that ends at the start of a line doesn't count that line
+	assert.Equal(t, 1, b.StatsRange(Loc{0, 0}, Loc{0, 1}).Lines)
+	assert.Equal(t, BufferStats{Lines: 1}, NewBufferFromString("", "", BTDefault).Stats())
+}
+
+func TestRangeSize(t *testing.T) {
+	b := NewBufferFromString("héllo wörld\n日本語\nend", "", BTDefault)
+
+	runes, bytes := b.RangeSize(Loc{1, 0}, Loc{5, 0})
+	assert.Equal(t, 4, runes)
+	assert.Equal(t, 5, bytes)
+
+	// "wörld\n日本語\ne", reversed
+	runes, bytes = b.RangeSize(Loc{1, 2}, Loc{6, 0})
+	assert.Equal(t, 11, runes)
+	assert.Equal(t, 18, bytes)
+
+	b.SetOptionNative("fileformat", "dos")
+	runes, bytes = b.RangeSize(Loc{6, 0}, Loc{1, 2})
+	assert.Equal(t, 11, runes)
+	assert.Equal(t, 20, bytes)
+
+	runes, bytes = b.RangeSize(b.Start(), b.End())
+	assert.Equal(t, len([]rune(string(b.Bytes())))-2, runes)
+	assert.Equal(t, len(b.Bytes()), bytes)
+}
+
+func TestLinesOverLength(t *testing.T) {
+	b := NewBufferFromString("12345678\n123456789\n\t1234\n\t12345\n日本語の\n日本語のx\n", "", BTDefault)
+	b.SetOptionNative("tabsize", float64(4))
+
+	assert.Equal(t, []int{1, 3, 5}, b.LinesOverLength(8))
+	assert.Nil(t, b.LinesOverLength(10))
+}
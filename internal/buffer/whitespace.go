@@ -0,0 +1,239 @@
+package buffer
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// A WhitespaceRange is a range of runes in a line that contain only whitespace
+type WhitespaceRange struct {
+	Line       int
+	Start, End int
+}
+
+// TrailingWhitespaceRanges returns the trailing whitespace of every line that
+// has some (the whitespace that rmtrailingws would remove)
+// If skipBlank is true, lines that only contain whitespace are ignored
+func (b *Buffer) TrailingWhitespaceRanges(skipBlank bool) []WhitespaceRange {
+	var ranges []WhitespaceRange
+	for i, l := range b.lines {
+		trimmed := bytes.TrimRightFunc(l.data, unicode.IsSpace)
+		if len(trimmed) == len(l.data) || (skipBlank && len(trimmed) == 0) {
+			continue
+		}
+
+		start := utf8.RuneCount(trimmed)
+		end := start + utf8.RuneCount(l.data[len(trimmed):])
+		ranges = append(ranges, WhitespaceRange{i, start, end})
+	}
+	return ranges
+}
+
+// indentSampleLines is the largest number of lines that IndentStyle looks at
+const indentSampleLines = 10000
+
+// IndentStyle reports whether the lines of the buffer are indented with
+// "tabs" or "spaces", whichever is used by most indented lines, or "mixed"
+// if most lines mix both. It returns "none" if no line is indented
+// consistent is true if all the indented lines use the same style
+// Blank lines are ignored, and in big buffers only a sample of lines spread
+// evenly over the buffer is looked at
+func (b *Buffer) IndentStyle() (style string, consistent bool) {
+	step := 1
+	if len(b.lines) > indentSampleLines {
+		step = len(b.lines) / indentSampleLines
+	}
+
+	var tabs, spaces, mixed int
+	for i := 0; i < len(b.lines); i += step {
+		data := b.lines[i].data
+		ws := data[:len(data)-len(bytes.TrimLeft(data, " \t"))]
+		if len(ws) == 0 || len(ws) == len(data) {
+			// Not indented, or blank
+			continue
+		}
+
+		hasTab := bytes.IndexByte(ws, '\t') >= 0
+		hasSpace := bytes.IndexByte(ws, ' ') >= 0
+		if hasTab && hasSpace {
+			mixed++
+		} else if hasTab {
+			tabs++
+		} else {
+			spaces++
+		}
+	}
+
+	kinds := 0
+	for _, n := range []int{tabs, spaces, mixed} {
+		if n > 0 {
+			kinds++
+		}
+	}
+
+	switch {
+	case kinds == 0:
+		return "none", true
+	case tabs > spaces && tabs > mixed:
+		style = "tabs"
+	case spaces > tabs && spaces > mixed:
+		style = "spaces"
+	default:
+		style = "mixed"
+	}
+	return style, kinds == 1
+}
+
+// DetectIndent guesses the indentation settings of the buffer from its
+// contents: tabs is true if the lines are indented with tabs, and size is the
+// most common difference in indentation between consecutive lines that are
+// indented with spaces
+// ok is false if the buffer isn't indented consistently enough to tell
+func (b *Buffer) DetectIndent() (tabs bool, size int, ok bool) {
+	style, _ := b.IndentStyle()
+	if style == "tabs" {
+		return true, 0, true
+	} else if style != "spaces" {
+		return false, 0, false
+	}
+
+	// Histogram of the differences in indentation, up to 8 spaces
+	var steps [9]int
+	prev := 0
+	for i, l := range b.lines {
+		if i >= indentSampleLines {
+			break
+		}
+		trimmed := bytes.TrimLeft(l.data, " ")
+		if len(trimmed) == 0 || trimmed[0] == '\t' {
+			// Blank lines and lines indented with tabs don't tell anything
+			continue
+		}
+
+		indent := len(l.data) - len(trimmed)
+		step := indent - prev
+		if step < 0 {
+			step = -step
+		}
+		if step > 0 && step < len(steps) {
+			steps[step]++
+		}
+		prev = indent
+	}
+
+	size = 0
+	for s, n := range steps {
+		if n > steps[size] {
+			size = s
+		}
+	}
+	if size == 0 {
+		return false, 0, false
+	}
+	return false, size, true
+}
+
+// IndentOfLine returns the leading whitespace of line n, which is the whole
+// line if it only contains whitespace
+func (b *Buffer) IndentOfLine(n int) string {
+	return string(util.GetLeadingWhitespace(b.LineBytes(n)))
+}
+
+// indentLevel returns the indentation depth of a line, in which every tab is
+// one level and every tabsize spaces are one level, and whether the line is
+// blank
+func indentLevel(data []byte, tabsize int) (level int, blank bool) {
+	spaces := 0
+	for _, c := range data {
+		switch c {
+		case '\t':
+			level++
+		case ' ':
+			spaces++
+		default:
+			return level + spaces/tabsize, false
+		}
+	}
+	return 0, true
+}
+
+// IndentLevel returns the indentation depth of line n in units of the
+// tabsize option (a tab is one level)
+// Blank lines have the level of the next line that isn't blank
+func (b *Buffer) IndentLevel(n int) int {
+	tabsize := util.Max(util.IntOpt(b.Settings["tabsize"]), 1)
+	for i := util.Max(n, 0); i < len(b.lines); i++ {
+		if level, blank := indentLevel(b.lines[i].data, tabsize); !blank {
+			return level
+		}
+	}
+	return 0
+}
+
+// ParentLine returns the nearest line before line n that isn't blank and is
+// indented less than line n, which is the start of the block that contains
+// it, or -1 if there is no such line
+func (b *Buffer) ParentLine(n int) int {
+	if n <= 0 || n >= len(b.lines) {
+		return -1
+	}
+	tabsize := util.Max(util.IntOpt(b.Settings["tabsize"]), 1)
+	level := b.IndentLevel(n)
+	for i := n - 1; i >= 0; i-- {
+		if l, blank := indentLevel(b.lines[i].data, tabsize); !blank && l < level {
+			return i
+		}
+	}
+	return -1
+}
+
+// InsertNormalizedIndent inserts text (such as pasted code) at loc as a single
+// undoable event, with the indentation of its lines converted to the
+// indentation style of the buffer (tabstospaces and tabsize)
+// The indentation unit of the text is guessed from the spaces its lines are
+// indented with, and every tab in the indentation is one level. Spaces that
+// don't make up a whole level are kept after the converted indentation
+func (b *Buffer) InsertNormalizedIndent(loc Loc, text string) {
+	lines := strings.Split(text, "\n")
+	tabsize := util.Max(util.IntOpt(b.Settings["tabsize"]), 1)
+
+	// The indentation unit is the greatest common divisor of the numbers of
+	// spaces that lines are indented with, unless that fits the tabsize of
+	// the buffer (like a block that is indented by two levels everywhere)
+	unit := 0
+	for _, l := range lines {
+		ws := util.GetLeadingWhitespace([]byte(l))
+		if spaces := bytes.Count(ws, []byte{' '}); spaces > 0 {
+			for a := spaces; a > 0; {
+				unit, a = a, unit%a
+			}
+		}
+	}
+	if unit < 2 || unit%tabsize == 0 {
+		unit = tabsize
+	}
+
+	indent := "\t"
+	if b.Settings["tabstospaces"].(bool) {
+		indent = strings.Repeat(" ", tabsize)
+	}
+	for i, l := range lines {
+		if i == 0 && loc.X > 0 {
+			// The first line is inserted in the middle of a line
+			continue
+		}
+		ws := util.GetLeadingWhitespace([]byte(l))
+		if len(ws) == 0 {
+			continue
+		}
+		tabs := bytes.Count(ws, []byte{'\t'})
+		spaces := len(ws) - tabs
+		lines[i] = strings.Repeat(indent, tabs+spaces/unit) + strings.Repeat(" ", spaces%unit) + l[len(ws):]
+	}
+
+	b.Insert(loc, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,129 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zyedidia/micro/internal/config"
+)
+
+func TestTrailingWhitespaceRanges(t *testing.T) {
+	b := NewBufferFromString("none\nspaces  \ntabs\t\t\n  \nmixé \t\n", "", BTDefault)
+
+	assert.Equal(t, []WhitespaceRange{
+		{1, 6, 8},
+		{2, 4, 6},
+		{3, 0, 2},
+		{4, 4, 6},
+	}, b.TrailingWhitespaceRanges(false))
+
+	assert.Equal(t, []WhitespaceRange{
+		{1, 6, 8},
+		{2, 4, 6},
+		{4, 4, 6},
+	}, b.TrailingWhitespaceRanges(true))
+
+	assert.Nil(t, NewBufferFromString("no\ntrailing\n", "", BTDefault).TrailingWhitespaceRanges(false))
+}
+
+func TestIndentStyle(t *testing.T) {
+	tests := []struct {
+		text       string
+		style      string
+		consistent bool
+	}{
+		{"func f() {\n\tif x {\n\t\treturn\n\t}\n}\n", "tabs", true},
+		{"def f():\n    if x:\n        return\n\n    \n", "spaces", true},
+		{"a\n\t \tb\n \tc\n", "mixed", true},
+		{"no\nindentation\n", "none", true},
+		{"a\n\tb\n\tc\n\td\n    e\n", "tabs", false},
+		{"a\n  b\n  c\n\td\n\t  e\n", "spaces", false},
+		{"a\n\tb\n  c\n", "mixed", false},
+	}
+
+	for _, test := range tests {
+		b := NewBufferFromString(test.text, "", BTDefault)
+		style, consistent := b.IndentStyle()
+		assert.Equal(t, test.style, style, test.text)
+		assert.Equal(t, test.consistent, consistent, test.text)
+	}
+}
+
+func TestDetectIndent(t *testing.T) {
+	config.GlobalSettings["detectindent"] = true
+	defer func() { config.GlobalSettings["detectindent"] = false }()
+
+	b := NewBufferFromString("a:\n  b:\n    c: 1\n    d: 2\n  e: 3\n", "", BTDefault)
+	assert.Equal(t, true, b.Settings["tabstospaces"])
+	assert.Equal(t, float64(2), b.Settings["tabsize"])
+
+	b = NewBufferFromString("def f():\n    if x:\n        return 1\n\n    return 2\n", "", BTDefault)
+	assert.Equal(t, true, b.Settings["tabstospaces"])
+	assert.Equal(t, float64(4), b.Settings["tabsize"])
+
+	config.GlobalSettings["tabstospaces"] = true
+	defer func() { config.GlobalSettings["tabstospaces"] = false }()
+	b = NewBufferFromString("func f() {\n\tif x {\n\t\treturn\n\t}\n}\n", "", BTDefault)
+	assert.Equal(t, false, b.Settings["tabstospaces"])
+	assert.Equal(t, float64(4), b.Settings["tabsize"])
+
+	// Without indentation the settings are left alone
+	b = NewBufferFromString("a\nb\n", "", BTDefault)
+	assert.Equal(t, true, b.Settings["tabstospaces"])
+}
+
+func TestIndentOfLine(t *testing.T) {
+	b := NewBufferFromString("\t\tfoo\n    bar\n \t \n\nbaz", "", BTDefault)
+
+	assert.Equal(t, "\t\t", b.IndentOfLine(0))
+	assert.Equal(t, "    ", b.IndentOfLine(1))
+	assert.Equal(t, " \t ", b.IndentOfLine(2))
+	assert.Equal(t, "", b.IndentOfLine(3))
+	assert.Equal(t, "", b.IndentOfLine(4))
+	assert.Equal(t, "", b.IndentOfLine(10))
+}
+
+func TestIndentLevel(t *testing.T) {
+	text := "func main() {\n" +
+		"    if x {\n" +
+		"        a()\n" +
+		"\n" +
+		"        for {\n" +
+		"\t\t\tb()\n" +
+		"        }\n" +
+		"      c()\n" +
+		"    }\n" +
+		"}\n"
+	b := NewBufferFromString(text, "", BTDefault)
+	b.SetOptionNative("tabsize", float64(4))
+
+	levels := []int{0, 1, 2, 2, 2, 3, 2, 1, 1, 0, 0}
+	parents := []int{-1, 0, 1, 1, 1, 4, 1, 0, 0, -1, -1}
+	for i := range levels {
+		assert.Equal(t, levels[i], b.IndentLevel(i), "line", i)
+		assert.Equal(t, parents[i], b.ParentLine(i), "line", i)
+	}
+}
+
+func TestInsertNormalizedIndent(t *testing.T) {
+	b := NewBufferFromString("x\n", "", BTDefault)
+	b.SetOptionNative("tabstospaces", false)
+	b.SetOptionNative("tabsize", float64(4))
+
+	b.InsertNormalizedIndent(Loc{0, 1}, "if a {\n  if b {\n    c()\n  }\n}\n")
+	assert.Equal(t, "x\nif a {\n\tif b {\n\t\tc()\n\t}\n}\n", string(b.Bytes()))
+
+	b.Undo()
+	assert.Equal(t, "x\n", string(b.Bytes()))
+
+	// Mixed tabs and spaces, with an alignment space that is kept
+	b.InsertNormalizedIndent(Loc{0, 1}, "\tf(a,\n\t     b)\n    g()\n")
+	assert.Equal(t, "x\n\tf(a,\n\t\t b)\n\tg()\n", string(b.Bytes()))
+
+	// A block indented by whole tabsizes everywhere and a partial first line
+	b = NewBufferFromString("y = ", "", BTDefault)
+	b.SetOptionNative("tabstospaces", true)
+	b.SetOptionNative("tabsize", float64(2))
+	b.InsertNormalizedIndent(Loc{4, 0}, "  1\n\t\t2\n    3")
+	assert.Equal(t, "y =   1\n    2\n    3", string(b.Bytes()))
+}
@@ -0,0 +1,123 @@
+package buffer
+
+import (
+	"strings"
+
+	"github.com/zyedidia/micro/internal/util"
+)
+
+// IsWordChar returns whether r is part of a word: a letter, a number, an
+// underscore or one of the runes in the wordchars option
+func (b *Buffer) IsWordChar(r rune) bool {
+	return util.IsWordChar(r) || strings.ContainsRune(b.Settings["wordchars"].(string), r)
+}
+
+// The classes of runes that words are made of
+const (
+	runeSpace = iota
+	runeWord
+	runePunct
+)
+
+func (b *Buffer) runeClass(r rune) int {
+	if util.IsWhitespace(r) {
+		return runeSpace
+	} else if b.IsWordChar(r) {
+		return runeWord
+	}
+	return runePunct
+}
+
+// WordStartBefore returns the start of the word before loc, skipping any
+// whitespace in between
+// A run of punctuation counts as a word. At the start of a line it returns
+// the end of the previous line
+func (b *Buffer) WordStartBefore(loc Loc) Loc {
+	if loc.X <= 0 {
+		if loc.Y > 0 {
+			return Loc{len([]rune(string(b.LineBytes(loc.Y - 1)))), loc.Y - 1}
+		}
+		return Loc{0, 0}
+	}
+
+	line := []rune(string(b.LineBytes(loc.Y)))
+	x := util.Min(loc.X, len(line))
+	for x > 0 && b.runeClass(line[x-1]) == runeSpace {
+		x--
+	}
+	if x > 0 {
+		class := b.runeClass(line[x-1])
+		for x > 0 && b.runeClass(line[x-1]) == class {
+			x--
+		}
+	}
+	return Loc{x, loc.Y}
+}
+
+// WordEndAfter returns the end of the word after loc, skipping any
+// whitespace in between
+// A run of punctuation counts as a word. At the end of a line it returns the
+// start of the next line
+func (b *Buffer) WordEndAfter(loc Loc) Loc {
+	line := []rune(string(b.LineBytes(loc.Y)))
+	if loc.X >= len(line) {
+		if loc.Y < b.LinesNum()-1 {
+			return Loc{0, loc.Y + 1}
+		}
+		return Loc{len(line), loc.Y}
+	}
+
+	x := util.Max(loc.X, 0)
+	for x < len(line) && b.runeClass(line[x]) == runeSpace {
+		x++
+	}
+	if x < len(line) {
+		class := b.runeClass(line[x])
+		for x < len(line) && b.runeClass(line[x]) == class {
+			x++
+		}
+	}
+	return Loc{x, loc.Y}
+}
+
+// DeleteWordLeft removes the text from the start of the word before loc up to
+// loc as a single undoable event and returns the location the cursor should
+// move to
+// If withSpace is true the whitespace before the word is removed too. At the
+// start of a line the line is joined with the previous one
+func (b *Buffer) DeleteWordLeft(loc Loc, withSpace bool) Loc {
+	start := b.WordStartBefore(loc)
+	if withSpace && start.Y == loc.Y {
+		line := []rune(string(b.LineBytes(start.Y)))
+		for start.X > 0 && util.IsWhitespace(line[start.X-1]) {
+			start.X--
+		}
+	}
+	if b.Type.Readonly || start == loc {
+		return loc
+	}
+
+	b.Remove(start, loc)
+	return start
+}
+
+// DeleteWordRight removes the text from loc up to the end of the word after it
+// as a single undoable event and returns the location the cursor should move
+// to
+// If withSpace is true the whitespace after the word is removed too. At the
+// end of a line the next line is joined with it
+func (b *Buffer) DeleteWordRight(loc Loc, withSpace bool) Loc {
+	end := b.WordEndAfter(loc)
+	if withSpace && end.Y == loc.Y {
+		line := []rune(string(b.LineBytes(end.Y)))
+		for end.X < len(line) && util.IsWhitespace(line[end.X]) {
+			end.X++
+		}
+	}
+	if b.Type.Readonly || end == loc {
+		return loc
+	}
+
+	b.Remove(loc, end)
+	return loc
+}
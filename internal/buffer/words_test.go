@@ -0,0 +1,86 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWordStartBefore(t *testing.T) {
+	b := NewBufferFromString("  foo.bar(); héllo\nwörld", "", BTDefault)
+
+	// Word characters
+	assert.Equal(t, Loc{6, 0}, b.WordStartBefore(Loc{9, 0}))
+	// Consecutive punctuation
+	assert.Equal(t, Loc{9, 0}, b.WordStartBefore(Loc{12, 0}))
+	// Whitespace before a multibyte word
+	assert.Equal(t, Loc{13, 0}, b.WordStartBefore(Loc{18, 0}))
+	assert.Equal(t, Loc{9, 0}, b.WordStartBefore(Loc{13, 0}))
+	// Leading whitespace
+	assert.Equal(t, Loc{0, 0}, b.WordStartBefore(Loc{2, 0}))
+	// Line and buffer boundaries
+	assert.Equal(t, Loc{18, 0}, b.WordStartBefore(Loc{0, 1}))
+	assert.Equal(t, Loc{0, 1}, b.WordStartBefore(Loc{5, 1}))
+	assert.Equal(t, Loc{0, 0}, b.WordStartBefore(Loc{0, 0}))
+}
+
+func TestWordEndAfter(t *testing.T) {
+	b := NewBufferFromString("  foo.bar(); héllo\nwörld", "", BTDefault)
+
+	// Leading whitespace
+	assert.Equal(t, Loc{5, 0}, b.WordEndAfter(Loc{0, 0}))
+	assert.Equal(t, Loc{6, 0}, b.WordEndAfter(Loc{5, 0}))
+	// Consecutive punctuation
+	assert.Equal(t, Loc{12, 0}, b.WordEndAfter(Loc{9, 0}))
+	// Whitespace before a multibyte word
+	assert.Equal(t, Loc{18, 0}, b.WordEndAfter(Loc{12, 0}))
+	// Line and buffer boundaries
+	assert.Equal(t, Loc{0, 1}, b.WordEndAfter(Loc{18, 0}))
+	assert.Equal(t, Loc{5, 1}, b.WordEndAfter(Loc{0, 1}))
+	assert.Equal(t, Loc{5, 1}, b.WordEndAfter(Loc{5, 1}))
+}
+
+func TestWordChars(t *testing.T) {
+	b := NewBufferFromString("foo-bar baz", "", BTDefault)
+	assert.Equal(t, Loc{3, 0}, b.WordEndAfter(Loc{0, 0}))
+
+	b.SetOptionNative("wordchars", "-")
+	assert.True(t, b.IsWordChar('-'))
+	assert.Equal(t, Loc{7, 0}, b.WordEndAfter(Loc{0, 0}))
+	assert.Equal(t, Loc{0, 0}, b.WordStartBefore(Loc{7, 0}))
+}
+
+func TestDeleteWord(t *testing.T) {
+	b := NewBufferFromString("foo  bar.baz qux\nnext", "", BTDefault)
+	b.SetOptionNative("undogroupwindow", float64(0))
+
+	// Mid-line
+	assert.Equal(t, Loc{5, 0}, b.DeleteWordLeft(Loc{8, 0}, false))
+	assert.Equal(t, "foo  .baz qux", string(b.LineBytes(0)))
+	assert.Equal(t, Loc{0, 0}, b.DeleteWordLeft(Loc{5, 0}, false))
+	assert.Equal(t, ".baz qux", string(b.LineBytes(0)))
+
+	assert.Equal(t, Loc{1, 0}, b.DeleteWordRight(Loc{1, 0}, true))
+	assert.Equal(t, ".qux", string(b.LineBytes(0)))
+
+	// A single undo restores each deletion
+	b.Undo()
+	assert.Equal(t, ".baz qux", string(b.LineBytes(0)))
+	b.Undo()
+	assert.Equal(t, "foo  .baz qux", string(b.LineBytes(0)))
+
+	// At the start of a line the lines are joined
+	assert.Equal(t, Loc{13, 0}, b.DeleteWordLeft(Loc{0, 1}, false))
+	assert.Equal(t, "foo  .baz quxnext", string(b.LineBytes(0)))
+	assert.Equal(t, 1, b.LinesNum())
+
+	// At the edges of the buffer nothing happens
+	assert.Equal(t, Loc{0, 0}, b.DeleteWordLeft(Loc{0, 0}, true))
+	assert.Equal(t, Loc{17, 0}, b.DeleteWordRight(Loc{17, 0}, true))
+	assert.Equal(t, "foo  .baz quxnext", string(b.Bytes()))
+
+	// The whitespace before the word
+	b = NewBufferFromString("a  foo bar", "", BTDefault)
+	assert.Equal(t, Loc{1, 0}, b.DeleteWordLeft(Loc{6, 0}, true))
+	assert.Equal(t, "a bar", string(b.LineBytes(0)))
+}
@@ -43,3 +43,44 @@ func StartAutoSave() {
 		}
 	}()
 }
+
+// Autoserialize receives a value every serializeinterval seconds, when the
+// open buffers should be serialized
+var Autoserialize chan bool
+var serializetime int
+var serializing bool
+
+func init() {
+	Autoserialize = make(chan bool)
+}
+
+// SetSerializeTime sets the number of seconds between serializations of the
+// open buffers, and starts serializing periodically if it isn't already
+// A time less than 1 stops the periodic serialization
+func SetSerializeTime(a int) {
+	autolock.Lock()
+	defer autolock.Unlock()
+
+	serializetime = a
+	if serializetime < 1 || serializing {
+		return
+	}
+
+	serializing = true
+	go func() {
+		for {
+			autolock.Lock()
+			a := serializetime
+			if a < 1 {
+				serializing = false
+			}
+			autolock.Unlock()
+			if a < 1 {
+				return
+			}
+
+			time.Sleep(time.Duration(a) * time.Second)
+			Autoserialize <- true
+		}
+	}()
+}
@@ -0,0 +1,282 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// An editorConfigSection is a glob section of an .editorconfig file along
+// with the properties it sets
+type editorConfigSection struct {
+	glob  *regexp.Regexp
+	props map[string]string
+}
+
+// An editorConfig is a parsed .editorconfig file
+type editorConfig struct {
+	dir      string
+	root     bool
+	sections []editorConfigSection
+}
+
+// editorConfigGlob converts an EditorConfig glob into a regular expression
+// matching paths relative to the directory of the .editorconfig file
+func editorConfigGlob(glob string) (*regexp.Regexp, error) {
+	var prefix string
+	if !strings.Contains(glob, "/") {
+		// Globs without a slash match files in any subdirectory
+		prefix = "(?:.*/)?"
+	} else {
+		glob = strings.TrimPrefix(glob, "/")
+	}
+
+	rgx, _ := globToRegex(glob, false)
+	return regexp.Compile("^" + prefix + rgx + "$")
+}
+
+// globToRegex converts the given glob to a regular expression and returns
+// the rest of the glob if inBrace is true and the end of the brace is reached
+func globToRegex(glob string, inBrace bool) (string, string) {
+	var rgx strings.Builder
+	for len(glob) > 0 {
+		c := glob[0]
+		glob = glob[1:]
+		switch c {
+		case '\\':
+			if len(glob) > 0 {
+				rgx.WriteString(regexp.QuoteMeta(glob[:1]))
+				glob = glob[1:]
+			}
+		case '*':
+			if strings.HasPrefix(glob, "*") {
+				glob = glob[1:]
+				rgx.WriteString(".*")
+			} else {
+				rgx.WriteString("[^/]*")
+			}
+		case '?':
+			rgx.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob, ']')
+			if end < 0 {
+				rgx.WriteString(`\[`)
+				break
+			}
+			class := glob[:end]
+			glob = glob[end+1:]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			rgx.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+		case '{':
+			end := strings.IndexByte(glob, '}')
+			if end >= 0 {
+				if r, ok := numRangeRegex(glob[:end]); ok {
+					rgx.WriteString(r)
+					glob = glob[end+1:]
+					break
+				}
+			}
+			if end < 0 || !strings.Contains(glob[:end], ",") {
+				rgx.WriteString(`\{`)
+				break
+			}
+
+			rgx.WriteString("(?:")
+			for {
+				var alt string
+				alt, glob = globToRegex(glob, true)
+				rgx.WriteString(alt)
+				if len(glob) == 0 || glob[0] == '}' {
+					if len(glob) > 0 {
+						glob = glob[1:]
+					}
+					break
+				}
+				// Skip the comma and continue with the next alternative
+				glob = glob[1:]
+				rgx.WriteString("|")
+			}
+			rgx.WriteString(")")
+		case ',', '}':
+			if inBrace {
+				return rgx.String(), string(c) + glob
+			}
+			rgx.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			rgx.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return rgx.String(), ""
+}
+
+// numRangeRegex converts a {num1..num2} range into a regular expression
+func numRangeRegex(r string) (string, bool) {
+	parts := strings.Split(r, "..")
+	if len(parts) != 2 {
+		return "", false
+	}
+	lo, err1 := strconv.Atoi(parts[0])
+	hi, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return "", false
+	}
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	if hi-lo > 1000 {
+		return `[+-]?\d+`, true
+	}
+
+	nums := make([]string, 0, hi-lo+1)
+	for i := lo; i <= hi; i++ {
+		nums = append(nums, strconv.Itoa(i))
+	}
+	return "(?:" + strings.Join(nums, "|") + ")", true
+}
+
+// readEditorConfig parses the .editorconfig file in the given directory
+func readEditorConfig(dir string) (*editorConfig, error) {
+	f, err := os.Open(filepath.Join(dir, ".editorconfig"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ec := &editorConfig{dir: dir}
+	var section *editorConfigSection
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = nil
+			glob, err := editorConfigGlob(line[1 : len(line)-1])
+			if err != nil {
+				// Ignore the properties of sections that can't be matched
+				continue
+			}
+			ec.sections = append(ec.sections, editorConfigSection{glob, make(map[string]string)})
+			section = &ec.sections[len(ec.sections)-1]
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:eq]))
+		value := strings.ToLower(strings.TrimSpace(line[eq+1:]))
+
+		if section != nil {
+			section.props[key] = value
+		} else if len(ec.sections) == 0 && key == "root" {
+			ec.root = value == "true"
+		}
+	}
+
+	return ec, scanner.Err()
+}
+
+// editorConfigProperties returns the EditorConfig properties that apply to the
+// file at the given absolute path
+func editorConfigProperties(path string) map[string]string {
+	var configs []*editorConfig
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if ec, err := readEditorConfig(dir); err == nil {
+			configs = append(configs, ec)
+			if ec.root {
+				break
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	props := make(map[string]string)
+	// Files closer to the path take precedence, so apply them last
+	for i := len(configs) - 1; i >= 0; i-- {
+		ec := configs[i]
+		rel, err := filepath.Rel(ec.dir, path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, s := range ec.sections {
+			if s.glob.MatchString(rel) {
+				for k, v := range s.props {
+					props[k] = v
+				}
+			}
+		}
+	}
+	return props
+}
+
+// applyEditorConfig sets the options that are given by the .editorconfig files
+// that apply to the file at path
+func applyEditorConfig(settings map[string]interface{}, path string) {
+	if path == "" {
+		return
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	props := editorConfigProperties(absPath)
+
+	switch props["indent_style"] {
+	case "space":
+		settings["tabstospaces"] = true
+	case "tab":
+		settings["tabstospaces"] = false
+	}
+
+	size := props["indent_size"]
+	if size == "tab" || size == "" {
+		size = props["tab_width"]
+	}
+	if n, err := strconv.Atoi(size); err == nil && n > 0 {
+		settings["tabsize"] = float64(n)
+	}
+
+	switch props["end_of_line"] {
+	case "lf":
+		settings["fileformat"] = "unix"
+	case "crlf":
+		settings["fileformat"] = "dos"
+	}
+
+	if charset := props["charset"]; charset != "" {
+		charset = strings.TrimSuffix(charset, "-bom")
+		if _, err := htmlindex.Get(charset); err == nil {
+			settings["encoding"] = charset
+		}
+	}
+
+	switch props["trim_trailing_whitespace"] {
+	case "true":
+		settings["rmtrailingws"] = true
+	case "false":
+		settings["rmtrailingws"] = false
+	}
+
+	switch props["insert_final_newline"] {
+	case "true":
+		settings["eofnewline"] = true
+	case "false":
+		settings["eofnewline"] = false
+	}
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditorConfigGlob(t *testing.T) {
+	tests := []struct {
+		glob, path string
+		match      bool
+	}{
+		{"*", "a.go", true},
+		{"*.go", "sub/dir/a.go", true},
+		{"*.go", "a.go.txt", false},
+		{"src/*.c", "src/a.c", true},
+		{"src/*.c", "src/sub/a.c", false},
+		{"/src/**.c", "src/sub/a.c", true},
+		{"*.{js,py}", "a.py", true},
+		{"*.{js,py}", "a.rb", false},
+		{"file[0-9].txt", "file5.txt", true},
+		{"file[!0-9].txt", "file5.txt", false},
+		{"v{1..3}.txt", "v2.txt", true},
+		{"v{1..3}.txt", "v4.txt", false},
+		{"a?c", "abc", true},
+		{"a?c", "a/c", false},
+	}
+
+	for _, test := range tests {
+		g, err := editorConfigGlob(test.glob)
+		assert.Nil(t, err)
+		assert.Equal(t, test.match, g.MatchString(test.path), test.glob+" "+test.path)
+	}
+}
+
+func TestEditorConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "micro-editorconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sub := filepath.Join(dir, "project", "src")
+	assert.Nil(t, os.MkdirAll(sub, os.ModePerm))
+
+	// This file is above the root and must be ignored
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".editorconfig"), []byte(`
+[*]
+insert_final_newline = false
+charset = latin1
+`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "project", ".editorconfig"), []byte(`
+root = true
+
+[*]
+indent_style = space
+indent_size = 2
+end_of_line = crlf
+trim_trailing_whitespace = true
+insert_final_newline = true
+
+[Makefile]
+indent_style = tab
+`), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sub, ".editorconfig"), []byte(`
+# closer files override
+[*.go]
+indent_style = tab
+indent_size = tab
+tab_width = 8
+`), 0644))
+
+	settings := DefaultCommonSettings()
+	InitLocalSettings(settings, filepath.Join(sub, "main.c"))
+	assert.Equal(t, true, settings["tabstospaces"])
+	assert.Equal(t, float64(2), settings["tabsize"])
+	assert.Equal(t, "dos", settings["fileformat"])
+	assert.Equal(t, true, settings["rmtrailingws"])
+	assert.Equal(t, true, settings["eofnewline"])
+	assert.Equal(t, "utf-8", settings["encoding"])
+
+	settings = DefaultCommonSettings()
+	InitLocalSettings(settings, filepath.Join(sub, "main.go"))
+	assert.Equal(t, false, settings["tabstospaces"])
+	assert.Equal(t, float64(8), settings["tabsize"])
+
+	settings = DefaultCommonSettings()
+	InitLocalSettings(settings, filepath.Join(dir, "project", "Makefile"))
+	assert.Equal(t, false, settings["tabstospaces"])
+
+	settings = DefaultCommonSettings()
+	InitLocalSettings(settings, filepath.Join(dir, "other.txt"))
+	assert.Equal(t, "latin1", settings["encoding"])
+	assert.Equal(t, false, settings["eofnewline"])
+	assert.Equal(t, false, settings["tabstospaces"])
+}
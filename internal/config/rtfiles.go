@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 const (
@@ -34,6 +35,13 @@ type RuntimeFile interface {
 var allFiles [NumTypes][]RuntimeFile
 var realFiles [NumTypes][]RuntimeFile
 
+// errors that happened while loading syntax files during this session
+var (
+	syntaxErrors     []error
+	syntaxErrorsSeen = make(map[string]bool)
+	syntaxErrorsLock sync.Mutex
+)
+
 // some file on filesystem
 type realFile string
 
@@ -282,3 +290,29 @@ func PluginAddRuntimeFilesFromDirectory(plugin string, filetype RTFiletype, dire
 func PluginAddRuntimeFileFromMemory(filetype RTFiletype, filename, data string) {
 	AddRealRuntimeFile(filetype, memoryFile{filename, []byte(data)})
 }
+
+// AddSyntaxLoadError records an error that happened while loading a syntax
+// file and returns whether it is new. Each error is only recorded once per
+// session, so callers should only tell the user about new errors
+func AddSyntaxLoadError(err error) bool {
+	syntaxErrorsLock.Lock()
+	defer syntaxErrorsLock.Unlock()
+
+	if syntaxErrorsSeen[err.Error()] {
+		return false
+	}
+	syntaxErrorsSeen[err.Error()] = true
+	syntaxErrors = append(syntaxErrors, err)
+	return true
+}
+
+// SyntaxLoadErrors returns the errors that happened while loading syntax
+// files during this session
+func SyntaxLoadErrors() []error {
+	syntaxErrorsLock.Lock()
+	defer syntaxErrorsLock.Unlock()
+
+	errs := make([]error, len(syntaxErrors))
+	copy(errs, syntaxErrors)
+	return errs
+}
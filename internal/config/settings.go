@@ -5,7 +5,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -35,13 +38,22 @@ func init() {
 // Options with validators
 var optionValidators = map[string]optionValidator{
 	// "autosave":     validateNonNegativeValue,
-	"tabsize":      validatePositiveValue,
-	"scrollmargin": validateNonNegativeValue,
-	"scrollspeed":  validateNonNegativeValue,
-	"colorscheme":  validateColorscheme,
-	"colorcolumn":  validateNonNegativeValue,
-	"fileformat":   validateLineEnding,
-	"encoding":     validateEncoding,
+	"tabsize":               validatePositiveValue,
+	"scrollmargin":          validateNonNegativeValue,
+	"scrollspeed":           validateNonNegativeValue,
+	"colorscheme":           validateColorscheme,
+	"colorcolumn":           validateNonNegativeValue,
+	"fileformat":            validateLineEnding,
+	"encoding":              validateEncoding,
+	"undogroupwindow":       validateNonNegativeValue,
+	"tabstospacesonsave":    validateTabsToSpacesOnSave,
+	"serializeinterval":     validateNonNegativeValue,
+	"nohistorypaths":        validateGlobList,
+	"rmtrailingwsexclude":   validateStringList,
+	"eofnewlineexclude":     validateStringList,
+	"maxtrailingblanklines": validateLimit,
+	"largeinsertthreshold":  validateLimit,
+	"outlinepatterns":       validateRegexList,
 }
 
 func ReadSettings() error {
@@ -68,7 +80,7 @@ func InitGlobalSettings() {
 	GlobalSettings = DefaultGlobalSettings()
 
 	for k, v := range parsedSettings {
-		if !strings.HasPrefix(reflect.TypeOf(v).String(), "map") {
+		if !strings.HasPrefix(reflect.TypeOf(v).String(), "map") || k == "filetypeoverrides" {
 			GlobalSettings[k] = v
 		}
 	}
@@ -76,11 +88,15 @@ func InitGlobalSettings() {
 
 // InitLocalSettings scans the json in settings.json and sets the options locally based
 // on whether the filetype or path matches ft or glob local settings
+// Options from any .editorconfig files that apply to the path are set first so
+// that settings.json takes precedence over them
 // Must be called after ReadSettings
 func InitLocalSettings(settings map[string]interface{}, path string) error {
+	applyEditorConfig(settings, path)
+
 	var parseError error
 	for k, v := range parsedSettings {
-		if strings.HasPrefix(reflect.TypeOf(v).String(), "map") {
+		if strings.HasPrefix(reflect.TypeOf(v).String(), "map") && k != "filetypeoverrides" {
 			if strings.HasPrefix(k, "ft:") {
 				if settings["filetype"].(string) == k[3:] {
 					for k1, v1 := range v.(map[string]interface{}) {
@@ -153,42 +169,128 @@ func GetGlobalOption(name string) interface{} {
 	return GlobalSettings[name]
 }
 
+// FileTypeOverride returns the filetype that the filetypeoverrides option
+// assigns to the file at path
+// Keys of the option are either extensions (such as ".tpl") or globs that are
+// matched against the path and the name of the file
+func FileTypeOverride(path string) (string, bool) {
+	overrides, ok := GlobalSettings["filetypeoverrides"].(map[string]interface{})
+	if !ok || path == "" {
+		return "", false
+	}
+
+	// Check the keys in a fixed order so that the result doesn't depend on
+	// the map iteration order
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	base := filepath.Base(path)
+	for _, k := range keys {
+		ft, ok := overrides[k].(string)
+		if !ok {
+			continue
+		}
+
+		if strings.HasPrefix(k, ".") && !strings.ContainsAny(k, "*?[{") {
+			if strings.HasSuffix(base, k) {
+				return ft, true
+			}
+			continue
+		}
+
+		g, err := glob.Compile(k)
+		if err != nil {
+			continue
+		}
+		if g.MatchString(path) || g.MatchString(base) {
+			return ft, true
+		}
+	}
+	return "", false
+}
+
+// NoHistoryPath returns whether the cursor and undo history of the file at
+// the given absolute path must not be stored, because the path matches one of
+// the globs of the nohistorypaths option
+func NoHistoryPath(path string) bool {
+	globs, _ := GlobalSettings["nohistorypaths"].([]interface{})
+	for _, v := range globs {
+		pattern, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if home, err := util.ReplaceHome(pattern); err == nil {
+			pattern = home
+		}
+
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		if g.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
 var defaultCommonSettings = map[string]interface{}{
-	"autoindent":     true,
-	"backup":         true,
-	"basename":       false,
-	"colorcolumn":    float64(0),
-	"cursorline":     true,
-	"encoding":       "utf-8",
-	"eofnewline":     false,
-	"fastdirty":      true,
-	"fileformat":     "unix",
-	"filetype":       "unknown",
-	"ignorecase":     false,
-	"indentchar":     " ",
-	"keepautoindent": false,
-	"matchbrace":     true,
-	"mkparents":      false,
-	"readonly":       false,
-	"rmtrailingws":   false,
-	"ruler":          true,
-	"savecursor":     false,
-	"saveundo":       false,
-	"scrollbar":      false,
-	"scrollmargin":   float64(3),
-	"scrollspeed":    float64(2),
-	"smartpaste":     true,
-	"softwrap":       false,
-	"splitbottom":    true,
-	"splitright":     true,
-	"statusformatl":  "$(filename) $(modified)($(line),$(col)) | ft:$(opt:filetype) | $(opt:fileformat) | $(opt:encoding)",
-	"statusformatr":  "$(bind:ToggleKeyMenu): bindings, $(bind:ToggleHelp): help",
-	"statusline":     true,
-	"syntax":         true,
-	"tabmovement":    false,
-	"tabsize":        float64(4),
-	"tabstospaces":   false,
-	"useprimary":     true,
+	"autoindent":            true,
+	"autopair":              true,
+	"backup":                true,
+	"basename":              false,
+	"clearhistoryonreload":  false,
+	"colorcolumn":           float64(0),
+	"cursorline":            true,
+	"detectindent":          false,
+	"encoding":              "utf-8",
+	"eofnewline":            false,
+	"fastdirty":             true,
+	"fileformat":            "unix",
+	"filetype":              "unknown",
+	"ignorecase":            false,
+	"indentchar":            " ",
+	"keepautoindent":        false,
+	"largeinsertthreshold":  float64(1048576),
+	"lineseparator":         "",
+	"matchbrace":            true,
+	"maxtrailingblanklines": float64(-1),
+	"mkparents":             false,
+	"modeline":              false,
+	"outlinepatterns":       []interface{}{},
+	"pasteindent":           false,
+	"preserveeol":           false,
+	"readonly":              false,
+	"rmtrailingws":          false,
+	"ruler":                 true,
+	"savecursor":            false,
+	"savefolds":             false,
+	"saveundo":              false,
+	"scrollbar":             false,
+	"scrollmargin":          float64(3),
+	"scrollspeed":           float64(2),
+	"searchexpandtabs":      false,
+	"showcontrolchars":      true,
+	"smartpaste":            true,
+	"softwrap":              false,
+	"softwrapwords":         false,
+	"splitbottom":           true,
+	"splitright":            true,
+	"statusformatl":         "$(filename) $(modified)($(line),$(col)) | ft:$(opt:filetype) | $(opt:fileformat) | $(opt:encoding)",
+	"statusformatr":         "$(bind:ToggleKeyMenu): bindings, $(bind:ToggleHelp): help",
+	"statusline":            true,
+	"stripansi":             false,
+	"syntax":                true,
+	"tabmovement":           false,
+	"tabsize":               float64(4),
+	"tabstospaces":          false,
+	"tabstospacesonsave":    "off",
+	"undogroupwindow":       float64(500),
+	"useprimary":            true,
+	"wordchars":             "",
 }
 
 func GetInfoBarOffset() int {
@@ -213,14 +315,23 @@ func DefaultCommonSettings() map[string]interface{} {
 }
 
 var defaultGlobalSettings = map[string]interface{}{
+	"allowduplicatebuffers": false,
 	// "autosave":    float64(0),
-	"colorscheme": "default",
-	"infobar":     true,
-	"keymenu":     false,
-	"mouse":       true,
-	"paste":       false,
-	"savehistory": true,
-	"sucmd":       "sudo",
+	"colorscheme":         "default",
+	"eofnewlineexclude":   []interface{}{},
+	"filetypeoverrides":   map[string]interface{}{},
+	"infobar":             true,
+	"keymenu":             false,
+	"mouse":               true,
+	"mustexist":           false,
+	"nohistorypaths":      []interface{}{},
+	"paste":               false,
+	"rmtrailingwsexclude": []interface{}{},
+	"savehistory":         true,
+	"serializeinterval":   float64(0),
+	"sucmd":               "sudo",
+	"templatedir":         "",
+	"wslpaths":            false,
 }
 
 // DefaultGlobalSettings returns the default global settings for micro
@@ -315,6 +426,22 @@ func validateNonNegativeValue(option string, value interface{}) error {
 	return nil
 }
 
+// validateLimit validates options that are either a non-negative limit or -1
+// for no limit
+func validateLimit(option string, value interface{}) error {
+	nativeValue, ok := value.(float64)
+
+	if !ok {
+		return errors.New("Expected numeric type for " + option)
+	}
+
+	if nativeValue < 0 && nativeValue != -1 {
+		return errors.New(option + " must be non-negative, or -1 for no limit")
+	}
+
+	return nil
+}
+
 func validateColorscheme(option string, value interface{}) error {
 	colorscheme, ok := value.(string)
 
@@ -343,7 +470,63 @@ func validateLineEnding(option string, value interface{}) error {
 	return nil
 }
 
+func validateTabsToSpacesOnSave(option string, value interface{}) error {
+	mode, ok := value.(string)
+
+	if !ok {
+		return errors.New("Expected string type for " + option)
+	}
+
+	if mode != "off" && mode != "leading" && mode != "all" {
+		return errors.New(option + " must be 'off', 'leading' or 'all'")
+	}
+
+	return nil
+}
+
 func validateEncoding(option string, value interface{}) error {
 	_, err := htmlindex.Get(value.(string))
 	return err
 }
+
+// validateList returns a validator for options that are lists of strings,
+// which checks every string of the list with check (if it isn't nil)
+func validateList(check func(option, s string) error) optionValidator {
+	return func(option string, value interface{}) error {
+		list, ok := value.([]interface{})
+
+		if !ok {
+			return errors.New("Expected list type for " + option)
+		}
+
+		for _, v := range list {
+			s, ok := v.(string)
+			if !ok {
+				return errors.New("Expected list of strings for " + option)
+			}
+			if check != nil {
+				if err := check(option, s); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+var validateStringList = validateList(nil)
+
+var validateGlobList = validateList(func(option, pattern string) error {
+	if _, err := glob.Compile(pattern); err != nil {
+		return errors.New("Invalid glob in " + option + ": " + pattern)
+	}
+	return nil
+})
+
+var validateRegexList = validateList(func(option, pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return errors.New("Invalid regex in " + option + ": " + pattern)
+	}
+	return nil
+})
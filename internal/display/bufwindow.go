@@ -370,17 +370,7 @@ func (w *BufWindow) displayBuffer() {
 	}
 
 	if b.Settings["syntax"].(bool) && b.SyntaxDef != nil {
-		for _, c := range b.GetCursors() {
-			// rehighlight starting from where the cursor is
-			start := c.Y
-			if start > 0 && b.Rehighlight(start-1) {
-				b.Highlighter.ReHighlightLine(b, start-1)
-				b.SetRehighlight(start-1, false)
-			}
-
-			b.Highlighter.ReHighlightStates(b, start)
-			b.Highlighter.HighlightMatches(b, w.StartLine, w.StartLine+bufHeight)
-		}
+		b.EnsureHighlighted(w.StartLine, w.StartLine+bufHeight)
 	}
 
 	var matchingBraces []buffer.Loc
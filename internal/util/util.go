@@ -1,6 +1,9 @@
 package util
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -187,6 +190,56 @@ func StringWidth(b []byte, n, tabsize int) int {
 	return width
 }
 
+// ExpandTabs replaces tabs in the given byte array with the number of spaces
+// needed to reach the next tabstop
+// If leading is true only the tabs in the leading whitespace are replaced
+func ExpandTabs(b []byte, tabsize int, leading bool) []byte {
+	return expandTabs(b, tabsize, leading, 0)
+}
+
+// ExpandTabsAt is like ExpandTabs (replacing all tabs) for text that starts
+// at the visual column col of a line
+func ExpandTabsAt(b []byte, tabsize, col int) []byte {
+	return expandTabs(b, tabsize, false, col)
+}
+
+func expandTabs(b []byte, tabsize int, leading bool, width int) []byte {
+	if !bytes.ContainsRune(b, '\t') {
+		return b
+	}
+
+	res := make([]byte, 0, len(b))
+	inLeading := true
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+
+		switch r {
+		case '\t':
+			ts := tabsize - (width % tabsize)
+			if inLeading || !leading {
+				res = append(res, Spaces(ts)...)
+			} else {
+				res = append(res, '\t')
+			}
+			width += ts
+		case ' ':
+			res = append(res, ' ')
+			width++
+		case '\n':
+			res = append(res, '\n')
+			width = 0
+			inLeading = true
+		default:
+			inLeading = false
+			res = append(res, b[:size]...)
+			width += runewidth.RuneWidth(r)
+		}
+
+		b = b[size:]
+	}
+	return res
+}
+
 // Min takes the min of two ints
 func Min(a, b int) int {
 	if a > b {
@@ -304,6 +357,23 @@ func ReplaceHome(path string) (string, error) {
 	return strings.Replace(path, homeString, home, 1), nil
 }
 
+// AbbreviateHome replaces the current user's home directory at the start of
+// path with ~, which is the inverse of ReplaceHome
+func AbbreviateHome(path string) string {
+	userData, err := user.Current()
+	if err != nil || userData.HomeDir == "" {
+		return path
+	}
+	home := filepath.Clean(userData.HomeDir)
+	if path == home {
+		return "~"
+	}
+	if strings.HasPrefix(path, home+string(filepath.Separator)) {
+		return "~" + path[len(home):]
+	}
+	return path
+}
+
 // GetPathAndCursorPosition returns a filename without everything following a `:`
 // This is used for opening files like util.go:10:5 to specify a line and column
 // Special cases like Windows Absolute path (C:\myfile.txt:10:5) are handled correctly.
@@ -321,6 +391,31 @@ func GetPathAndCursorPosition(path string) (string, []string) {
 	return match[1], []string{match[2], "0"}
 }
 
+var windowsPath = regexp.MustCompile(`^([A-Za-z]):(?:[\\/](.*))?$`)
+var wslPath = regexp.MustCompile(`^/mnt/([a-z])(?:/(.*))?$`)
+
+// WindowsToWSLPath converts an absolute Windows path such as C:\Users\me to the
+// path of the same file in the Windows Subsystem for Linux, /mnt/c/Users/me
+// It returns false if path is not an absolute Windows path
+func WindowsToWSLPath(path string) (string, bool) {
+	match := windowsPath.FindStringSubmatch(path)
+	if match == nil {
+		return path, false
+	}
+	return "/mnt/" + strings.ToLower(match[1]) + "/" + strings.Replace(match[2], "\\", "/", -1), true
+}
+
+// WSLToWindowsPath converts a path in the Windows Subsystem for Linux such as
+// /mnt/c/Users/me to the Windows path of the same file, C:\Users\me
+// It returns false if path is not on a Windows drive
+func WSLToWindowsPath(path string) (string, bool) {
+	match := wslPath.FindStringSubmatch(path)
+	if match == nil {
+		return path, false
+	}
+	return strings.ToUpper(match[1]) + ":\\" + strings.Replace(match[2], "/", "\\", -1), true
+}
+
 // GetModTime returns the last modification time for a given file
 func GetModTime(path string) (time.Time, error) {
 	info, err := os.Stat(path)
@@ -336,6 +431,19 @@ func EscapePath(path string) string {
 	return strings.Replace(path, "/", "%", -1)
 }
 
+// EscapePathLimited is like EscapePath, but if the escaped path is longer than
+// max bytes (file systems usually limit file names to 255 bytes) it returns
+// the hex encoded sha256 hash of the path instead
+// The second return value reports whether the path was hashed
+func EscapePathLimited(path string, max int) (string, bool) {
+	escaped := EscapePath(path)
+	if len(escaped) <= max {
+		return escaped, false
+	}
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:]), true
+}
+
 // GetLeadingWhitespace returns the leading whitespace of the given byte array
 func GetLeadingWhitespace(b []byte) []byte {
 	ws := []byte{}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,3 +32,49 @@ func TestSliceVisualEnd(t *testing.T) {
 	assert.Equal(t, []byte("ello"), slc)
 	assert.Equal(t, 0, n)
 }
+
+func TestExpandTabs(t *testing.T) {
+	b := []byte("\t  \tfoo\t\"a\tb\"")
+
+	assert.Equal(t, []byte("        foo \"a  b\""), ExpandTabs(b, 4, false))
+	assert.Equal(t, []byte("        foo\t\"a\tb\""), ExpandTabs(b, 4, true))
+	assert.Equal(t, []byte("no tabs"), ExpandTabs([]byte("no tabs"), 4, false))
+}
+
+func TestEscapePathLimited(t *testing.T) {
+	name, hashed := EscapePathLimited("/home/user/file.txt", 255)
+	assert.Equal(t, "%home%user%file.txt", name)
+	assert.False(t, hashed)
+
+	long := "/" + strings.Repeat("a", 300)
+	name, hashed = EscapePathLimited(long, 255)
+	assert.True(t, hashed)
+	assert.Equal(t, 64, len(name))
+	other, _ := EscapePathLimited(long+"b", 255)
+	assert.NotEqual(t, name, other)
+}
+
+func TestExpandTabsAt(t *testing.T) {
+	assert.Equal(t, []byte("  foo\n    bar"), ExpandTabsAt([]byte("\tfoo\n\tbar"), 4, 2))
+	assert.Equal(t, []byte("ab  c"), ExpandTabsAt([]byte("ab\tc"), 4, 0))
+}
+
+func TestWSLPaths(t *testing.T) {
+	p, ok := WindowsToWSLPath(`C:\Users\me\file.txt`)
+	assert.True(t, ok)
+	assert.Equal(t, "/mnt/c/Users/me/file.txt", p)
+	p, ok = WindowsToWSLPath("d:/src")
+	assert.True(t, ok)
+	assert.Equal(t, "/mnt/d/src", p)
+	_, ok = WindowsToWSLPath("/home/me/file.txt")
+	assert.False(t, ok)
+
+	p, ok = WSLToWindowsPath("/mnt/c/Users/me/file.txt")
+	assert.True(t, ok)
+	assert.Equal(t, `C:\Users\me\file.txt`, p)
+	p, ok = WSLToWindowsPath("/mnt/d")
+	assert.True(t, ok)
+	assert.Equal(t, `D:\`, p)
+	_, ok = WSLToWindowsPath("/mnt/data/file.txt")
+	assert.False(t, ok)
+}
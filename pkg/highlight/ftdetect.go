@@ -16,3 +16,17 @@ func MatchFiletype(ftdetect [2]*regexp.Regexp, filename string, firstLine []byte
 
 	return false
 }
+
+// FiletypeScore returns how specifically the detection rules match the file
+// A match on the first line of the file is more specific than a match on the
+// filename, and matching both is better still. A score of 0 means no match
+func FiletypeScore(ftdetect [2]*regexp.Regexp, filename string, firstLine []byte) int {
+	score := 0
+	if ftdetect[0] != nil && ftdetect[0].MatchString(filename) {
+		score++
+	}
+	if ftdetect[1] != nil && ftdetect[1].Match(firstLine) {
+		score += 2
+	}
+	return score
+}
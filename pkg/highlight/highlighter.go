@@ -356,13 +356,28 @@ func (h *Highlighter) HighlightMatches(input LineStates, startline, endline int)
 // ReHighlightStates will scan down from `startline` and set the appropriate end of line state
 // for each line until it comes across the same state in two consecutive lines
 func (h *Highlighter) ReHighlightStates(input LineStates, startline int) {
+	h.ReHighlightStatesTo(input, startline, startline)
+}
+
+// ReHighlightStatesTo is like ReHighlightStates but always sets the states of all the lines
+// from `startline` to `endline` before it stops at a line whose state did not change
+// This is needed when several consecutive lines were edited
+func (h *Highlighter) ReHighlightStatesTo(input LineStates, startline, endline int) {
+	h.ReHighlightStatesUntil(input, startline, endline, input.LinesNum()-1)
+}
+
+// ReHighlightStatesUntil is like ReHighlightStatesTo but does not set the state of any line
+// after `limit`, even if the states have not converged yet
+// It returns the last line whose state was set
+func (h *Highlighter) ReHighlightStatesUntil(input LineStates, startline, endline, limit int) int {
 	// lines := input.LineData()
 
 	h.lastRegion = nil
 	if startline > 0 {
 		h.lastRegion = input.State(startline - 1)
 	}
-	for i := startline; i < input.LinesNum(); i++ {
+	i := startline
+	for ; i < input.LinesNum() && i <= limit; i++ {
 		line := input.LineBytes(i)
 		// highlights := make(LineMatch)
 
@@ -377,10 +392,11 @@ func (h *Highlighter) ReHighlightStates(input LineStates, startline int) {
 
 		input.SetState(i, curState)
 
-		if curState == lastState {
-			break
+		if i >= endline && curState == lastState {
+			return i
 		}
 	}
+	return i - 1
 }
 
 // ReHighlightLine will rehighlight the state and match for a single line